@@ -0,0 +1,184 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"task-manager-api/events"
+	"task-manager-api/models"
+	"task-manager-api/utils"
+)
+
+// read a task inside a transaction and lock its row until the transaction ends, tasks in the trash are not found
+func lockTask(tx *sql.Tx, id int) (models.Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM ` + taskFrom + ` WHERE t.task_id = $1 AND t.deleted_at IS NULL FOR UPDATE OF t`
+	t, err := scanTask(tx.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("task ID %d: %w", id, ErrTaskNotFound)
+	}
+	return t, err
+}
+
+func snapshotOf(t models.Task) models.TaskSnapshot {
+	return models.TaskSnapshot{Name: t.Name, Description: t.Description, Status: t.Status, ProjectID: t.ProjectID,
+		Priority: t.Priority, DueAt: t.DueAt, Labels: t.Labels, Recurrence: t.Recurrence}
+}
+
+// field level differences between two snapshots, a nil snapshot stands for a task that does not exist
+func diffSnapshots(before, after *models.TaskSnapshot) map[string]models.FieldChange {
+	fields := func(s *models.TaskSnapshot) map[string]interface{} {
+		if s == nil {
+			return map[string]interface{}{"name": nil, "description": nil, "status": nil, "project_id": nil,
+				"priority": nil, "due_at": nil, "labels": nil, "recurrence": nil}
+		}
+		snap := snapshotDefaults(*s)
+		var projectID, dueAt interface{}
+		if snap.ProjectID != nil {
+			projectID = *snap.ProjectID
+		}
+		if snap.DueAt != nil {
+			dueAt = snap.DueAt.UTC().Format(time.RFC3339)
+		}
+		return map[string]interface{}{"name": snap.Name, "description": snap.Description, "status": snap.Status,
+			"project_id": projectID, "priority": snap.Priority, "due_at": dueAt, "labels": snap.Labels,
+			"recurrence": snap.Recurrence}
+	}
+	from, to := fields(before), fields(after)
+
+	changes := map[string]models.FieldChange{}
+	for name := range from {
+		if !reflect.DeepEqual(from[name], to[name]) {
+			changes[name] = models.FieldChange{From: from[name], To: to[name]}
+		}
+	}
+	return changes
+}
+
+// operation is one mutating request: a transaction and the id that groups the activity entries
+// it writes, so the whole request can be undone at once
+type operation struct {
+	tx       *sql.Tx
+	id       string
+	actor    string
+	undoOf   string         // set when the operation undoes an earlier one
+	pending  []events.Event // published by commit
+	webhooks bool           // deliveries were queued
+}
+
+func beginOperation(actorEmail string) (*operation, error) {
+	id, err := utils.GenerateRandomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &operation{tx: tx, id: id, actor: actorEmail}, nil
+}
+
+// append an entry to the activity log as part of the operation that made the change. before is
+// nil for created tasks and after is nil for deleted ones, updates that change nothing are skipped
+func recordActivity(op *operation, action string, before, after *models.Task) error {
+	var beforeSnap, afterSnap *models.TaskSnapshot
+	task := after
+	if before != nil {
+		s := snapshotOf(*before)
+		beforeSnap, task = &s, before
+	}
+	if after != nil {
+		s := snapshotOf(*after)
+		afterSnap = &s
+	}
+	changes := diffSnapshots(beforeSnap, afterSnap)
+	if action == models.ActivityUpdated && len(changes) == 0 {
+		return nil
+	}
+	snapshot := afterSnap
+	if snapshot == nil {
+		snapshot = beforeSnap
+	}
+
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// the task row is locked by the caller, so versions of one task cannot race
+	query := `INSERT INTO task_activity (task_id, workspace_id, owner_id, actor_id, action, version, changes, snapshot,
+			operation_id, undo_of)
+		VALUES($1, $2, $3, (SELECT user_id FROM users WHERE email = $4), $5,
+			(SELECT COALESCE(MAX(version), 0) + 1 FROM task_activity WHERE task_id = $1), $6::JSONB, $7::JSONB,
+			$8, NULLIF($9, ''))`
+	_, err = op.tx.Exec(query, task.ID, task.WorkspaceID, task.OwnerID, op.actor, action, string(changesJSON), string(snapshotJSON),
+		op.id, op.undoOf)
+	if err != nil {
+		return err
+	}
+	return queueEvent(op, action, task, after, changes)
+}
+
+const activitySelect = `SELECT a.activity_id, a.task_id, a.workspace_id, a.actor_id, COALESCE(u.email, ''), a.action,
+	a.version, a.changes, a.snapshot, a.operation_id, a.created_at
+	FROM task_activity a LEFT JOIN users u ON u.user_id = a.actor_id`
+
+// read activity rows of a query
+func scanActivity(rows *sql.Rows) ([]models.ActivityEntry, error) {
+	defer rows.Close()
+
+	entries := []models.ActivityEntry{}
+	for rows.Next() {
+		var e models.ActivityEntry
+		var changes, snapshot []byte
+		err := rows.Scan(&e.ID, &e.TaskID, &e.WorkspaceID, &e.ActorID, &e.ActorEmail, &e.Action,
+			&e.Version, &changes, &snapshot, &e.OperationID, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(snapshot, &e.Snapshot); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// history of a task, newest first, for anyone who can see the task
+func GetTaskHistory(id int, userEmail string, limit, offset int) ([]models.ActivityEntry, error) {
+	if _, err := TaskPermission(id, userEmail); err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(activitySelect+` WHERE a.task_id = $1 ORDER BY a.version DESC LIMIT $2 OFFSET $3`, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanActivity(rows)
+}
+
+// activity feed of the user, newest first: the user's own changes and changes to personal tasks
+// they own, tasks in their workspaces and tasks or projects shared with them
+func GetActivityFeed(userEmail string, limit, offset int) ([]models.ActivityEntry, error) {
+	query := activitySelect + `
+		CROSS JOIN (SELECT user_id FROM users WHERE email = $1) me
+		WHERE a.actor_id = me.user_id
+			OR (a.workspace_id IS NULL AND a.owner_id = me.user_id)
+			OR a.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = me.user_id)
+			OR a.task_id IN (SELECT task_id FROM task_shares WHERE user_email = $1)
+			OR a.task_id IN (SELECT t.task_id FROM tasks t JOIN project_shares ps ON ps.project_id = t.project_id WHERE ps.user_email = $1)
+		ORDER BY a.activity_id DESC LIMIT $2 OFFSET $3`
+	rows, err := DB.Query(query, userEmail, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanActivity(rows)
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"task-manager-api/models"
+	"task-manager-api/utils"
+)
+
+var (
+	ErrUserNotFound          = errors.New("user not found")
+	ErrAccountDisabled       = errors.New("account is disabled")
+	ErrPasswordResetRequired = errors.New("password reset required")
+	ErrInvalidResetToken     = errors.New("invalid or expired reset token")
+	ErrWrongPassword         = errors.New("current password is incorrect")
+)
+
+// check that the account is still allowed to use the API and return its current role, which may
+// differ from the role in a token issued earlier
+func CheckAccountStatus(email string) (string, error) {
+	var role string
+	var disabled, mustReset bool
+	query := `SELECT role, disabled, must_reset_password FROM users WHERE email = $1`
+	err := DB.QueryRow(query, email).Scan(&role, &disabled, &mustReset)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+	if disabled {
+		return "", ErrAccountDisabled
+	}
+	if mustReset {
+		return "", ErrPasswordResetRequired
+	}
+	return role, nil
+}
+
+// list users, optionally filtered by a search term matched against username and email
+func ListUsers(search string, limit, offset int) ([]models.Users, error) {
+	query := `SELECT user_id, username, email, role, disabled, must_reset_password FROM users
+		WHERE $1 = '' OR username ILIKE '%' || $1 || '%' OR email ILIKE '%' || $1 || '%'
+		ORDER BY email LIMIT $2 OFFSET $3`
+
+	rows, err := DB.Query(query, strings.TrimSpace(search), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.Users{}
+	for rows.Next() {
+		var u models.Users
+		err = rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.Disabled, &u.MustResetPassword)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// update a single column of a user row, returns ErrUserNotFound when no user matched
+func updateUser(email, setClause string, args ...interface{}) error {
+	args = append(args, email)
+	query := fmt.Sprintf(`UPDATE users SET %s WHERE email = $%d`, setClause, len(args))
+	res, err := DB.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func SetUserRole(email, role string) error {
+	if !models.IsValidRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+	return updateUser(email, "role = $1", role)
+}
+
+func SetUserDisabled(email string, disabled bool) error {
+	return updateUser(email, "disabled = $1", disabled)
+}
+
+// promote the given existing users to admins, used to bootstrap the first admin accounts
+func EnsureAdmins(emails []string) error {
+	for _, email := range emails {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		err := SetUserRole(email, models.RoleAdmin)
+		if err == ErrUserNotFound {
+			log.Printf("Admin bootstrap: user %s does not exist yet", email)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark the user as having to reset their password and create a one time reset token,
+// the plain token is returned once and only its hash is stored
+func ForcePasswordReset(email string, ttl time.Duration) (string, time.Time, error) {
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET must_reset_password = TRUE WHERE email = $1`, email)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", time.Time{}, ErrUserNotFound
+	}
+
+	query := `INSERT INTO password_resets (token_hash, user_email, expires_at) VALUES($1, $2, $3)`
+	_, err = tx.Exec(query, utils.HashToken(token), email, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, tx.Commit()
+}
+
+// consume a reset token and set the new password, returns the email of the account that was reset
+func ResetPassword(token, newPassword string) (string, error) {
+	if newPassword == "" {
+		return "", fmt.Errorf("password cannot be empty")
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var email string
+	query := `UPDATE password_resets SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_email`
+	err = tx.QueryRow(query, utils.HashToken(token)).Scan(&email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	var username string
+	if err = tx.QueryRow(`SELECT username FROM users WHERE email = $1`, email).Scan(&username); err != nil {
+		return "", err
+	}
+	// the token stays usable when the new password is rejected since the transaction is rolled back
+	if err = utils.ValidatePassword(newPassword, username, email); err != nil {
+		return "", err
+	}
+
+	hashPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password")
+	}
+	_, err = tx.Exec(`UPDATE users SET pass = $1, must_reset_password = FALSE WHERE email = $2`, hashPassword, email)
+	if err != nil {
+		return "", err
+	}
+	// any other outstanding token for this user is no longer needed
+	_, err = tx.Exec(`UPDATE password_resets SET used_at = NOW() WHERE user_email = $1 AND used_at IS NULL`, email)
+	if err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	log.Printf("Password reset for user %s", email)
+	return email, nil
+}
+
+// change the password of a logged in user after checking the current one
+func ChangePassword(email, currentPassword, newPassword string) error {
+	user, err := GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if !utils.CheckPassword(user.Password, currentPassword) {
+		return ErrWrongPassword
+	}
+	if currentPassword == newPassword {
+		return &utils.PasswordPolicyError{Violations: []utils.PasswordViolation{
+			{Code: "unchanged", Message: "new password must be different from the current one"},
+		}}
+	}
+	if err = utils.ValidatePassword(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hashPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to hash password")
+	}
+	if err = updateUser(email, "pass = $1", hashPassword); err != nil {
+		return err
+	}
+	log.Printf("Password changed for user %s", email)
+	return nil
+}
+
+// AUDIT LOG
+
+func RecordAudit(actorEmail, action, target, details string) error {
+	query := `INSERT INTO audit_log (actor_email, action, target, details) VALUES($1, $2, $3, $4)`
+	_, err := DB.Exec(query, actorEmail, action, target, details)
+	if err != nil {
+		log.Printf("Error recording audit entry %s by %s: %s", action, actorEmail, err)
+	}
+	return err
+}
+
+// get audit entries, newest first
+func GetAuditLog(limit, offset int) ([]models.AuditEntry, error) {
+	query := `SELECT audit_id, actor_email, action, target, details, created_at FROM audit_log
+		ORDER BY created_at DESC, audit_id DESC LIMIT $1 OFFSET $2`
+	rows, err := DB.Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		err = rows.Scan(&e.ID, &e.ActorEmail, &e.Action, &e.Target, &e.Details, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"task-manager-api/models"
+	"task-manager-api/utils"
+
+	"github.com/lib/pq"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// how often last_used_at is refreshed, avoids a write on every request
+const apiKeyUsageResolution = time.Minute
+
+// create a new API key for the user, the raw key is returned once and never stored
+func CreateAPIKey(ownerEmail, name string, scopes []string, expiresAt *time.Time) (models.APIKey, string, error) {
+	var key models.APIKey
+	if name == "" {
+		return key, "", fmt.Errorf("API key name is required")
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	rawKey, prefix, err := utils.GenerateAPIKey()
+	if err != nil {
+		return key, "", err
+	}
+
+	query := `INSERT INTO api_keys (owner_email, name, prefix, key_hash, scopes, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING key_id, created_at`
+	err = DB.QueryRow(query, ownerEmail, name, prefix, utils.HashToken(rawKey), pq.Array(scopes), expiresAt).
+		Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		log.Printf("Error creating API key: %s", err)
+		return key, "", err
+	}
+
+	key.Name, key.Prefix, key.Scopes, key.OwnerEmail, key.ExpiresAt = name, prefix, scopes, ownerEmail, expiresAt
+	log.Printf("New API key %s created for %s", prefix, ownerEmail)
+	return key, rawKey, nil
+}
+
+const apiKeyColumns = `key_id, owner_email, name, prefix, scopes, expires_at, last_used_at, last_used_ip, revoked_at, created_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (models.APIKey, error) {
+	var k models.APIKey
+	err := row.Scan(&k.ID, &k.OwnerEmail, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt, &k.CreatedAt)
+	return k, err
+}
+
+// list all keys of a user including revoked and expired ones, newest first
+func ListAPIKeys(ownerEmail string) ([]models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE owner_email = $1 ORDER BY created_at DESC`
+	rows, err := DB.Query(query, ownerEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// returns ErrAPIKeyNotFound when the key was revoked or has expired, for utils.APIKeyStatusCheck
+func CheckAPIKey(id int) error {
+	var active bool
+	query := `SELECT revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW()) FROM api_keys WHERE key_id = $1`
+	err := DB.QueryRow(query, id).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+func RevokeAPIKey(id int, ownerEmail string) error {
+	query := `UPDATE api_keys SET revoked_at = NOW() WHERE key_id = $1 AND owner_email = $2 AND revoked_at IS NULL`
+	res, err := DB.Exec(query, id, ownerEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	log.Printf("API key %d of %s revoked", id, ownerEmail)
+	return nil
+}
+
+// resolve a raw API key to the claims of its owner, used by JWTAuthMiddleware
+func AuthenticateAPIKey(rawKey, clientIP string) (*utils.CustomClaims, error) {
+	if _, err := utils.APIKeyVisiblePrefix(rawKey); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT k.key_id, k.scopes, u.email, u.username, u.role FROM api_keys k
+		JOIN users u ON u.email = k.owner_email
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW())`
+
+	var keyID int
+	var scopes []string
+	claims := &utils.CustomClaims{}
+	err := DB.QueryRow(query, utils.HashToken(rawKey)).Scan(&keyID, pq.Array(&scopes), &claims.Email, &claims.Username, &claims.Role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+	claims.APIKeyID = keyID
+	claims.Subject = claims.Email
+	// a key never grants more than its owner's current role allows, e.g. after losing the admin role
+	claims.Scopes = utils.RestrictScopes(scopes, claims.Role)
+
+	// last used tracking, a failure here should not reject the request
+	_, err = DB.Exec(`UPDATE api_keys SET last_used_at = NOW(), last_used_ip = $2
+		WHERE key_id = $1 AND (last_used_at IS NULL OR last_used_at < $3 OR last_used_ip <> $2)`,
+		keyID, clientIP, time.Now().Add(-apiKeyUsageResolution))
+	if err != nil {
+		log.Printf("Error updating API key usage: %s", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+
+	"task-manager-api/models"
+)
+
+var (
+	ErrAssigneeNoAccess = errors.New("assignee has no access to the task")
+	ErrNotAssigned      = errors.New("user is not assigned to the task")
+)
+
+// assign a user to a task, requires editor access and the assignee must be able to see the task.
+// Assigning someone who is already assigned does nothing
+func AssignTask(id int, actorEmail string, assigneeID int) error {
+	if err := requireTaskPermission(id, actorEmail, models.PermissionEditor); err != nil {
+		return err
+	}
+	var assigneeEmail string
+	err := DB.QueryRow(`SELECT email FROM users WHERE user_id = $1`, assigneeID).Scan(&assigneeEmail)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user ID %d: %w", assigneeID, ErrUserNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = TaskPermission(id, assigneeEmail); err != nil {
+		if errors.Is(err, ErrTaskNotFound) {
+			return fmt.Errorf("%s: %w", assigneeEmail, ErrAssigneeNoAccess)
+		}
+		return err
+	}
+
+	op, err := beginOperation(actorEmail)
+	if err != nil {
+		return err
+	}
+	defer op.tx.Rollback()
+	task, err := lockTask(op.tx, id)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO task_assignees (task_id, user_id, assigned_by)
+		SELECT $1, $2, user_id FROM users WHERE email = $3
+		ON CONFLICT (task_id, user_id) DO NOTHING`
+	res, err := op.tx.Exec(query, id, assigneeID, actorEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if err = recordAssignment(op, task, assigneeID, models.AssignmentAssigned); err != nil {
+		return err
+	}
+	if err = op.commit(); err != nil {
+		return err
+	}
+	log.Printf("Task %d assigned to %s by %s", id, assigneeEmail, actorEmail)
+	return nil
+}
+
+// remove an assignee from a task, editors can remove anyone and assignees can remove themselves
+func UnassignTask(id int, actorEmail string, assigneeID int) error {
+	actor, err := GetUserByEmail(actorEmail)
+	if err != nil {
+		return err
+	}
+	required := models.PermissionEditor
+	if actor.ID == assigneeID {
+		required = models.PermissionViewer
+	}
+	if err = requireTaskPermission(id, actorEmail, required); err != nil {
+		return err
+	}
+
+	op, err := beginOperation(actorEmail)
+	if err != nil {
+		return err
+	}
+	defer op.tx.Rollback()
+	task, err := lockTask(op.tx, id)
+	if err != nil {
+		return err
+	}
+
+	res, err := op.tx.Exec(`DELETE FROM task_assignees WHERE task_id = $1 AND user_id = $2`, id, assigneeID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotAssigned
+	}
+	if err = recordAssignment(op, task, assigneeID, models.AssignmentUnassigned); err != nil {
+		return err
+	}
+	if err = op.commit(); err != nil {
+		return err
+	}
+	log.Printf("User %d unassigned from task %d by %s", assigneeID, id, actorEmail)
+	return nil
+}
+
+// write the assignment history entry, bump the task version and queue a task.updated event with
+// the assignee IDs before and after. Assignees are part of the task representation, so cached
+// copies, ETags and live views must change with them. task is the locked task before the change
+func recordAssignment(op *operation, task models.Task, userID int, action string) error {
+	query := `INSERT INTO task_assignment_history (task_id, user_id, action, actor_id)
+		SELECT $1, $2, $3, user_id FROM users WHERE email = $4`
+	if _, err := op.tx.Exec(query, task.ID, userID, action, op.actor); err != nil {
+		return err
+	}
+	if _, err := op.tx.Exec(`UPDATE tasks SET version = version + 1 WHERE task_id = $1`, task.ID); err != nil {
+		return err
+	}
+
+	after := task
+	after.Version++
+	rows, err := op.tx.Query(`SELECT u.user_id, u.username, u.email FROM task_assignees a
+		JOIN users u ON u.user_id = a.user_id WHERE a.task_id = $1 ORDER BY a.assigned_at`, task.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	after.Assignees = []models.UserSummary{}
+	to := []int{}
+	from := []int{}
+	for rows.Next() {
+		var u models.UserSummary
+		if err = rows.Scan(&u.ID, &u.Username, &u.Email); err != nil {
+			return err
+		}
+		after.Assignees = append(after.Assignees, u)
+		to = append(to, u.ID)
+		if u.ID != userID {
+			from = append(from, u.ID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if action == models.AssignmentUnassigned {
+		from = append(from, userID)
+	}
+	changes := map[string]models.FieldChange{"assignees": {From: from, To: to}}
+	return queueEvent(op, models.ActivityUpdated, &task, &after, changes)
+}
+
+// assignment changes of a task, newest first, for anyone who can see the task
+func GetAssignmentHistory(id int, userEmail string, limit, offset int) ([]models.AssignmentEvent, error) {
+	if _, err := TaskPermission(id, userEmail); err != nil {
+		return nil, err
+	}
+	query := `SELECT h.task_id, h.user_id, u.email, h.action, h.actor_id, a.email, h.created_at
+		FROM task_assignment_history h
+		JOIN users u ON u.user_id = h.user_id
+		JOIN users a ON a.user_id = h.actor_id
+		WHERE h.task_id = $1 ORDER BY h.history_id DESC LIMIT $2 OFFSET $3`
+	rows, err := DB.Query(query, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AssignmentEvent{}
+	for rows.Next() {
+		var e models.AssignmentEvent
+		if err = rows.Scan(&e.TaskID, &e.UserID, &e.UserEmail, &e.Action, &e.ActorID, &e.ActorEmail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// tasks assigned to the given user that the caller can see, optionally limited to one workspace.
+// The assignee may have been given access the caller does not have, those tasks are left out
+func GetAssignedTasks(userEmail string, assigneeID int, workspaceID *int) ([]models.Task, error) {
+	query := `SELECT ` + taskColumns + `, ` + permissionColumns + `
+		FROM ` + taskFrom + ` JOIN task_assignees a ON a.task_id = t.task_id ` + permissionJoins + `
+		WHERE a.user_id = $1 AND ($3::INT IS NULL OR t.workspace_id = $3) AND t.deleted_at IS NULL
+			AND ` + permissionVisible + ` ORDER BY t.task_id`
+	rows, err := DB.Query(query, assigneeID, userEmail, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		t, err := scanTaskWithPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tasks, hydrateTasks(tasks)
+}
+
+// fill in Owner and Assignees of the tasks with two queries for the whole list
+func hydrateTasks(tasks []models.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(tasks))
+	ownerIDs := make([]int64, len(tasks))
+	index := make(map[int][]int, len(tasks)) // a task can be listed more than once
+	for i := range tasks {
+		ids[i] = int64(tasks[i].ID)
+		ownerIDs[i] = int64(tasks[i].OwnerID)
+		index[tasks[i].ID] = append(index[tasks[i].ID], i)
+		tasks[i].Assignees = []models.UserSummary{}
+	}
+
+	owners := map[int]models.UserSummary{}
+	rows, err := DB.Query(`SELECT user_id, username, email FROM users WHERE user_id = ANY($1)`, pq.Array(ownerIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u models.UserSummary
+		if err = rows.Scan(&u.ID, &u.Username, &u.Email); err != nil {
+			return err
+		}
+		owners[u.ID] = u
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range tasks {
+		if owner, ok := owners[tasks[i].OwnerID]; ok {
+			tasks[i].Owner = &owner
+		}
+	}
+
+	query := `SELECT a.task_id, u.user_id, u.username, u.email
+		FROM task_assignees a JOIN users u ON u.user_id = a.user_id
+		WHERE a.task_id = ANY($1) ORDER BY a.assigned_at`
+	rows, err = DB.Query(query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taskID int
+		var u models.UserSummary
+		if err = rows.Scan(&taskID, &u.ID, &u.Username, &u.Email); err != nil {
+			return err
+		}
+		for _, i := range index[taskID] {
+			tasks[i].Assignees = append(tasks[i].Assignees, u)
+		}
+	}
+	return rows.Err()
+}
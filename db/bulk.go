@@ -0,0 +1,122 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"task-manager-api/models"
+)
+
+// bulk operation kinds
+const (
+	BulkCreate   = "create"
+	BulkUpdate   = "update"
+	BulkDelete   = "delete"
+	BulkComplete = "complete"
+)
+
+// ErrBulkAborted is the result of operations that were rolled back or never ran because another
+// operation of an all-or-nothing batch failed
+var ErrBulkAborted = errors.New("not applied, another operation in the batch failed")
+
+// BulkOp is one operation of a batch. Task is used by create, Updates by update (same keys as
+// UpdateTask) and Precondition by update, delete and complete
+type BulkOp struct {
+	Kind         string
+	ID           int
+	Task         models.Task
+	Updates      map[string]interface{}
+	Precondition Precondition
+}
+
+// BulkResult is the outcome of one operation, ID is the new task ID for create
+type BulkResult struct {
+	ID  int
+	Err error
+}
+
+// run a batch of task operations in a single transaction, recorded as one operation so a single
+// undo reverses the whole batch. When atomic is set the first failure rolls back everything,
+// otherwise every operation runs in its own savepoint and failures only undo themselves.
+// Returns the operation ID and whether anything was committed
+func BulkTasks(userEmail string, ops []BulkOp, atomic bool) (string, []BulkResult, bool, error) {
+	results := make([]BulkResult, len(ops))
+
+	op, err := beginOperation(userEmail)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer op.tx.Rollback()
+
+	failed := false
+	for i, item := range ops {
+		if failed {
+			results[i].Err = ErrBulkAborted
+			continue
+		}
+		if !atomic {
+			if _, err = op.tx.Exec(`SAVEPOINT bulk_item`); err != nil {
+				return "", nil, false, err
+			}
+		}
+
+		queued := len(op.pending)
+		results[i].ID, results[i].Err = runBulkOp(op, item)
+
+		switch {
+		case results[i].Err == nil && !atomic:
+			if _, err = op.tx.Exec(`RELEASE SAVEPOINT bulk_item`); err != nil {
+				return "", nil, false, err
+			}
+		case results[i].Err != nil && !atomic:
+			if _, err = op.tx.Exec(`ROLLBACK TO SAVEPOINT bulk_item`); err != nil {
+				return "", nil, false, err
+			}
+			op.pending = op.pending[:queued]
+		case results[i].Err != nil:
+			failed = true
+		}
+	}
+
+	if failed {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i] = BulkResult{Err: ErrBulkAborted}
+			}
+		}
+		return op.id, results, false, nil
+	}
+	if err = op.commit(); err != nil {
+		return "", nil, false, err
+	}
+	log.Printf("Bulk operation %s by %s: %d operations", op.id, userEmail, len(ops))
+	return op.id, results, true, nil
+}
+
+func runBulkOp(op *operation, item BulkOp) (int, error) {
+	switch item.Kind {
+	case BulkCreate:
+		item.Task.OwnerEmail = op.actor
+		return insertTask(op, item.Task)
+	case BulkUpdate:
+		if err := requireTaskPermissionIn(op.tx, item.ID, op.actor, models.PermissionEditor); err != nil {
+			return item.ID, err
+		}
+		return item.ID, updateTask(op, item.ID, item.Updates, item.Precondition)
+	case BulkComplete:
+		if err := requireTaskPermissionIn(op.tx, item.ID, op.actor, models.PermissionEditor); err != nil {
+			return item.ID, err
+		}
+		updates := map[string]interface{}{"status": true, "updated_at": time.Now().UTC()}
+		return item.ID, updateTask(op, item.ID, updates, item.Precondition)
+	case BulkDelete:
+		if err := requireTaskPermissionIn(op.tx, item.ID, op.actor, models.PermissionOwner); err != nil {
+			return item.ID, err
+		}
+		return item.ID, deleteTask(op, item.ID, item.Precondition)
+	default:
+		return item.ID, fmt.Errorf("unknown operation %q", item.Kind)
+	}
+}
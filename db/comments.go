@@ -0,0 +1,78 @@
+package db
+
+import (
+	"log"
+
+	"task-manager-api/models"
+	"task-manager-api/webhooks"
+)
+
+// add a comment to a task, anyone who can see the task can comment on it. Webhooks subscribed to
+// comment.added are queued with the comment
+func AddComment(taskID int, authorEmail, body string) (models.Comment, error) {
+	var c models.Comment
+	if _, err := TaskPermission(taskID, authorEmail); err != nil {
+		return c, err
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO task_comments (task_id, author_id, body)
+		SELECT $1, user_id, $3 FROM users WHERE email = $2
+		RETURNING comment_id, task_id, author_id, body, created_at`
+	err = tx.QueryRow(query, taskID, authorEmail, body).Scan(&c.ID, &c.TaskID, &c.AuthorID, &c.Body, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.AuthorEmail = authorEmail
+
+	var t models.Task
+	err = tx.QueryRow(`SELECT task_id, owner_id, workspace_id FROM tasks WHERE task_id = $1`, taskID).Scan(&t.ID, &t.OwnerID, &t.WorkspaceID)
+	if err != nil {
+		return c, err
+	}
+	audience, err := taskAudience(tx, t)
+	if err != nil {
+		return c, err
+	}
+	queued, err := queueWebhooks(tx, webhooks.CommentAdded, authorEmail, audience, map[string]interface{}{"task_id": taskID, "comment": c})
+	if err != nil {
+		return c, err
+	}
+	if err = tx.Commit(); err != nil {
+		return c, err
+	}
+	if queued {
+		notifyWebhooks()
+	}
+	log.Printf("Comment %d added to task %d by %s", c.ID, taskID, authorEmail)
+	return c, nil
+}
+
+// comments of a task, oldest first, for anyone who can see the task
+func ListComments(taskID int, userEmail string, limit, offset int) ([]models.Comment, error) {
+	if _, err := TaskPermission(taskID, userEmail); err != nil {
+		return nil, err
+	}
+	query := `SELECT c.comment_id, c.task_id, c.author_id, COALESCE(u.email, ''), c.body, c.created_at
+		FROM task_comments c LEFT JOIN users u ON u.user_id = c.author_id
+		WHERE c.task_id = $1 ORDER BY c.comment_id LIMIT $2 OFFSET $3`
+	rows, err := DB.Query(query, taskID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []models.Comment{}
+	for rows.Next() {
+		var c models.Comment
+		if err = rows.Scan(&c.ID, &c.TaskID, &c.AuthorID, &c.AuthorEmail, &c.Body, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
@@ -2,16 +2,16 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"sync"
 	"task-manager-api/models"
 	task "task-manager-api/models"
 	"task-manager-api/utils"
 	_ "task-manager-api/utils"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var DB *sql.DB
@@ -35,6 +35,12 @@ func Init() error {
 		return err
 	}
 	log.Println("Successfully connected to the database")
+
+	err = migrate()
+	if err != nil {
+		log.Printf("Error migrating database: %s", err)
+		return err
+	}
 	return nil
 }
 
@@ -46,99 +52,231 @@ func Close() error {
 	return nil // no need to close, DB is nil
 }
 
-// check if tasks exists in the database
+// check if a task exists in the database and is visible to the user
 func TaskExists(id int, userEmail string) (bool, error) {
-	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM tasks WHERE task_id = $1 AND owner_email = $2)`
-	err := DB.QueryRow(query, id, userEmail).Scan(&exists)
-	return exists, err
+	_, err := TaskPermission(id, userEmail)
+	if errors.Is(err, ErrTaskNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// columns selected for a task by scanTask, queries alias tasks as t and join the owner as u (see taskFrom)
+const taskColumns = `t.task_id, t.name, t.description, t.status, u.email, t.owner_id, t.workspace_id, t.project_id, t.created_at, t.updated_at, t.deleted_at, t.version,
+	t.priority, t.due_at, t.labels, COALESCE(t.recurrence, '')`
+
+const taskFrom = `tasks t JOIN users u ON u.user_id = t.owner_id`
+
+func scanTask(row interface{ Scan(...interface{}) error }) (task.Task, error) {
+	var t task.Task
+	err := row.Scan(taskDest(&t)...)
+	return t, err
+}
+
+// scan destinations for taskColumns
+func taskDest(t *task.Task) []interface{} {
+	return []interface{}{&t.ID, &t.Name, &t.Description, &t.Status, &t.OwnerEmail, &t.OwnerID, &t.WorkspaceID, &t.ProjectID,
+		&t.CreatedAt, &t.UpdatedAt, &t.DeletedAt, &t.Version, &t.Priority, &t.DueAt, pq.Array(&t.Labels), &t.Recurrence}
 }
 
-// insert new task to the database
-func InsertTask(task task.Task) error {
+// read all task rows of a query
+func scanTasks(rows *sql.Rows) ([]task.Task, error) {
+	defer rows.Close() // close database cursor
+
+	tasks := []task.Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// insert new task to the database, OwnerEmail is the creator. Tasks with a WorkspaceID belong to the
+// workspace, the creator must be a member allowed to write there
+func InsertTask(task task.Task) (int, error) {
+	op, err := beginOperation(task.OwnerEmail)
+	if err != nil {
+		return 0, err
+	}
+	defer op.tx.Rollback()
+
+	id, err := insertTask(op, task)
+	if err != nil {
+		return 0, err
+	}
+	if err = op.commit(); err != nil {
+		return 0, err
+	}
+	log.Printf("New task inserted to the DB, task details: %v", task)
+
+	return id, nil
+}
+
+// insert a task as part of op and record it in the activity log
+func insertTask(op *operation, task task.Task) (int, error) {
 	var err error
 	name, desc, status, ownerEmail := task.Name, task.Description, task.Status, task.OwnerEmail
 
-	query := `INSERT INTO tasks (name, description, status, owner_email) VALUES($1, $2, $3, $4)`
+	if task.WorkspaceID != nil {
+		if err = requireWorkspaceRole(*task.WorkspaceID, ownerEmail, models.WorkspaceRoleMember); err != nil {
+			return 0, err
+		}
+	}
+	if task.ProjectID != nil {
+		if err = checkProjectPlacement(*task.ProjectID, task.WorkspaceID); err != nil {
+			return 0, err
+		}
+	}
+
+	if task.Priority == "" {
+		task.Priority = models.PriorityNormal
+	}
+	if task.Labels == nil {
+		task.Labels = []string{}
+	}
 
-	_, err = DB.Exec(query, name, desc, status, ownerEmail)
+	query := `INSERT INTO tasks (name, description, status, owner_id, workspace_id, project_id, priority, due_at, labels, recurrence)
+		SELECT $1, $2, $3::BOOLEAN, user_id, $5::INT, $6::INT, $7, $8::TIMESTAMPTZ, $9::TEXT[], NULLIF($10, '') FROM users WHERE email = $4
+		RETURNING task_id`
+
+	var id int
+	err = op.tx.QueryRow(query, name, desc, status, ownerEmail, task.WorkspaceID, task.ProjectID,
+		task.Priority, task.DueAt, pq.Array(task.Labels), task.Recurrence).Scan(&id)
 	if err != nil {
 		log.Printf("Error inserting task: %s", err)
-		return err
-	} else {
-		log.Printf("New task inserted to the DB, task details: %v", task)
+		return 0, err
 	}
-
-	return nil
+	created, err := lockTask(op.tx, id)
+	if err != nil {
+		return 0, err
+	}
+	return id, recordActivity(op, models.ActivityCreated, nil, &created)
 }
 
-// gets all tasks from database
+// gets all personal tasks of the user from database
 func GetAllTasks(userEmail string) ([]task.Task, error) {
-	var err error
-	var tasks []task.Task
-	query := `SELECT task_id, name, description, status, created_at, updated_at FROM tasks WHERE owner_email = $1`
+	query := `SELECT ` + taskColumns + ` FROM ` + taskFrom + ` WHERE u.email = $1 AND t.workspace_id IS NULL AND t.deleted_at IS NULL ORDER BY t.task_id`
 
 	rows, err := DB.Query(query, userEmail)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close() // close database cursor
-
-	for rows.Next() {
-		var t task.Task
-		err = rows.Scan(&t.ID, &t.Name, &t.Description, &t.Status, &t.CreatedAt, &t.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		tasks = append(tasks, t)
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, err
 	}
-	return tasks, nil
+	return tasks, hydrateTasks(tasks)
 }
 
 // get task from database by given ID
 func GetTask(id int, userEmail string) (task.Task, error) {
-	var err error
 	var task task.Task
-	query := `SELECT task_id, name, description, status, created_at, updated_at FROM tasks WHERE task_id = $1 AND owner_email = $2`
-
-	row := DB.QueryRow(query, id, userEmail)
+	permission, err := TaskPermission(id, userEmail)
+	if err != nil {
+		if errors.Is(err, ErrTaskNotFound) {
+			return task, fmt.Errorf("task with ID: %d was not found: %w", id, ErrTaskNotFound)
+		}
+		return task, err
+	}
+	query := `SELECT ` + taskColumns + ` FROM ` + taskFrom + ` WHERE t.task_id = $1 AND t.deleted_at IS NULL`
 
-	err = row.Scan(&task.ID, &task.Name, &task.Description, &task.Status, &task.CreatedAt, &task.UpdatedAt)
+	task, err = scanTask(DB.QueryRow(query, id))
 	if err != nil {
 		// check if the error suggests that no row was found with the given ID
 		if err == sql.ErrNoRows {
-			return task, fmt.Errorf("task with ID: %d was not found", id)
+			return task, fmt.Errorf("task with ID: %d was not found: %w", id, ErrTaskNotFound)
 		}
 		return task, err
 	}
+	task.Permission = permission
+
+	hydrated := []models.Task{task}
+	if err = hydrateTasks(hydrated); err != nil {
+		return task, err
+	}
+	return hydrated[0], nil
 
-	return task, nil
+}
+
+// ErrPreconditionFailed is returned when a Precondition rejects the current state of a task
+var ErrPreconditionFailed = errors.New("precondition failed, the task was changed in the meantime")
 
+// Precondition is checked against the current task while its row is locked, right before the task
+// is changed, e.g. to compare the version a client last saw. nil means no precondition
+type Precondition func(current task.Task) bool
+
+func checkPrecondition(pre Precondition, current task.Task) error {
+	if pre != nil && !pre(current) {
+		return fmt.Errorf("task ID %d is at version %d: %w", current.ID, current.Version, ErrPreconditionFailed)
+	}
+	return nil
 }
 
-func DeleteTask(id int, userEmail string) error {
-	exists, err := TaskExists(id, userEmail)
+// delete a task, only its owner can do that. The task goes to the trash until it is purged
+func DeleteTask(id int, userEmail string, pre Precondition) error {
+	err := requireTaskPermission(id, userEmail, models.PermissionOwner)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("task ID: %v not found", id)
-	}
 
-	query := `DELETE FROM tasks WHERE task_id=$1`
-	_, err = DB.Exec(query, id)
+	op, err := beginOperation(userEmail)
 	if err != nil {
 		return err
 	}
+	defer op.tx.Rollback()
+
+	if err = deleteTask(op, id, pre); err != nil {
+		return err
+	}
+	if err = op.commit(); err != nil {
+		return err
+	}
 	log.Printf("Task %v deleted successfully", id)
 	return nil
 
 }
 
-func UpdateTask(id int, userEmail string, updates map[string]interface{}) error {
-	if exists, _ := TaskExists(id, userEmail); !exists {
-		return fmt.Errorf("task ID %v was not found", id)
+// move a task to the trash as part of op and record it in the activity log
+func deleteTask(op *operation, id int, pre Precondition) error {
+	before, err := lockTask(op.tx, id)
+	if err != nil {
+		return err
+	}
+	if err = checkPrecondition(pre, before); err != nil {
+		return err
 	}
+	query := `UPDATE tasks SET deleted_at = NOW(), deleted_by = (SELECT user_id FROM users WHERE email = $2), version = version + 1
+		WHERE task_id = $1`
+	_, err = op.tx.Exec(query, id, op.actor)
+	if err != nil {
+		return err
+	}
+	return recordActivity(op, models.ActivityDeleted, &before, nil)
+}
+
+// update task fields, requires editor access
+func UpdateTask(id int, userEmail string, updates map[string]interface{}, pre Precondition) error {
+	if err := requireTaskPermission(id, userEmail, models.PermissionEditor); err != nil {
+		return err
+	}
+	op, err := beginOperation(userEmail)
+	if err != nil {
+		return err
+	}
+	defer op.tx.Rollback()
+
+	if err = updateTask(op, id, updates, pre); err != nil {
+		return err
+	}
+	return op.commit()
+}
+
+// update task fields as part of op and record the changes in the activity log, every update
+// increments the task version
+func updateTask(op *operation, id int, updates map[string]interface{}, pre Precondition) error {
 	setClause := ""         // will be the executed query parameters
 	args := []interface{}{} // init empty slice
 
@@ -147,60 +285,92 @@ func UpdateTask(id int, userEmail string, updates map[string]interface{}) error
 		if setClause != "" {
 			setClause += ", "
 		}
+		if labels, ok := val.([]string); ok {
+			val = pq.Array(labels)
+		}
+		if key == "recurrence" {
+			// stored as NULL when the task does not repeat
+			setClause += fmt.Sprintf("%s = NULLIF($%d, '')", key, i)
+			args = append(args, val)
+			i++
+			continue
+		}
 		setClause += fmt.Sprintf("%s = $%d", key, i)
 		args = append(args, val)
 		i++
 	}
 
+	if setClause != "" {
+		setClause += ", "
+	}
+	setClause += "version = version + 1"
+
 	args = append(args, id)
 	query := fmt.Sprintf(`UPDATE tasks SET %s WHERE task_id = $%d`, setClause, i)
-	_, err := DB.Exec(query, args...)
+
+	before, err := lockTask(op.tx, id)
 	if err != nil {
 		return err
 	}
-	return nil
+	if err = checkPrecondition(pre, before); err != nil {
+		return err
+	}
+	if projectID, ok := updates["project_id"].(*int); ok && projectID != nil {
+		if err = checkProjectPlacement(*projectID, before.WorkspaceID); err != nil {
+			return err
+		}
+	}
+	_, err = op.tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	after, err := lockTask(op.tx, id)
+	if err != nil {
+		return err
+	}
+	return recordActivity(op, models.ActivityUpdated, &before, &after)
 
 }
 
+// get several tasks with one query, in the order of the given IDs. Fails with ErrTaskNotFound
+// when any of them does not exist or is not visible to the user
 func GetMultipleTasks(taskIds []int, userEmail string) ([]task.Task, error) {
-	var wg sync.WaitGroup
-	errsChan := make(chan error, len(taskIds))      // channel to handle errors
-	tasksChan := make(chan task.Task, len(taskIds)) // channel to handle tasks
-	tasks := make([]task.Task, 0, len(taskIds))     // return tasks
+	ids := make([]int64, len(taskIds))
+	for i, id := range taskIds {
+		ids[i] = int64(id)
+	}
+	query := `SELECT ` + taskColumns + `, ` + permissionColumns + `
+		FROM ` + taskFrom + ` ` + permissionJoins + `
+		WHERE t.task_id = ANY($1) AND t.deleted_at IS NULL`
+	rows, err := DB.Query(query, pq.Array(ids), userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	found := make(map[int]task.Task, len(taskIds))
+	for rows.Next() {
+		t, err := scanTaskWithPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		if t.Permission != "" {
+			found[t.ID] = t
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tasks := make([]task.Task, 0, len(taskIds)) // return tasks, in request order
 	for _, id := range taskIds {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			task, err := GetTask(id, userEmail)
-			if err != nil {
-				errsChan <- err
-				return
-			}
-			tasksChan <- task
-		}(id)
-	}
-
-	go func() {
-		wg.Wait()
-		close(tasksChan)
-		close(errsChan)
-	}()
-
-	for {
-		select {
-		case task, ok := <-tasksChan:
-			if ok {
-				tasks = append(tasks, task)
-			} else {
-				return tasks, nil
-			}
-		case err, ok := <-errsChan:
-			if ok {
-				return nil, err
-			}
+		t, ok := found[id]
+		if !ok {
+			return nil, fmt.Errorf("task with ID: %d was not found: %w", id, ErrTaskNotFound)
 		}
+		tasks = append(tasks, t)
 	}
+	return tasks, hydrateTasks(tasks)
 }
 
 // USER FUNC
@@ -221,6 +391,10 @@ func CreateUser(user models.Users) error {
 	if !utils.IsValidEmail(email) {
 		return fmt.Errorf("invalid email format")
 	}
+	// returns *utils.PasswordPolicyError listing every broken rule
+	if err := utils.ValidatePassword(password, username, email); err != nil {
+		return err
+	}
 
 	exists, err := utils.IsEmailExists(email, DB)
 	if err != nil {
@@ -249,11 +423,11 @@ func CreateUser(user models.Users) error {
 func GetUserByEmail(email string) (models.Users, error) {
 	var err error
 	var user models.Users
-	query := `SELECT username, pass, email FROM users WHERE email = $1`
+	query := `SELECT user_id, username, pass, email, role, disabled, must_reset_password FROM users WHERE email = $1`
 
 	row := DB.QueryRow(query, email)
 
-	err = row.Scan(&user.Username, &user.Password, &user.Email)
+	err = row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.Disabled, &user.MustResetPassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("User email: %s not found in database", email)
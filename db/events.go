@@ -0,0 +1,98 @@
+package db
+
+import (
+	"database/sql"
+
+	"task-manager-api/events"
+	"task-manager-api/models"
+)
+
+// EventHub receives an event for every committed task change, nil turns publishing off
+var EventHub *events.Hub
+
+// event types of activity actions, a task restored from the trash appears again like a new one
+var activityEvents = map[string]string{
+	models.ActivityCreated:  events.TaskCreated,
+	models.ActivityRestored: events.TaskCreated,
+	models.ActivityUpdated:  events.TaskUpdated,
+	models.ActivityDeleted:  events.TaskDeleted,
+}
+
+// emails of the users who can see a task (see permissionFor): the creator of a personal task,
+// the members of its workspace and the users it or its project is shared with
+func taskAudience(tx *sql.Tx, t models.Task) ([]string, error) {
+	query := `SELECT email FROM users WHERE user_id = $2 AND $3::INT IS NULL
+		UNION SELECT u.email FROM workspace_members m JOIN users u ON u.user_id = m.user_id WHERE m.workspace_id = $3
+		UNION SELECT user_email FROM task_shares WHERE task_id = $1
+		UNION SELECT ps.user_email FROM project_shares ps JOIN tasks pt ON pt.project_id = ps.project_id WHERE pt.task_id = $1`
+	rows, err := tx.Query(query, t.ID, t.OwnerID, t.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audience := []string{}
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		audience = append(audience, email)
+	}
+	return audience, rows.Err()
+}
+
+// queue the event of an activity entry for webhooks, in the transaction, and for the hub, which
+// gets it once the operation commits. task is the task before the change, after is nil for
+// deleted tasks
+func queueEvent(op *operation, action string, task, after *models.Task, changes map[string]models.FieldChange) error {
+	eventType := webhookEventType(action, changes)
+	if EventHub == nil && eventType == "" {
+		return nil
+	}
+	audience, err := taskAudience(op.tx, *task)
+	if err != nil {
+		return err
+	}
+	// the permission depends on who receives the event
+	current := *task
+	if after != nil {
+		current = *after
+	}
+	current.Permission = ""
+
+	if eventType != "" {
+		queued, err := queueWebhooks(op.tx, eventType, op.actor, audience, map[string]interface{}{"task": current})
+		if err != nil {
+			return err
+		}
+		op.webhooks = op.webhooks || queued
+	}
+	if EventHub == nil {
+		return nil
+	}
+	e := events.Event{Type: activityEvents[action], TaskID: task.ID, WorkspaceID: task.WorkspaceID,
+		ProjectID: task.ProjectID, Actor: op.actor, Changes: changes, Audience: audience}
+	if after != nil {
+		e.Task, e.ProjectID = &current, current.ProjectID
+	}
+	op.pending = append(op.pending, e)
+	return nil
+}
+
+// commit the operation, publish the events of its changes and wake the webhook dispatcher
+func (op *operation) commit() error {
+	if err := op.tx.Commit(); err != nil {
+		return err
+	}
+	if EventHub != nil {
+		for _, e := range op.pending {
+			EventHub.Publish(e)
+		}
+	}
+	op.pending = nil
+	if op.webhooks {
+		notifyWebhooks()
+	}
+	return nil
+}
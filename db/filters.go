@@ -0,0 +1,150 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"task-manager-api/filter"
+	"task-manager-api/models"
+)
+
+var (
+	ErrFilterNotFound  = errors.New("saved filter not found")
+	ErrFilterNameTaken = errors.New("a saved filter with this name already exists")
+)
+
+// tasks the user can see that match the filter expression, limited to one workspace when
+// workspaceID is set. Days and weeks in the expression are those of the user's settings
+func FilterTasks(userEmail string, expr filter.Node, workspaceID *int, limit, offset int) ([]models.Task, error) {
+	user, err := GetUserByEmail(userEmail)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := GetUserSettings(userEmail)
+	if err != nil {
+		return nil, err
+	}
+	env := filter.Env{Now: time.Now(), Location: settings.Location(), WeekStart: settings.FirstWeekday(), UserID: user.ID}
+	// $1 to $4 are used below, permissionJoins expects the caller's email in $2
+	condition, args, err := filter.Compile(expr, env, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + taskColumns + `, ` + permissionColumns + ` FROM ` + taskFrom + ` ` + permissionJoins + `
+		WHERE t.deleted_at IS NULL AND ` + permissionVisible + ` AND ($1::INT IS NULL OR t.workspace_id = $1)
+			AND ` + condition + `
+		ORDER BY t.task_id LIMIT $3 OFFSET $4`
+	rows, err := DB.Query(query, append([]interface{}{workspaceID, userEmail, limit, offset}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		t, err := scanTaskWithPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tasks, hydrateTasks(tasks)
+}
+
+const savedFilterColumns = `filter_id, name, query, created_at, updated_at`
+
+func scanSavedFilter(row interface{ Scan(...interface{}) error }) (models.SavedFilter, error) {
+	var f models.SavedFilter
+	err := row.Scan(&f.ID, &f.Name, &f.Query, &f.CreatedAt, &f.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return f, ErrFilterNotFound
+	}
+	return f, err
+}
+
+// map a unique violation on the filter name to ErrFilterNameTaken
+func savedFilterError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		return ErrFilterNameTaken
+	}
+	return err
+}
+
+// save a filter expression under a name, the query must already be validated with filter.Parse
+func CreateSavedFilter(userEmail, name, query string) (models.SavedFilter, error) {
+	stmt := `INSERT INTO saved_filters (user_id, name, query)
+		SELECT user_id, $2, $3 FROM users WHERE email = $1
+		RETURNING ` + savedFilterColumns
+	f, err := scanSavedFilter(DB.QueryRow(stmt, userEmail, name, query))
+	if err != nil {
+		return f, savedFilterError(err)
+	}
+	log.Printf("Saved filter %d created by %s", f.ID, userEmail)
+	return f, nil
+}
+
+// saved filters of the user, by name
+func ListSavedFilters(userEmail string) ([]models.SavedFilter, error) {
+	query := `SELECT ` + savedFilterColumns + ` FROM saved_filters
+		WHERE user_id = (SELECT user_id FROM users WHERE email = $1) ORDER BY name`
+	rows, err := DB.Query(query, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filters := []models.SavedFilter{}
+	for rows.Next() {
+		f, err := scanSavedFilter(rows)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, rows.Err()
+}
+
+// a saved filter of the user, other users' filters are not found
+func GetSavedFilter(id int, userEmail string) (models.SavedFilter, error) {
+	query := `SELECT ` + savedFilterColumns + ` FROM saved_filters
+		WHERE filter_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)`
+	f, err := scanSavedFilter(DB.QueryRow(query, id, userEmail))
+	if errors.Is(err, ErrFilterNotFound) {
+		return f, fmt.Errorf("filter ID %d: %w", id, ErrFilterNotFound)
+	}
+	return f, err
+}
+
+// rename a saved filter or change its query
+func UpdateSavedFilter(id int, userEmail, name, query string) (models.SavedFilter, error) {
+	stmt := `UPDATE saved_filters SET name = $3, query = $4, updated_at = NOW()
+		WHERE filter_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)
+		RETURNING ` + savedFilterColumns
+	f, err := scanSavedFilter(DB.QueryRow(stmt, id, userEmail, name, query))
+	if errors.Is(err, ErrFilterNotFound) {
+		return f, fmt.Errorf("filter ID %d: %w", id, ErrFilterNotFound)
+	}
+	return f, savedFilterError(err)
+}
+
+func DeleteSavedFilter(id int, userEmail string) error {
+	stmt := `DELETE FROM saved_filters WHERE filter_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)`
+	res, err := DB.Exec(stmt, id, userEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("filter ID %d: %w", id, ErrFilterNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"task-manager-api/utils"
+)
+
+// IdempotencyStore keeps Idempotency-Key reservations and responses in the database so retries
+// that reach another instance are recognised too
+type IdempotencyStore struct{}
+
+var _ utils.IdempotencyStore = IdempotencyStore{}
+
+func (IdempotencyStore) Reserve(key, fingerprint string, now time.Time, ttl time.Duration) (utils.IdempotencyRecord, bool, error) {
+	// the primary key makes concurrent duplicates race on the insert, exactly one of them wins.
+	// Expired keys are taken over as if they were free
+	query := `INSERT INTO idempotency_keys (idempotency_key, fingerprint, created_at, expires_at) VALUES($1, $2, $3, $4)
+		ON CONFLICT (idempotency_key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, completed = FALSE, status = 0, header = '{}', body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.created_at
+		RETURNING idempotency_key`
+	var reserved string
+	err := DB.QueryRow(query, key, fingerprint, now, now.Add(ttl)).Scan(&reserved)
+	if err == nil {
+		return utils.IdempotencyRecord{Fingerprint: fingerprint}, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return utils.IdempotencyRecord{}, false, err
+	}
+
+	var rec utils.IdempotencyRecord
+	var header []byte
+	query = `SELECT fingerprint, completed, status, header, COALESCE(body, '') FROM idempotency_keys WHERE idempotency_key = $1`
+	err = DB.QueryRow(query, key).Scan(&rec.Fingerprint, &rec.Completed, &rec.Status, &header, &rec.Body)
+	if err == sql.ErrNoRows {
+		// released between the insert and the select
+		return rec, false, fmt.Errorf("idempotency key was released concurrently")
+	}
+	if err != nil {
+		return rec, false, err
+	}
+	if err = json.Unmarshal(header, &rec.Header); err != nil {
+		return rec, false, err
+	}
+	return rec, false, nil
+}
+
+func (IdempotencyStore) Complete(key string, rec utils.IdempotencyRecord) error {
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE idempotency_keys SET completed = TRUE, status = $2, header = $3::JSONB, body = $4
+		WHERE idempotency_key = $1 AND fingerprint = $5`
+	_, err = DB.Exec(query, key, rec.Status, string(header), rec.Body, rec.Fingerprint)
+	return err
+}
+
+func (IdempotencyStore) Release(key string) error {
+	_, err := DB.Exec(`DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND NOT completed`, key)
+	return err
+}
+
+// remove expired idempotency keys, called periodically
+func PurgeIdempotencyKeys() error {
+	_, err := DB.Exec(`DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	return err
+}
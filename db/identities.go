@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"task-manager-api/utils"
+)
+
+// find the local user for an external identity, linking it by verified email on first login.
+// A user is created when no local account has that email, its password is random and unknown
+// so it can only log in through the provider (or after a password reset)
+func LinkExternalIdentity(issuer, subject, email, name string) (string, error) {
+	var userEmail string
+	query := `UPDATE user_identities SET last_login_at = NOW() WHERE issuer = $1 AND subject = $2 RETURNING user_email`
+	err := DB.QueryRow(query, issuer, subject).Scan(&userEmail)
+	if err == nil {
+		return userEmail, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if !utils.IsValidEmail(email) {
+		return "", fmt.Errorf("identity provider returned an invalid email")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT email FROM users WHERE LOWER(email) = LOWER($1)`, email).Scan(&userEmail)
+	if err == sql.ErrNoRows {
+		userEmail = email
+		username := name
+		if username == "" {
+			username = strings.SplitN(email, "@", 2)[0]
+		}
+		random, err := utils.GenerateRandomToken(32)
+		if err != nil {
+			return "", err
+		}
+		hashPassword, err := utils.HashPassword(random)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password")
+		}
+		_, err = tx.Exec(`INSERT INTO users (username, pass, email) VALUES($1, $2, $3)`, username, hashPassword, userEmail)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("new user created from external identity: %s", userEmail)
+	} else if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO user_identities (issuer, subject, user_email) VALUES($1, $2, $3)`, issuer, subject, userEmail)
+	if err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	log.Printf("External identity %s|%s linked to %s", issuer, subject, userEmail)
+	return userEmail, nil
+}
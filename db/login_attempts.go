@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"task-manager-api/utils"
+)
+
+// LoginAttemptStore keeps failed login counters in the database so every instance sees them
+type LoginAttemptStore struct{}
+
+var _ utils.AttemptStore = LoginAttemptStore{}
+
+func (LoginAttemptStore) Get(key string) (utils.AttemptRecord, error) {
+	var rec utils.AttemptRecord
+	var lockedUntil sql.NullTime
+	query := `SELECT failures, last_failure, locked_until FROM login_attempts WHERE attempt_key = $1`
+	err := DB.QueryRow(query, key).Scan(&rec.Failures, &rec.LastFailure, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return rec, nil
+	}
+	rec.LockedUntil = lockedUntil.Time
+	return rec, err
+}
+
+func (LoginAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (utils.AttemptRecord, error) {
+	var rec utils.AttemptRecord
+	var lockedUntil sql.NullTime
+	query := `INSERT INTO login_attempts (attempt_key, failures, last_failure) VALUES($1, 1, $2)
+		ON CONFLICT (attempt_key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+		RETURNING failures, last_failure, locked_until`
+	err := DB.QueryRow(query, key, now, now.Add(-window)).Scan(&rec.Failures, &rec.LastFailure, &lockedUntil)
+	rec.LockedUntil = lockedUntil.Time
+	return rec, err
+}
+
+func (LoginAttemptStore) Lock(key string, until time.Time) error {
+	_, err := DB.Exec(`UPDATE login_attempts SET locked_until = $2 WHERE attempt_key = $1`, key, until)
+	return err
+}
+
+func (LoginAttemptStore) Reset(key string) error {
+	_, err := DB.Exec(`DELETE FROM login_attempts WHERE attempt_key = $1`, key)
+	return err
+}
+
+// remove counters that no longer matter, called periodically
+func PurgeLoginAttempts(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	_, err := DB.Exec(`DELETE FROM login_attempts WHERE last_failure < $1 AND (locked_until IS NULL OR locked_until < NOW())`, cutoff)
+	return err
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"task-manager-api/models"
+)
+
+var (
+	ErrTaskNotFound     = errors.New("task not found")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// the caller's permission on a task: owner, editor or viewer. Tasks the user has no access to
+// are reported as ErrTaskNotFound so their existence is not revealed.
+// Personal tasks belong to their creator. Workspace tasks are owned by the workspace: owners and
+// admins manage every task, members manage their own and edit the rest, guests can only view.
+// A share of the task or of its project can raise the permission further
+func TaskPermission(id int, userEmail string) (string, error) {
+	return taskPermission(id, userEmail, false)
+}
+
+// querier is implemented by *sql.DB and *sql.Tx, for lookups that must also see changes made
+// earlier in the same transaction
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// columns that permissionFor needs, queries alias the caller's user row as me (see permissionJoins)
+const permissionColumns = `t.owner_id = me.user_id, t.workspace_id IS NOT NULL, COALESCE(m.role, ''), COALESCE(s.permission, '')`
+
+// joins for permissionColumns, $2 is the caller's email
+const permissionJoins = `JOIN users me ON me.email = $2
+	LEFT JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = me.user_id
+	` + shareJoin
+
+// the strongest share of the task with the caller ($2), either of the task itself or of its
+// project, as s.permission and s.created_at
+const shareJoin = `LEFT JOIN LATERAL (SELECT permission, created_at FROM (
+		SELECT permission, created_at FROM task_shares WHERE task_id = t.task_id AND user_email = $2
+		UNION ALL
+		SELECT permission, created_at FROM project_shares WHERE project_id = t.project_id AND user_email = $2) g
+		ORDER BY permission = 'editor' DESC, created_at LIMIT 1) s ON TRUE`
+
+// condition on permissionJoins that holds exactly when permissionFor grants some access, for
+// queries that must filter before LIMIT
+const permissionVisible = `((t.workspace_id IS NULL AND t.owner_id = me.user_id) OR m.role IS NOT NULL OR s.permission IS NOT NULL)`
+
+// scan a row of taskColumns and permissionColumns followed by extra columns, the permission is ""
+// when the caller has no access
+func scanTaskWithPermission(row interface{ Scan(...interface{}) error }, extra ...interface{}) (models.Task, error) {
+	var t models.Task
+	var isCreator, inWorkspace bool
+	var workspaceRole, share string
+	dest := append(taskDest(&t), &isCreator, &inWorkspace, &workspaceRole, &share)
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return t, err
+	}
+	t.Permission = permissionFor(isCreator, inWorkspace, workspaceRole, share)
+	return t, nil
+}
+
+// same as TaskPermission, inTrash selects whether to look at deleted tasks or live ones
+func taskPermission(id int, userEmail string, inTrash bool) (string, error) {
+	return taskPermissionIn(DB, id, userEmail, inTrash)
+}
+
+func taskPermissionIn(q querier, id int, userEmail string, inTrash bool) (string, error) {
+	var (
+		isCreator, inWorkspace bool
+		workspaceRole, share   string
+	)
+	query := `SELECT ` + permissionColumns + ` FROM tasks t ` + permissionJoins + `
+		WHERE t.task_id = $1 AND (t.deleted_at IS NOT NULL) = $3`
+	err := q.QueryRow(query, id, userEmail, inTrash).Scan(&isCreator, &inWorkspace, &workspaceRole, &share)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("task ID %d: %w", id, ErrTaskNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	permission := permissionFor(isCreator, inWorkspace, workspaceRole, share)
+	if permission == "" {
+		return "", fmt.Errorf("task ID %d: %w", id, ErrTaskNotFound)
+	}
+	return permission, nil
+}
+
+// combine the ways a user can get access to a task into one permission, "" means no access
+func permissionFor(isCreator, inWorkspace bool, workspaceRole, share string) string {
+	permission := share
+	grant := func(p string) {
+		if models.PermissionAllows(p, permission) {
+			permission = p
+		}
+	}
+	switch {
+	case !inWorkspace && isCreator:
+		grant(models.PermissionOwner)
+	case workspaceRole == models.WorkspaceRoleOwner || workspaceRole == models.WorkspaceRoleAdmin:
+		grant(models.PermissionOwner)
+	case workspaceRole == models.WorkspaceRoleMember && isCreator:
+		grant(models.PermissionOwner)
+	case workspaceRole == models.WorkspaceRoleMember:
+		grant(models.PermissionEditor)
+	case workspaceRole == models.WorkspaceRoleGuest:
+		grant(models.PermissionViewer)
+	}
+	return permission
+}
+
+// check that the user has at least the required permission on the task
+func requireTaskPermission(id int, userEmail, required string) error {
+	return requireTaskPermissionIn(DB, id, userEmail, required)
+}
+
+func requireTaskPermissionIn(q querier, id int, userEmail, required string) error {
+	permission, err := taskPermissionIn(q, id, userEmail, false)
+	if err != nil {
+		return err
+	}
+	if !models.PermissionAllows(permission, required) {
+		return fmt.Errorf("task ID %d requires %s access: %w", id, required, ErrPermissionDenied)
+	}
+	return nil
+}
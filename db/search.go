@@ -0,0 +1,71 @@
+package db
+
+import (
+	"task-manager-api/models"
+	"task-manager-api/search"
+)
+
+// options for ts_headline. Matches are marked with control characters rather than HTML so the
+// text can be escaped before search.MarkHeadline turns the markers into <mark>
+const headlineOptions = `StartSel="` + search.HeadlineStart + `", StopSel="` + search.HeadlineStop +
+	`", MaxWords=35, MinWords=15, MaxFragments=2`
+
+// search tasks and comments the user can see, best matches first, using the tsvector columns and
+// their GIN indexes
+func SearchTasks(userEmail string, q search.Query, limit, offset int) ([]models.SearchResult, error) {
+	query := `WITH q AS (SELECT to_tsquery('english', $1) AS query),
+		hits AS (
+			SELECT t.task_id, NULL::INT AS comment_id, ts_rank(t.search_vector, q.query) AS rank
+			FROM tasks t, q WHERE t.search_vector @@ q.query AND t.deleted_at IS NULL
+			UNION ALL
+			SELECT c.task_id, c.comment_id, ts_rank(c.search_vector, q.query)
+			FROM task_comments c, q WHERE c.search_vector @@ q.query
+		)
+		SELECT ` + taskColumns + `, ` + permissionColumns + `, h.comment_id, h.rank,
+			ts_headline('english', translate(COALESCE(c.body, t.name || ': ' || t.description), $6, ''), q.query, $5)
+		FROM ` + taskFrom + ` JOIN hits h ON h.task_id = t.task_id ` + permissionJoins + `
+			LEFT JOIN task_comments c ON c.comment_id = h.comment_id
+			CROSS JOIN q
+		WHERE t.deleted_at IS NULL AND ` + permissionVisible + `
+		ORDER BY h.rank DESC, t.task_id, h.comment_id NULLS FIRST LIMIT $3 OFFSET $4`
+	rows, err := DB.Query(query, q.TSQuery(), userEmail, limit, offset, headlineOptions,
+		search.HeadlineStart+search.HeadlineStop)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []models.SearchResult{}
+	for rows.Next() {
+		var res models.SearchResult
+		res.Task, err = scanTaskWithPermission(rows, &res.CommentID, &res.Rank, &res.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		res.Snippet = search.MarkHeadline(res.Snippet)
+		res.Type = models.SearchResultTask
+		if res.CommentID != nil {
+			res.Type = models.SearchResultComment
+		}
+		results = append(results, res)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, hydrateSearchResults(results)
+}
+
+// fill in owner and assignees of the result tasks
+func hydrateSearchResults(results []models.SearchResult) error {
+	tasks := make([]models.Task, len(results))
+	for i := range results {
+		tasks[i] = results[i].Task
+	}
+	if err := hydrateTasks(tasks); err != nil {
+		return err
+	}
+	for i := range results {
+		results[i].Task = tasks[i]
+	}
+	return nil
+}
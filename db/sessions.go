@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"task-manager-api/models"
+	"task-manager-api/utils"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionInvalid  = errors.New("session expired or revoked")
+)
+
+// how often last_seen_at is refreshed, avoids a write on every request
+const sessionSeenResolution = time.Minute
+
+// user agents can be arbitrarily long, only keep what is useful to recognise a device
+const maxUserAgentLength = 512
+
+// create a session for a new login, returns the session ID and the ID of its first refresh token
+func CreateSession(email, userAgent, ip string) (string, string, error) {
+	sessionID, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	refreshID, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	query := `INSERT INTO sessions (session_id, user_email, user_agent, ip, refresh_token_id, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6)`
+	_, err = DB.Exec(query, sessionID, email, userAgent, ip, refreshID, time.Now().Add(utils.RefreshTokenTTL))
+	if err != nil {
+		log.Printf("Error creating session: %s", err)
+		return "", "", err
+	}
+	return sessionID, refreshID, nil
+}
+
+// check that the session is active, used by JWTAuthMiddleware, also tracks when it was last seen
+func CheckSession(sessionID, email string) error {
+	query := `UPDATE sessions SET last_seen_at = NOW()
+		WHERE session_id = $1 AND user_email = $2 AND revoked_at IS NULL AND expires_at > NOW()
+			AND last_seen_at < $3`
+	res, err := DB.Exec(query, sessionID, email, time.Now().Add(-sessionSeenResolution))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	// nothing updated: either seen very recently or not valid anymore
+	var valid bool
+	query = `SELECT EXISTS(SELECT 1 FROM sessions
+		WHERE session_id = $1 AND user_email = $2 AND revoked_at IS NULL AND expires_at > NOW())`
+	if err = DB.QueryRow(query, sessionID, email).Scan(&valid); err != nil {
+		return err
+	}
+	if !valid {
+		return ErrSessionInvalid
+	}
+	return nil
+}
+
+// RotateRefreshToken swaps the session's refresh token ID for a new one and extends the session.
+// Presenting an already used refresh token means it was copied, the whole session is revoked then
+func RotateRefreshToken(sessionID, email, usedTokenID string) (string, error) {
+	newID, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	query := `UPDATE sessions SET refresh_token_id = $4, expires_at = $5, last_seen_at = NOW()
+		WHERE session_id = $1 AND user_email = $2 AND refresh_token_id = $3
+			AND revoked_at IS NULL AND expires_at > NOW()`
+	res, err := DB.Exec(query, sessionID, email, usedTokenID, newID, time.Now().Add(utils.RefreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return newID, nil
+	}
+
+	// reuse of an old refresh token, revoke the session so neither holder can continue
+	res, err = DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE session_id = $1 AND user_email = $2 AND revoked_at IS NULL`, sessionID, email)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		log.Printf("Refresh token reuse detected, session %s of %s revoked", sessionID, email)
+		RecordAudit("system", "session.refresh_reuse", email, "session="+sessionID)
+	}
+	return "", ErrSessionInvalid
+}
+
+// list the active sessions of a user, most recently used first
+func ListSessions(email string) ([]models.Session, error) {
+	query := `SELECT session_id, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions
+		WHERE user_email = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC`
+	rows, err := DB.Query(query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		s := models.Session{UserEmail: email}
+		err = rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func RevokeSession(sessionID, email string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE session_id = $1 AND user_email = $2 AND revoked_at IS NULL`
+	res, err := DB.Exec(query, sessionID, email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// revoke every session of the user except keepSessionID (empty revokes all), returns how many were revoked
+func RevokeUserSessions(email, keepSessionID string) (int64, error) {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE user_email = $1 AND session_id <> $2 AND revoked_at IS NULL`
+	res, err := DB.Exec(query, email, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// delete sessions that ended more than olderThan ago
+func PurgeSessions(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	_, err := DB.Exec(`DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $1`, cutoff)
+	return err
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+
+	"task-manager-api/models"
+)
+
+// settings of the user, the defaults when they were never changed
+func GetUserSettings(userEmail string) (models.UserSettings, error) {
+	s := models.DefaultUserSettings()
+	query := `SELECT s.timezone, s.week_start, s.locale, s.updated_at FROM user_settings s
+		JOIN users u ON u.user_id = s.user_id WHERE u.email = $1`
+	err := DB.QueryRow(query, userEmail).Scan(&s.Timezone, &s.WeekStart, &s.Locale, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return models.DefaultUserSettings(), nil
+	}
+	return s, err
+}
+
+// store the settings of the user, they must already be validated with UserSettings.Validate
+func UpdateUserSettings(userEmail string, s models.UserSettings) (models.UserSettings, error) {
+	stmt := `INSERT INTO user_settings (user_id, timezone, week_start, locale)
+		SELECT user_id, $2, $3, $4 FROM users WHERE email = $1
+		ON CONFLICT (user_id) DO UPDATE SET timezone = EXCLUDED.timezone, week_start = EXCLUDED.week_start,
+			locale = EXCLUDED.locale, updated_at = NOW()
+		RETURNING timezone, week_start, locale, updated_at`
+	var out models.UserSettings
+	err := DB.QueryRow(stmt, userEmail, s.Timezone, s.WeekStart, s.Locale).Scan(&out.Timezone, &out.WeekStart, &out.Locale, &out.UpdatedAt)
+	if err != nil {
+		return out, err
+	}
+	log.Printf("Settings of %s updated", userEmail)
+	return out, nil
+}
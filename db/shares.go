@@ -0,0 +1,210 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"task-manager-api/models"
+)
+
+var ErrShareNotFound = errors.New("share not found")
+
+// share a task with another user or change the permission of an existing share, owner only
+func ShareTask(id int, ownerEmail, targetEmail, permission string) (models.TaskShare, error) {
+	var share models.TaskShare
+	if !models.IsSharePermission(permission) {
+		return share, fmt.Errorf("invalid permission %q, must be viewer or editor", permission)
+	}
+	if err := requireTaskPermission(id, ownerEmail, models.PermissionOwner); err != nil {
+		return share, err
+	}
+	if targetEmail == ownerEmail {
+		return share, fmt.Errorf("cannot share a task with yourself")
+	}
+
+	// workspace admins share tasks they did not create, the creator already owns the task
+	var isCreator bool
+	err := DB.QueryRow(`SELECT t.owner_id = u.user_id FROM users u, tasks t WHERE u.email = $1 AND t.task_id = $2`,
+		targetEmail, id).Scan(&isCreator)
+	if err == sql.ErrNoRows {
+		return share, fmt.Errorf("user %s: %w", targetEmail, ErrUserNotFound)
+	}
+	if err != nil {
+		return share, err
+	}
+	if isCreator {
+		return share, fmt.Errorf("cannot share a task with its owner")
+	}
+
+	query := `INSERT INTO task_shares (task_id, user_email, permission, shared_by) VALUES($1, $2, $3, $4)
+		ON CONFLICT (task_id, user_email) DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING task_id, user_email, permission, shared_by, created_at`
+	err = DB.QueryRow(query, id, targetEmail, permission, ownerEmail).
+		Scan(&share.TaskID, &share.UserEmail, &share.Permission, &share.SharedBy, &share.CreatedAt)
+	if err != nil {
+		return share, err
+	}
+	log.Printf("Task %d shared with %s as %s", id, targetEmail, permission)
+	return share, nil
+}
+
+// list who a task is shared with, visible to the owner only
+func ListTaskShares(id int, ownerEmail string) ([]models.TaskShare, error) {
+	if err := requireTaskPermission(id, ownerEmail, models.PermissionOwner); err != nil {
+		return nil, err
+	}
+	query := `SELECT task_id, user_email, permission, shared_by, created_at FROM task_shares
+		WHERE task_id = $1 ORDER BY created_at`
+	rows, err := DB.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []models.TaskShare{}
+	for rows.Next() {
+		var s models.TaskShare
+		if err = rows.Scan(&s.TaskID, &s.UserEmail, &s.Permission, &s.SharedBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// revoke a share, the owner can revoke anyone and a user can remove their own access
+func RevokeTaskShare(id int, userEmail, targetEmail string) error {
+	if userEmail != targetEmail {
+		if err := requireTaskPermission(id, userEmail, models.PermissionOwner); err != nil {
+			return err
+		}
+	}
+	res, err := DB.Exec(`DELETE FROM task_shares WHERE task_id = $1 AND user_email = $2`, id, targetEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrShareNotFound
+	}
+	log.Printf("Share of task %d with %s revoked", id, targetEmail)
+	return nil
+}
+
+// tasks other users shared with the user, directly or through their project, with the permission
+// they were given
+func GetSharedWithUser(userEmail string) ([]models.Task, error) {
+	query := `SELECT ` + taskColumns + `, s.permission
+		FROM ` + taskFrom + ` ` + strings.ReplaceAll(shareJoin, "$2", "$1") + `
+		WHERE s.permission IS NOT NULL AND t.deleted_at IS NULL ORDER BY s.created_at DESC`
+	rows, err := DB.Query(query, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		var t models.Task
+		if err = rows.Scan(append(taskDest(&t), &t.Permission)...); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tasks, hydrateTasks(tasks)
+}
+
+// the workspace of a project, for users with at least the required role in it
+func requireProjectRole(projectID int, userEmail, required string) error {
+	var workspaceID int
+	err := DB.QueryRow(`SELECT workspace_id FROM projects WHERE project_id = $1`, projectID).Scan(&workspaceID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("project ID %d: %w", projectID, ErrProjectNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if err = requireWorkspaceRole(workspaceID, userEmail, required); errors.Is(err, ErrWorkspaceNotFound) {
+		return fmt.Errorf("project ID %d: %w", projectID, ErrProjectNotFound)
+	}
+	return err
+}
+
+// share a project, and so every task in it, with another user or change the permission of an
+// existing share. Workspace owners and admins only, like managing the tasks themselves
+func ShareProject(projectID int, actorEmail, targetEmail, permission string) (models.ProjectShare, error) {
+	var share models.ProjectShare
+	if !models.IsSharePermission(permission) {
+		return share, fmt.Errorf("invalid permission %q, must be viewer or editor", permission)
+	}
+	if err := requireProjectRole(projectID, actorEmail, models.WorkspaceRoleAdmin); err != nil {
+		return share, err
+	}
+
+	var exists bool
+	if err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`, targetEmail).Scan(&exists); err != nil {
+		return share, err
+	}
+	if !exists {
+		return share, fmt.Errorf("user %s: %w", targetEmail, ErrUserNotFound)
+	}
+
+	query := `INSERT INTO project_shares (project_id, user_email, permission, shared_by) VALUES($1, $2, $3, $4)
+		ON CONFLICT (project_id, user_email) DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING project_id, user_email, permission, shared_by, created_at`
+	err := DB.QueryRow(query, projectID, targetEmail, permission, actorEmail).
+		Scan(&share.ProjectID, &share.UserEmail, &share.Permission, &share.SharedBy, &share.CreatedAt)
+	if err != nil {
+		return share, err
+	}
+	log.Printf("Project %d shared with %s as %s", projectID, targetEmail, permission)
+	return share, nil
+}
+
+// list who a project is shared with, visible to workspace owners and admins
+func ListProjectShares(projectID int, actorEmail string) ([]models.ProjectShare, error) {
+	if err := requireProjectRole(projectID, actorEmail, models.WorkspaceRoleAdmin); err != nil {
+		return nil, err
+	}
+	query := `SELECT project_id, user_email, permission, shared_by, created_at FROM project_shares
+		WHERE project_id = $1 ORDER BY created_at`
+	rows, err := DB.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []models.ProjectShare{}
+	for rows.Next() {
+		var s models.ProjectShare
+		if err = rows.Scan(&s.ProjectID, &s.UserEmail, &s.Permission, &s.SharedBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// revoke a project share, workspace owners and admins can revoke anyone and a user can remove
+// their own access
+func RevokeProjectShare(projectID int, actorEmail, targetEmail string) error {
+	if actorEmail != targetEmail {
+		if err := requireProjectRole(projectID, actorEmail, models.WorkspaceRoleAdmin); err != nil {
+			return err
+		}
+	}
+	res, err := DB.Exec(`DELETE FROM project_shares WHERE project_id = $1 AND user_email = $2`, projectID, targetEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrShareNotFound
+	}
+	log.Printf("Share of project %d with %s revoked", projectID, targetEmail)
+	return nil
+}
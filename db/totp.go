@@ -0,0 +1,194 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"task-manager-api/utils"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two factor authentication is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("two factor authentication enrolment was not started")
+	ErrInvalidTOTPCode    = errors.New("invalid two factor code")
+)
+
+// start (or restart) enrolment with a new secret, the secret is only active after ConfirmTOTP
+func StartTOTPEnrollment(email, secret string) error {
+	query := `INSERT INTO user_totp (user_email, secret) VALUES($1, $2)
+		ON CONFLICT (user_email) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE user_totp.confirmed_at IS NULL`
+	res, err := DB.Exec(query, email, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+// confirm enrolment with the first code from the authenticator app and create the recovery codes,
+// the plain recovery codes are returned once and only stored hashed
+func ConfirmTOTP(email, code string) ([]string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var confirmedAt *time.Time
+	err = tx.QueryRow(`SELECT secret, confirmed_at FROM user_totp WHERE user_email = $1 FOR UPDATE`, email).Scan(&secret, &confirmedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt != nil {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	step, ok := utils.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	_, err = tx.Exec(`UPDATE user_totp SET confirmed_at = NOW(), last_used_step = $2 WHERE user_email = $1`, email, step)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.Printf("Two factor authentication enabled for %s", email)
+	return codes, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, email string) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_email = $1`, email); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash, err := utils.HashPassword(code)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec(`INSERT INTO recovery_codes (user_email, code_hash) VALUES($1, $2)`, email, hash); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// check if the user has confirmed two factor authentication
+func IsTOTPEnabled(email string) (bool, error) {
+	var enabled bool
+	query := `SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_email = $1 AND confirmed_at IS NOT NULL)`
+	err := DB.QueryRow(query, email).Scan(&enabled)
+	return enabled, err
+}
+
+// count the recovery codes that were not used yet
+func RemainingRecoveryCodes(email string) (int, error) {
+	var n int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_email = $1 AND used_at IS NULL`, email).Scan(&n)
+	return n, err
+}
+
+// verify a second factor, either a TOTP code or a recovery code. A TOTP time step and a recovery
+// code can each be used only once
+func VerifySecondFactor(email, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return useRecoveryCode(email, recoveryCode)
+	}
+
+	var secret string
+	var lastStep int64
+	query := `SELECT secret, last_used_step FROM user_totp WHERE user_email = $1 AND confirmed_at IS NOT NULL`
+	err := DB.QueryRow(query, email).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+
+	step, ok := utils.ValidateTOTP(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return ErrInvalidTOTPCode
+	}
+	// the condition on last_used_step makes concurrent use of the same code fail
+	res, err := DB.Exec(`UPDATE user_totp SET last_used_step = $2 WHERE user_email = $1 AND last_used_step < $2`, email, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+func useRecoveryCode(email, code string) error {
+	code = utils.NormalizeRecoveryCode(code)
+	rows, err := DB.Query(`SELECT code_id, code_hash FROM recovery_codes WHERE user_email = $1 AND used_at IS NULL`, email)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err = rows.Scan(&id, &hash); err != nil {
+			return err
+		}
+		if utils.CheckPassword(hash, code) {
+			matched = id
+			break
+		}
+	}
+	if matched == 0 {
+		return ErrInvalidTOTPCode
+	}
+	rows.Close()
+
+	res, err := DB.Exec(`UPDATE recovery_codes SET used_at = NOW() WHERE code_id = $1 AND used_at IS NULL`, matched)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTOTPCode
+	}
+	log.Printf("Recovery code used by %s", email)
+	return nil
+}
+
+// turn off two factor authentication and drop the recovery codes
+func DisableTOTP(email string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM user_totp WHERE user_email = $1`, email); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_email = $1`, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
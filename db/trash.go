@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"task-manager-api/models"
+)
+
+// tasks in the trash that the user could delete, most recently deleted first
+func ListTrash(userEmail string, limit, offset int) ([]models.Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM ` + taskFrom + `
+		CROSS JOIN (SELECT user_id FROM users WHERE email = $1) me
+		LEFT JOIN workspace_members m ON m.workspace_id = t.workspace_id AND m.user_id = me.user_id
+		WHERE t.deleted_at IS NOT NULL AND (
+			(t.workspace_id IS NULL AND t.owner_id = me.user_id)
+			OR m.role IN ('owner', 'admin')
+			OR (m.role = 'member' AND t.owner_id = me.user_id))
+		ORDER BY t.deleted_at DESC LIMIT $2 OFFSET $3`
+	rows, err := DB.Query(query, userEmail, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tasks {
+		tasks[i].Permission = models.PermissionOwner
+	}
+	return tasks, hydrateTasks(tasks)
+}
+
+// check that the user has owner permission on a task in the trash
+func requireTrashPermission(id int, userEmail string) error {
+	permission, err := taskPermission(id, userEmail, true)
+	if err != nil {
+		return err
+	}
+	if permission != models.PermissionOwner {
+		return fmt.Errorf("task ID %d requires owner access: %w", id, ErrPermissionDenied)
+	}
+	return nil
+}
+
+// take a task out of the trash as part of op, returns false when the task is not in the trash
+func restoreTask(op *operation, id int) (bool, error) {
+	res, err := op.tx.Exec(`UPDATE tasks SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+		WHERE task_id = $1 AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	restored, err := lockTask(op.tx, id)
+	if err != nil {
+		return false, err
+	}
+	return true, recordActivity(op, models.ActivityRestored, nil, &restored)
+}
+
+// take a task out of the trash, only its owner can do that
+func RestoreTask(id int, userEmail string) error {
+	if err := requireTrashPermission(id, userEmail); err != nil {
+		return err
+	}
+	op, err := beginOperation(userEmail)
+	if err != nil {
+		return err
+	}
+	defer op.tx.Rollback()
+
+	ok, err := restoreTask(op, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("task ID %d: %w", id, ErrTaskNotFound)
+	}
+	if err = op.commit(); err != nil {
+		return err
+	}
+	log.Printf("Task %d restored from the trash by %s", id, userEmail)
+	return nil
+}
+
+// permanently remove a task that is in the trash, only its owner can do that
+func PurgeTask(id int, userEmail string) error {
+	if err := requireTrashPermission(id, userEmail); err != nil {
+		return err
+	}
+	res, err := DB.Exec(`DELETE FROM tasks WHERE task_id = $1 AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("task ID %d: %w", id, ErrTaskNotFound)
+	}
+	log.Printf("Task %d permanently deleted by %s", id, userEmail)
+	return nil
+}
+
+// permanently remove tasks that have been in the trash for longer than retention
+func PurgeTrash(retention time.Duration) error {
+	res, err := DB.Exec(`DELETE FROM tasks WHERE deleted_at < $1`, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Purged %d tasks from the trash", n)
+	}
+	return nil
+}
+
+// taskInTrash reports whether the task row still exists in the trash
+func taskInTrash(tx *sql.Tx, id int) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM tasks WHERE task_id = $1 AND deleted_at IS NOT NULL)`, id).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"task-manager-api/models"
+)
+
+var (
+	ErrVersionNotFound = errors.New("task version not found")
+	ErrNothingToUndo   = errors.New("nothing to undo")
+	ErrUndoConflict    = errors.New("the task was changed since by an operation that has not been undone")
+	ErrTaskPurged      = errors.New("the task was permanently deleted from the trash")
+)
+
+// how long after an operation it can still be undone
+var UndoWindow = 15 * time.Minute
+
+// read the snapshot stored with a version of a task
+func taskSnapshot(q querier, id, version int) (models.TaskSnapshot, error) {
+	var snap models.TaskSnapshot
+	var raw []byte
+	err := q.QueryRow(`SELECT snapshot FROM task_activity WHERE task_id = $1 AND version = $2`, id, version).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return snap, fmt.Errorf("task ID %d version %d: %w", id, version, ErrVersionNotFound)
+	}
+	if err != nil {
+		return snap, err
+	}
+	return snap, json.Unmarshal(raw, &snap)
+}
+
+// fill in fields that snapshots written before they existed do not have
+func snapshotDefaults(snap models.TaskSnapshot) models.TaskSnapshot {
+	if snap.Priority == "" {
+		snap.Priority = models.PriorityNormal
+	}
+	if snap.Labels == nil {
+		snap.Labels = []string{}
+	}
+	return snap
+}
+
+// set the fields of a task back to a snapshot as part of op
+func applySnapshot(op *operation, id int, snap models.TaskSnapshot) error {
+	snap = snapshotDefaults(snap)
+	return updateTask(op, id, map[string]interface{}{
+		"name":        snap.Name,
+		"description": snap.Description,
+		"status":      snap.Status,
+		"project_id":  snap.ProjectID,
+		"priority":    snap.Priority,
+		"due_at":      snap.DueAt,
+		"labels":      snap.Labels,
+		"recurrence":  snap.Recurrence,
+		"updated_at":  time.Now().UTC(),
+	}, nil)
+}
+
+// restore a task to the snapshot of an earlier version, requires editor access. The revert is
+// recorded as a new version so it can be reverted in turn
+func RevertTask(id int, userEmail string, version int) error {
+	if err := requireTaskPermission(id, userEmail, models.PermissionEditor); err != nil {
+		return err
+	}
+	snap, err := taskSnapshot(DB, id, version)
+	if err != nil {
+		return err
+	}
+
+	op, err := beginOperation(userEmail)
+	if err != nil {
+		return err
+	}
+	defer op.tx.Rollback()
+
+	current, err := lockTask(op.tx, id)
+	if err != nil {
+		return err
+	}
+	if snap.ProjectID != nil {
+		// the project may have been deleted since, the task then stays outside any project
+		if err = checkProjectPlacement(*snap.ProjectID, current.WorkspaceID); errors.Is(err, ErrProjectNotFound) {
+			snap.ProjectID = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if err = applySnapshot(op, id, snap); err != nil {
+		return err
+	}
+	if err = op.commit(); err != nil {
+		return err
+	}
+	log.Printf("Task %d reverted to version %d by %s", id, version, userEmail)
+	return nil
+}
+
+// an activity entry of the operation being undone
+type undoEntry struct {
+	activityID int64
+	taskID     int
+	action     string
+	version    int
+}
+
+// reverse the user's most recent operation that was made within UndoWindow and not undone yet.
+// Undoing again steps further back. Fails with ErrUndoConflict when one of the tasks was changed
+// afterwards by an operation that is still in effect, by anyone, and with ErrTaskPurged when a deleted
+// task was removed from the trash for good. Nothing is undone in either case
+func UndoLastOperation(userEmail string) (models.UndoResult, error) {
+	var result models.UndoResult
+
+	op, err := beginOperation(userEmail)
+	if err != nil {
+		return result, err
+	}
+	defer op.tx.Rollback()
+
+	// serialize undo requests of the same user so one operation cannot be undone twice
+	var userID int
+	err = op.tx.QueryRow(`SELECT user_id FROM users WHERE email = $1 FOR NO KEY UPDATE`, userEmail).Scan(&userID)
+	if err != nil {
+		return result, err
+	}
+
+	query := `SELECT a.operation_id FROM task_activity a
+		WHERE a.actor_id = $1 AND a.operation_id <> '' AND a.undo_of IS NULL AND a.created_at > $2
+			AND NOT EXISTS (SELECT 1 FROM task_activity x WHERE x.undo_of = a.operation_id)
+		ORDER BY a.activity_id DESC LIMIT 1`
+	err = op.tx.QueryRow(query, userID, time.Now().Add(-UndoWindow)).Scan(&result.UndoneOperationID)
+	if err == sql.ErrNoRows {
+		return result, ErrNothingToUndo
+	}
+	if err != nil {
+		return result, err
+	}
+	op.undoOf = result.UndoneOperationID
+	result.OperationID = op.id
+
+	entries, err := operationEntries(op.tx, result.UndoneOperationID)
+	if err != nil {
+		return result, err
+	}
+
+	// first and last entry of every task, tasks are undone in reverse order
+	first := map[int]undoEntry{}
+	last := map[int]undoEntry{}
+	order := []int{}
+	for _, e := range entries {
+		if _, ok := first[e.taskID]; !ok {
+			first[e.taskID] = e
+			order = append(order, e.taskID)
+		}
+		last[e.taskID] = e
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		// operations that were undone since and the undos themselves cancel each other out
+		var conflict bool
+		query := `SELECT EXISTS(SELECT 1 FROM task_activity x WHERE x.task_id = $1 AND x.activity_id > $2 AND x.operation_id <> $3
+			AND x.undo_of IS NULL AND NOT EXISTS (SELECT 1 FROM task_activity u WHERE u.undo_of = x.operation_id))`
+		if err = op.tx.QueryRow(query, id, last[id].activityID, result.UndoneOperationID).Scan(&conflict); err != nil {
+			return result, err
+		}
+		if conflict {
+			return result, fmt.Errorf("task ID %d: %w", id, ErrUndoConflict)
+		}
+		if err = undoTask(op, first[id], last[id]); err != nil {
+			return result, err
+		}
+		result.TaskIDs = append(result.TaskIDs, id)
+	}
+
+	if err = op.commit(); err != nil {
+		return result, err
+	}
+	log.Printf("Operation %s undone by %s", result.UndoneOperationID, userEmail)
+	return result, nil
+}
+
+func operationEntries(tx *sql.Tx, operationID string) ([]undoEntry, error) {
+	query := `SELECT activity_id, task_id, action, version FROM task_activity
+		WHERE operation_id = $1 ORDER BY activity_id`
+	rows, err := tx.Query(query, operationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []undoEntry
+	for rows.Next() {
+		var e undoEntry
+		if err = rows.Scan(&e.activityID, &e.taskID, &e.action, &e.version); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// bring one task back to the state it had before the operation: created or restored tasks go
+// (back) to the trash, deleted tasks come out of it and updated tasks get their previous fields back
+func undoTask(op *operation, first, last undoEntry) error {
+	id := first.taskID
+	if first.action == models.ActivityCreated || first.action == models.ActivityRestored {
+		if err := requireTaskPermission(id, op.actor, models.PermissionOwner); err != nil {
+			if errors.Is(err, ErrTaskNotFound) {
+				return nil // already gone
+			}
+			return err
+		}
+		return deleteTask(op, id, nil)
+	}
+
+	// the snapshot of a delete entry is the task before it was deleted, otherwise the state before
+	// the operation is the snapshot of the previous version
+	before := first.version - 1
+	if first.action == models.ActivityDeleted {
+		before = first.version
+	}
+	snap, err := taskSnapshot(op.tx, id, before)
+	if err != nil {
+		return err
+	}
+	if last.action != models.ActivityDeleted {
+		if err = requireTaskPermission(id, op.actor, models.PermissionEditor); err != nil {
+			return err
+		}
+		return applySnapshot(op, id, snap)
+	}
+
+	// the operation ended by deleting the task, take it out of the trash
+	inTrash, err := taskInTrash(op.tx, id)
+	if err != nil {
+		return err
+	}
+	if inTrash {
+		if err = requireTrashPermission(id, op.actor); err != nil {
+			return err
+		}
+		if _, err = restoreTask(op, id); err != nil {
+			return err
+		}
+		return applySnapshot(op, id, snap)
+	}
+
+	// permanently removed from the trash, by its owner or the retention purge. A purged task stays gone
+	return fmt.Errorf("task ID %d: %w", id, ErrTaskPurged)
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"task-manager-api/models"
+	"task-manager-api/utils"
+	"task-manager-api/webhooks"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// WebhookNotify is called after deliveries were queued so they go out without waiting for the
+// next poll, nil when nothing sends webhooks
+var WebhookNotify func()
+
+func notifyWebhooks() {
+	if WebhookNotify != nil {
+		WebhookNotify()
+	}
+}
+
+const webhookColumns = `webhook_id, url, event_types, active, created_at, updated_at`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (models.Webhook, error) {
+	var w models.Webhook
+	err := row.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.Active, &w.CreatedAt, &w.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return w, ErrWebhookNotFound
+	}
+	return w, err
+}
+
+// register a webhook for the user, the URL and event types must already be validated. The secret
+// is returned once, in the Secret field
+func CreateWebhook(userEmail, url string, eventTypes []string) (models.Webhook, error) {
+	token, err := utils.GenerateRandomToken(24)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+	secret := "whsec_" + token
+	stmt := `INSERT INTO webhooks (user_id, url, secret, event_types)
+		SELECT user_id, $2, $3, $4 FROM users WHERE email = $1
+		RETURNING ` + webhookColumns
+	w, err := scanWebhook(DB.QueryRow(stmt, userEmail, url, secret, pq.Array(eventTypes)))
+	if err != nil {
+		return w, err
+	}
+	w.Secret = secret
+	log.Printf("Webhook %d created by %s for %v", w.ID, userEmail, eventTypes)
+	return w, nil
+}
+
+// webhooks of the user, oldest first
+func ListWebhooks(userEmail string) ([]models.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks
+		WHERE user_id = (SELECT user_id FROM users WHERE email = $1) ORDER BY webhook_id`
+	rows, err := DB.Query(query, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// a webhook of the user, other users' webhooks are not found
+func GetWebhook(id int, userEmail string) (models.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks
+		WHERE webhook_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)`
+	w, err := scanWebhook(DB.QueryRow(query, id, userEmail))
+	if errors.Is(err, ErrWebhookNotFound) {
+		return w, fmt.Errorf("webhook ID %d: %w", id, ErrWebhookNotFound)
+	}
+	return w, err
+}
+
+// change the URL, event types or active flag of a webhook
+func UpdateWebhook(id int, userEmail string, w models.Webhook) (models.Webhook, error) {
+	stmt := `UPDATE webhooks SET url = $3, event_types = $4, active = $5, updated_at = NOW()
+		WHERE webhook_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)
+		RETURNING ` + webhookColumns
+	updated, err := scanWebhook(DB.QueryRow(stmt, id, userEmail, w.URL, pq.Array(w.Events), w.Active))
+	if errors.Is(err, ErrWebhookNotFound) {
+		return updated, fmt.Errorf("webhook ID %d: %w", id, ErrWebhookNotFound)
+	}
+	return updated, err
+}
+
+// delete a webhook with its delivery log
+func DeleteWebhook(id int, userEmail string) error {
+	res, err := DB.Exec(`DELETE FROM webhooks WHERE webhook_id = $1 AND user_id = (SELECT user_id FROM users WHERE email = $2)`,
+		id, userEmail)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("webhook ID %d: %w", id, ErrWebhookNotFound)
+	}
+	log.Printf("Webhook %d deleted by %s", id, userEmail)
+	return nil
+}
+
+// webhookPayload is the body of every delivery
+type webhookPayload struct {
+	ID        string      `json:"id"` // the event, receivers use it to ignore redeliveries they already processed
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Actor     string      `json:"actor"`
+	Data      interface{} `json:"data"`
+}
+
+// queue an event for the active webhooks subscribed to it whose owners are in the audience, as
+// part of the transaction that made the change. Returns whether anything was queued
+func queueWebhooks(tx *sql.Tx, eventType, actor string, audience []string, data interface{}) (bool, error) {
+	if len(audience) == 0 {
+		return false, nil
+	}
+	eventID, err := utils.GenerateRandomToken(12)
+	if err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(webhookPayload{ID: eventID, Type: eventType, CreatedAt: time.Now().UTC(), Actor: actor, Data: data})
+	if err != nil {
+		return false, err
+	}
+	stmt := `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT w.webhook_id, $1, $2, $3 FROM webhooks w JOIN users u ON u.user_id = w.user_id
+		WHERE w.active AND $2 = ANY(w.event_types) AND u.email = ANY($4)`
+	res, err := tx.Exec(stmt, eventID, eventType, string(payload), pq.Array(audience))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// the webhook event of an activity entry, "" when webhooks are not told about it. Updates only
+// matter when they complete the task
+func webhookEventType(action string, changes map[string]models.FieldChange) string {
+	switch action {
+	case models.ActivityCreated, models.ActivityRestored:
+		return webhooks.TaskCreated
+	case models.ActivityDeleted:
+		return webhooks.TaskDeleted
+	case models.ActivityUpdated:
+		if change, ok := changes["status"]; ok && change.To == true {
+			return webhooks.TaskCompleted
+		}
+	}
+	return ""
+}
+
+const deliveryColumns = `delivery_id, webhook_id, event_id, event_type, status, attempts, next_attempt_at, last_status_code,
+	last_error, last_duration_ms, redelivery_of, payload, created_at, last_attempt_at, delivered_at`
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var nextAttempt time.Time
+	var payload string
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &nextAttempt, &d.LastStatusCode,
+		&d.LastError, &d.LastDuration, &d.RedeliveryOf, &payload, &d.CreatedAt, &d.LastAttemptAt, &d.DeliveredAt)
+	if err == sql.ErrNoRows {
+		return d, ErrDeliveryNotFound
+	}
+	if d.Status == models.DeliveryPending {
+		d.NextAttemptAt = &nextAttempt
+	}
+	d.Payload = json.RawMessage(payload)
+	return d, err
+}
+
+// delivery log of a webhook of the user, newest first
+func ListWebhookDeliveries(webhookID int, userEmail string, limit, offset int) ([]models.WebhookDelivery, error) {
+	if _, err := GetWebhook(webhookID, userEmail); err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries WHERE webhook_id = $1
+		ORDER BY delivery_id DESC LIMIT $2 OFFSET $3`
+	rows, err := DB.Query(query, webhookID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// queue a delivery again with the same event and payload, e.g. after fixing the receiver. The
+// webhook's current URL and secret are used
+func RedeliverWebhook(webhookID int, deliveryID int64, userEmail string) (models.WebhookDelivery, error) {
+	if _, err := GetWebhook(webhookID, userEmail); err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	stmt := `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, redelivery_of)
+		SELECT webhook_id, event_id, event_type, payload, delivery_id FROM webhook_deliveries
+		WHERE delivery_id = $1 AND webhook_id = $2
+		RETURNING ` + deliveryColumns
+	d, err := scanDelivery(DB.QueryRow(stmt, deliveryID, webhookID))
+	if errors.Is(err, ErrDeliveryNotFound) {
+		return d, fmt.Errorf("delivery ID %d: %w", deliveryID, ErrDeliveryNotFound)
+	}
+	if err != nil {
+		return d, err
+	}
+	log.Printf("Webhook delivery %d queued again as %d by %s", deliveryID, d.ID, userEmail)
+	notifyWebhooks()
+	return d, nil
+}
+
+// remove finished deliveries older than the given age
+func PurgeWebhookDeliveries(olderThan time.Duration) error {
+	_, err := DB.Exec(`DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1`, time.Now().Add(-olderThan))
+	return err
+}
+
+// WebhookStore is the delivery queue of webhooks.Dispatcher in the database
+type WebhookStore struct{}
+
+// ClaimDue pushes the next attempt of due deliveries back by lease and returns them, concurrent
+// dispatchers skip each other's rows. Deliveries of webhooks that were disabled in the meantime
+// stay queued until the webhook is active again
+func (WebhookStore) ClaimDue(limit int, lease time.Duration) ([]webhooks.Delivery, error) {
+	stmt := `UPDATE webhook_deliveries d SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE w.webhook_id = d.webhook_id AND d.delivery_id IN (
+			SELECT q.delivery_id FROM webhook_deliveries q JOIN webhooks qw ON qw.webhook_id = q.webhook_id
+			WHERE q.status = 'pending' AND q.next_attempt_at <= NOW() AND qw.active
+			ORDER BY q.next_attempt_at LIMIT $1 FOR UPDATE OF q SKIP LOCKED)
+		RETURNING d.delivery_id, d.webhook_id, w.url, w.secret, d.event_type, d.payload, d.attempts`
+	rows, err := DB.Query(stmt, limit, time.Now().Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []webhooks.Delivery
+	for rows.Next() {
+		var d webhooks.Delivery
+		var payload string
+		if err = rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.EventType, &payload, &d.Attempts); err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// RecordAttempt stores the outcome of an attempt, the delivery stays pending until retryAt when
+// it is set and is otherwise finished
+func (WebhookStore) RecordAttempt(d webhooks.Delivery, res webhooks.Result, retryAt *time.Time) error {
+	status := models.DeliveryFailed
+	switch {
+	case res.OK():
+		status = models.DeliverySucceeded
+	case retryAt != nil:
+		status = models.DeliveryPending
+	}
+	var statusCode *int
+	if res.StatusCode != 0 {
+		statusCode = &res.StatusCode
+	}
+	stmt := `UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, last_status_code = $3, last_error = $4,
+			last_duration_ms = $5, last_attempt_at = NOW(), next_attempt_at = COALESCE($6, next_attempt_at),
+			delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+		WHERE delivery_id = $1`
+	_, err := DB.Exec(stmt, d.ID, status, statusCode, res.Error, res.Duration.Milliseconds(), retryAt)
+	return err
+}
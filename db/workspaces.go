@@ -0,0 +1,527 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"task-manager-api/models"
+	"task-manager-api/utils"
+)
+
+var (
+	ErrWorkspaceNotFound  = errors.New("workspace not found")
+	ErrMemberNotFound     = errors.New("workspace member not found")
+	ErrLastWorkspaceOwner = errors.New("a workspace needs at least one owner")
+	ErrInvalidInvitation  = errors.New("invitation is invalid, expired or used up")
+	ErrProjectNotFound    = errors.New("project not found")
+)
+
+// the user's role in a workspace, ErrWorkspaceNotFound when the user is not a member
+func WorkspaceRole(workspaceID int, userEmail string) (string, error) {
+	var role string
+	query := `SELECT m.role FROM workspace_members m JOIN users u ON u.user_id = m.user_id
+		WHERE m.workspace_id = $1 AND u.email = $2`
+	err := DB.QueryRow(query, workspaceID, userEmail).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("workspace ID %d: %w", workspaceID, ErrWorkspaceNotFound)
+	}
+	return role, err
+}
+
+// check that the user is a member of the workspace with at least the required role
+func requireWorkspaceRole(workspaceID int, userEmail, required string) error {
+	role, err := WorkspaceRole(workspaceID, userEmail)
+	if err != nil {
+		return err
+	}
+	if !models.WorkspaceRoleAllows(role, required) {
+		return fmt.Errorf("workspace ID %d requires the %s role: %w", workspaceID, required, ErrPermissionDenied)
+	}
+	return nil
+}
+
+// create a workspace, the creator becomes its first owner
+func CreateWorkspace(name, ownerEmail string) (models.Workspace, error) {
+	var ws models.Workspace
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ws, fmt.Errorf("workspace name is required")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return ws, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO workspaces (name, created_by) SELECT $1, user_id FROM users WHERE email = $2
+		RETURNING workspace_id, name, created_by, created_at`
+	err = tx.QueryRow(query, name, ownerEmail).Scan(&ws.ID, &ws.Name, &ws.CreatedBy, &ws.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ws, fmt.Errorf("user %s: %w", ownerEmail, ErrUserNotFound)
+	}
+	if err != nil {
+		return ws, err
+	}
+	_, err = tx.Exec(`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES($1, $2, $3)`,
+		ws.ID, ws.CreatedBy, models.WorkspaceRoleOwner)
+	if err != nil {
+		return ws, err
+	}
+	if err = tx.Commit(); err != nil {
+		return ws, err
+	}
+	ws.Role = models.WorkspaceRoleOwner
+	log.Printf("Workspace %d (%s) created by %s", ws.ID, ws.Name, ownerEmail)
+	return ws, nil
+}
+
+const workspaceSelect = `SELECT w.workspace_id, w.name, w.created_by, w.created_at, m.role
+	FROM workspaces w
+	JOIN workspace_members m ON m.workspace_id = w.workspace_id
+	JOIN users u ON u.user_id = m.user_id`
+
+func scanWorkspace(row interface{ Scan(...interface{}) error }) (models.Workspace, error) {
+	var ws models.Workspace
+	err := row.Scan(&ws.ID, &ws.Name, &ws.CreatedBy, &ws.CreatedAt, &ws.Role)
+	return ws, err
+}
+
+// workspaces the user is a member of, with the user's role in each
+func ListWorkspaces(userEmail string) ([]models.Workspace, error) {
+	rows, err := DB.Query(workspaceSelect+` WHERE u.email = $1 ORDER BY w.workspace_id`, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []models.Workspace{}
+	for rows.Next() {
+		ws, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+// get a workspace the user is a member of
+func GetWorkspace(workspaceID int, userEmail string) (models.Workspace, error) {
+	ws, err := scanWorkspace(DB.QueryRow(workspaceSelect+` WHERE w.workspace_id = $1 AND u.email = $2`, workspaceID, userEmail))
+	if err == sql.ErrNoRows {
+		return ws, fmt.Errorf("workspace ID %d: %w", workspaceID, ErrWorkspaceNotFound)
+	}
+	return ws, err
+}
+
+// delete a workspace together with its tasks and projects, owners only
+func DeleteWorkspace(workspaceID int, userEmail string) error {
+	if err := requireWorkspaceRole(workspaceID, userEmail, models.WorkspaceRoleOwner); err != nil {
+		return err
+	}
+	if _, err := DB.Exec(`DELETE FROM workspaces WHERE workspace_id = $1`, workspaceID); err != nil {
+		return err
+	}
+	log.Printf("Workspace %d deleted by %s", workspaceID, userEmail)
+	return nil
+}
+
+// list the members of a workspace, visible to every member
+func ListWorkspaceMembers(workspaceID int, userEmail string) ([]models.WorkspaceMember, error) {
+	if _, err := WorkspaceRole(workspaceID, userEmail); err != nil {
+		return nil, err
+	}
+	query := `SELECT m.workspace_id, m.user_id, u.username, u.email, m.role, m.joined_at
+		FROM workspace_members m JOIN users u ON u.user_id = m.user_id
+		WHERE m.workspace_id = $1 ORDER BY m.joined_at`
+	rows, err := DB.Query(query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.WorkspaceMember{}
+	for rows.Next() {
+		var m models.WorkspaceMember
+		if err = rows.Scan(&m.WorkspaceID, &m.UserID, &m.Username, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// lock the workspace row and read the target member's role, used before changing memberships so
+// two concurrent changes cannot both remove the last owner
+func lockMember(tx *sql.Tx, workspaceID, userID int) (string, error) {
+	if _, err := tx.Exec(`SELECT 1 FROM workspaces WHERE workspace_id = $1 FOR UPDATE`, workspaceID); err != nil {
+		return "", err
+	}
+	var role string
+	err := tx.QueryRow(`SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`, workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("user ID %d: %w", userID, ErrMemberNotFound)
+	}
+	return role, err
+}
+
+// fail with ErrLastWorkspaceOwner when the workspace has a single owner left
+func checkNotLastOwner(tx *sql.Tx, workspaceID int) error {
+	var owners int
+	query := `SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND role = $2`
+	if err := tx.QueryRow(query, workspaceID, models.WorkspaceRoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+	if owners <= 1 {
+		return ErrLastWorkspaceOwner
+	}
+	return nil
+}
+
+// check that the actor may manage a member holding role: admins manage members and guests,
+// only owners manage admins and owners
+func canManageMember(actorRole, memberRole string) bool {
+	if actorRole == models.WorkspaceRoleOwner {
+		return true
+	}
+	return actorRole == models.WorkspaceRoleAdmin &&
+		(memberRole == models.WorkspaceRoleMember || memberRole == models.WorkspaceRoleGuest)
+}
+
+// change the role of a workspace member, requires admin and only owners can hand out owner or admin
+func SetWorkspaceMemberRole(workspaceID int, actorEmail string, userID int, role string) error {
+	if !models.IsWorkspaceRole(role) {
+		return fmt.Errorf("invalid role %q, must be owner, admin, member or guest", role)
+	}
+	actorRole, err := WorkspaceRole(workspaceID, actorEmail)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockMember(tx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if !canManageMember(actorRole, current) || !canManageMember(actorRole, role) {
+		return fmt.Errorf("cannot change a %s to %s as %s: %w", current, role, actorRole, ErrPermissionDenied)
+	}
+	if current == models.WorkspaceRoleOwner && role != models.WorkspaceRoleOwner {
+		if err = checkNotLastOwner(tx, workspaceID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`UPDATE workspace_members SET role = $1 WHERE workspace_id = $2 AND user_id = $3`, role, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Workspace %d: user %d is now %s", workspaceID, userID, role)
+	return nil
+}
+
+// remove a member from a workspace, admins can remove members they manage and anyone can leave
+func RemoveWorkspaceMember(workspaceID int, actorEmail string, userID int) error {
+	actor, err := GetUserByEmail(actorEmail)
+	if err != nil {
+		return err
+	}
+	actorRole, err := WorkspaceRole(workspaceID, actorEmail)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockMember(tx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if actor.ID != userID && !canManageMember(actorRole, current) {
+		return fmt.Errorf("cannot remove a %s as %s: %w", current, actorRole, ErrPermissionDenied)
+	}
+	if current == models.WorkspaceRoleOwner {
+		if err = checkNotLastOwner(tx, workspaceID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Workspace %d: user %d removed by %s", workspaceID, userID, actorEmail)
+	return nil
+}
+
+// create an invitation link, admins and owners only. maxUses 0 allows any number of uses.
+// Returns the invitation and the raw token, which is only stored hashed
+func CreateWorkspaceInvitation(workspaceID int, actorEmail, role string, maxUses int, ttl time.Duration) (models.WorkspaceInvitation, string, error) {
+	var inv models.WorkspaceInvitation
+	if role == models.WorkspaceRoleOwner || !models.IsWorkspaceRole(role) {
+		return inv, "", fmt.Errorf("invalid role %q, must be admin, member or guest", role)
+	}
+	if maxUses < 0 {
+		return inv, "", fmt.Errorf("max_uses cannot be negative")
+	}
+	actorRole, err := WorkspaceRole(workspaceID, actorEmail)
+	if err != nil {
+		return inv, "", err
+	}
+	if !canManageMember(actorRole, role) {
+		return inv, "", fmt.Errorf("cannot invite a %s as %s: %w", role, actorRole, ErrPermissionDenied)
+	}
+
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return inv, "", err
+	}
+	query := `INSERT INTO workspace_invitations (workspace_id, token_hash, role, created_by, max_uses, expires_at)
+		SELECT $1::INT, $2, $3, user_id, $5::INT, $6::TIMESTAMPTZ FROM users WHERE email = $4
+		RETURNING ` + invitationColumns
+	inv, err = scanInvitation(DB.QueryRow(query, workspaceID, utils.HashToken(token), role, actorEmail, maxUses, time.Now().Add(ttl)))
+	if err != nil {
+		return inv, "", err
+	}
+	log.Printf("Workspace %d: %s invitation %d created by %s", workspaceID, role, inv.ID, actorEmail)
+	return inv, token, nil
+}
+
+const invitationColumns = `invitation_id, workspace_id, role, created_by, max_uses, uses, expires_at, revoked_at, created_at`
+
+func scanInvitation(row interface{ Scan(...interface{}) error }) (models.WorkspaceInvitation, error) {
+	var inv models.WorkspaceInvitation
+	err := row.Scan(&inv.ID, &inv.WorkspaceID, &inv.Role, &inv.CreatedBy, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.RevokedAt, &inv.CreatedAt)
+	return inv, err
+}
+
+// list the invitations of a workspace, admins and owners only
+func ListWorkspaceInvitations(workspaceID int, actorEmail string) ([]models.WorkspaceInvitation, error) {
+	if err := requireWorkspaceRole(workspaceID, actorEmail, models.WorkspaceRoleAdmin); err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + invitationColumns + ` FROM workspace_invitations WHERE workspace_id = $1 ORDER BY created_at DESC`
+	rows, err := DB.Query(query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.WorkspaceInvitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// revoke an invitation link, admins and owners only
+func RevokeWorkspaceInvitation(workspaceID int, actorEmail string, invitationID int) error {
+	if err := requireWorkspaceRole(workspaceID, actorEmail, models.WorkspaceRoleAdmin); err != nil {
+		return err
+	}
+	query := `UPDATE workspace_invitations SET revoked_at = NOW()
+		WHERE invitation_id = $1 AND workspace_id = $2 AND revoked_at IS NULL`
+	res, err := DB.Exec(query, invitationID, workspaceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidInvitation
+	}
+	return nil
+}
+
+// join the workspace of an invitation. Users who are already members keep their current role
+func AcceptWorkspaceInvitation(token, userEmail string) (models.Workspace, error) {
+	var ws models.Workspace
+	user, err := GetUserByEmail(userEmail)
+	if err != nil {
+		return ws, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return ws, err
+	}
+	defer tx.Rollback()
+
+	// lock the invitation so concurrent accepts cannot go over max_uses
+	query := `SELECT ` + invitationColumns + ` FROM workspace_invitations WHERE token_hash = $1 FOR UPDATE`
+	inv, err := scanInvitation(tx.QueryRow(query, utils.HashToken(token)))
+	if err == sql.ErrNoRows {
+		return ws, ErrInvalidInvitation
+	}
+	if err != nil {
+		return ws, err
+	}
+	if inv.RevokedAt != nil || time.Now().After(inv.ExpiresAt) || (inv.MaxUses > 0 && inv.Uses >= inv.MaxUses) {
+		return ws, ErrInvalidInvitation
+	}
+
+	res, err := tx.Exec(`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING`, inv.WorkspaceID, user.ID, inv.Role)
+	if err != nil {
+		return ws, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if _, err = tx.Exec(`UPDATE workspace_invitations SET uses = uses + 1 WHERE invitation_id = $1`, inv.ID); err != nil {
+			return ws, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return ws, err
+	}
+	log.Printf("%s joined workspace %d through invitation %d", userEmail, inv.WorkspaceID, inv.ID)
+	return GetWorkspace(inv.WorkspaceID, userEmail)
+}
+
+// gets all tasks of a workspace, optionally limited to one project, for any member
+func GetWorkspaceTasks(workspaceID int, userEmail string, projectID *int) ([]models.Task, error) {
+	role, err := WorkspaceRole(workspaceID, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + taskColumns + ` FROM ` + taskFrom + `
+		WHERE t.workspace_id = $1 AND ($2::INT IS NULL OR t.project_id = $2) AND t.deleted_at IS NULL ORDER BY t.task_id`
+	rows, err := DB.Query(query, workspaceID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// same rules as TaskPermission, without a query per task
+	shares := map[int]string{}
+	rows, err = DB.Query(`SELECT s.task_id, s.permission FROM task_shares s JOIN tasks t ON t.task_id = s.task_id
+		WHERE t.workspace_id = $1 AND s.user_email = $2
+		UNION ALL SELECT t.task_id, s.permission FROM project_shares s JOIN tasks t ON t.project_id = s.project_id
+		WHERE t.workspace_id = $1 AND s.user_email = $2`, workspaceID, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var permission string
+		if err = rows.Scan(&id, &permission); err != nil {
+			return nil, err
+		}
+		if models.PermissionAllows(permission, shares[id]) {
+			shares[id] = permission
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tasks {
+		permission := models.PermissionOwner
+		switch {
+		case role == models.WorkspaceRoleGuest:
+			permission = models.PermissionViewer
+		case role == models.WorkspaceRoleMember && tasks[i].OwnerEmail != userEmail:
+			permission = models.PermissionEditor
+		}
+		if share := shares[tasks[i].ID]; models.PermissionAllows(share, permission) {
+			permission = share
+		}
+		tasks[i].Permission = permission
+	}
+	return tasks, hydrateTasks(tasks)
+}
+
+// create a project in a workspace, members and above
+func CreateProject(workspaceID int, userEmail, name string) (models.Project, error) {
+	var p models.Project
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return p, fmt.Errorf("project name is required")
+	}
+	if err := requireWorkspaceRole(workspaceID, userEmail, models.WorkspaceRoleMember); err != nil {
+		return p, err
+	}
+	query := `INSERT INTO projects (workspace_id, name) VALUES($1, $2) RETURNING project_id, workspace_id, name, created_at`
+	err := DB.QueryRow(query, workspaceID, name).Scan(&p.ID, &p.WorkspaceID, &p.Name, &p.CreatedAt)
+	return p, err
+}
+
+// list the projects of a workspace, for any member
+func ListProjects(workspaceID int, userEmail string) ([]models.Project, error) {
+	if _, err := WorkspaceRole(workspaceID, userEmail); err != nil {
+		return nil, err
+	}
+	query := `SELECT project_id, workspace_id, name, created_at FROM projects WHERE workspace_id = $1 ORDER BY name`
+	rows, err := DB.Query(query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []models.Project{}
+	for rows.Next() {
+		var p models.Project
+		if err = rows.Scan(&p.ID, &p.WorkspaceID, &p.Name, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// check that a project exists in the workspace a task is placed in, personal tasks have no projects
+func checkProjectPlacement(projectID int, workspaceID *int) error {
+	if workspaceID == nil {
+		return fmt.Errorf("project ID %d: personal tasks cannot belong to a project: %w", projectID, ErrProjectNotFound)
+	}
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM projects WHERE project_id = $1 AND workspace_id = $2)`
+	if err := DB.QueryRow(query, projectID, *workspaceID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("project ID %d in workspace %d: %w", projectID, *workspaceID, ErrProjectNotFound)
+	}
+	return nil
+}
+
+// check that the user can see the tasks of a project, i.e. is a member of its workspace or the
+// project is shared with them. Other projects are reported as ErrProjectNotFound
+func ProjectAccess(projectID int, userEmail string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM projects p
+		JOIN workspace_members m ON m.workspace_id = p.workspace_id
+		JOIN users u ON u.user_id = m.user_id
+		WHERE p.project_id = $1 AND u.email = $2)
+		OR EXISTS(SELECT 1 FROM project_shares WHERE project_id = $1 AND user_email = $2)`
+	if err := DB.QueryRow(query, projectID, userEmail).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("project ID %d: %w", projectID, ErrProjectNotFound)
+	}
+	return nil
+}
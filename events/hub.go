@@ -0,0 +1,162 @@
+// Package events is an in-process publish/subscribe hub for task changes. The db layer publishes
+// an event after every committed change, streaming endpoints subscribe to the events their caller
+// can see. Recent events are kept in a bounded buffer so clients can resume after a reconnect.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"task-manager-api/models"
+)
+
+// event types
+const (
+	TaskCreated = "task.created"
+	TaskUpdated = "task.updated"
+	TaskDeleted = "task.deleted"
+)
+
+// default number of events kept for resumption
+const DefaultReplaySize = 1000
+
+// events a subscriber can fall behind before it is dropped
+const subscriberBuffer = 256
+
+// Event is one change to a task
+type Event struct {
+	ID          int64                         `json:"id"`
+	Type        string                        `json:"type"`
+	TaskID      int                           `json:"task_id"`
+	WorkspaceID *int                          `json:"workspace_id,omitempty"`
+	ProjectID   *int                          `json:"project_id,omitempty"`
+	Actor       string                        `json:"actor"`
+	Task        *models.Task                  `json:"task,omitempty"` // the task after the change, nil for deleted tasks
+	Changes     map[string]models.FieldChange `json:"changes,omitempty"`
+	Time        time.Time                     `json:"time"`
+	Audience    []string                      `json:"-"` // emails of the users who can see the task
+}
+
+// VisibleTo checks if the user can see the event
+func (e Event) VisibleTo(email string) bool {
+	for _, a := range e.Audience {
+		if a == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events matching its filter on C. C is closed when the subscriber
+// falls too far behind or unsubscribes, Dropped tells the two apart
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	filter  func(Event) bool
+	dropped bool
+}
+
+// Dropped reports if the subscription was closed because the subscriber did not keep up, only
+// meaningful after C is closed
+func (s *Subscription) Dropped() bool {
+	return s.dropped
+}
+
+// Hub fans out published events to subscribers and keeps the most recent ones for replay
+type Hub struct {
+	mu          sync.Mutex
+	nextID      int64
+	replay      []Event // ring buffer, oldest at start once full
+	start       int
+	size        int
+	subscribers map[*Subscription]bool
+}
+
+// NewHub returns a hub that keeps the last replaySize events. IDs start at the current time in
+// milliseconds so IDs from before a restart are not mistaken for new ones
+func NewHub(replaySize int) *Hub {
+	if replaySize <= 0 {
+		replaySize = DefaultReplaySize
+	}
+	return &Hub{
+		nextID:      time.Now().UnixMilli(),
+		replay:      make([]Event, replaySize),
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Publish assigns the next ID to the event and delivers it, subscribers that cannot take it
+// without blocking are dropped
+func (h *Hub) Publish(e Event) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	e.ID = h.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if h.size < len(h.replay) {
+		h.replay[(h.start+h.size)%len(h.replay)] = e
+		h.size++
+	} else {
+		h.replay[h.start] = e
+		h.start = (h.start + 1) % len(h.replay)
+	}
+
+	for s := range h.subscribers {
+		if !s.filter(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped = true
+			h.remove(s)
+		}
+	}
+	return e
+}
+
+// Subscribe starts delivering events matching filter. With a lastID the buffered events after it
+// are returned for replay; complete is false when events after lastID were already evicted (or
+// lastID is unknown) and the subscriber has to reload its state instead
+func (h *Hub) Subscribe(filter func(Event) bool, lastID int64) (sub *Subscription, missed []Event, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	complete = true
+	if lastID > 0 {
+		oldest := h.nextID + 1
+		if h.size > 0 {
+			oldest = h.replay[h.start].ID
+		}
+		// lastID must be the event right before the oldest one kept or any later one
+		complete = lastID >= oldest-1 && lastID <= h.nextID
+		for i := 0; i < h.size; i++ {
+			e := h.replay[(h.start+i)%len(h.replay)]
+			if e.ID > lastID && filter(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	c := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: c, c: c, filter: filter}
+	h.subscribers[sub] = true
+	return sub, missed, complete
+}
+
+// Unsubscribe stops delivery and closes C, it is safe to call more than once
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscription) {
+	if h.subscribers[s] {
+		delete(h.subscribers, s)
+		close(s.c)
+	}
+}
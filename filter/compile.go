@@ -0,0 +1,300 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"task-manager-api/models"
+)
+
+// Env holds what values in an expression are relative to
+type Env struct {
+	Now       time.Time
+	Location  *time.Location // day boundaries of dates, today and tomorrow
+	WeekStart time.Weekday   // first day of thisweek, nextweek and lastweek
+	UserID    int            // the caller, for assignee:me and owner:me
+}
+
+type compiler struct {
+	env   Env
+	args  []interface{}
+	first int
+}
+
+// add a query argument and return its placeholder
+func (c *compiler) arg(v interface{}) string {
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", c.first+len(c.args)-1)
+}
+
+// Compile turns an expression into an SQL condition on tasks aliased t, with placeholders
+// numbered from firstArg, and the arguments for them
+func Compile(expr Node, env Env, firstArg int) (string, []interface{}, error) {
+	if env.Location == nil {
+		env.Location = time.UTC
+	}
+	c := &compiler{env: env, first: firstArg}
+	sql, err := c.compile(expr)
+	if err != nil {
+		return "", nil, err
+	}
+	return sql, c.args, nil
+}
+
+// negations treat unknown (NULL) as false, so NOT due<7d includes tasks without a due date
+func negate(cond string) string {
+	return "NOT COALESCE(" + cond + ", FALSE)"
+}
+
+func (c *compiler) compile(n Node) (string, error) {
+	switch n := n.(type) {
+	case And:
+		return c.binary(n.Left, "AND", n.Right)
+	case Or:
+		return c.binary(n.Left, "OR", n.Right)
+	case Not:
+		inner, err := c.compile(n.Expr)
+		if err != nil {
+			return "", err
+		}
+		return negate(inner), nil
+	case Comparison:
+		spec := fields[n.Field]
+		op := n.Op
+		if op == ":" {
+			op = "="
+		}
+		if !strings.Contains(" "+spec.ops+" ", " "+op+" ") {
+			return "", fmt.Errorf("%s does not support %s", n.Field, n.Op)
+		}
+		if op == "!=" {
+			cond, err := spec.compile(c, "=", n.Value)
+			if err != nil {
+				return "", err
+			}
+			return negate(cond), nil
+		}
+		return spec.compile(c, op, n.Value)
+	default:
+		return "", fmt.Errorf("unknown filter node %T", n)
+	}
+}
+
+func (c *compiler) binary(left Node, op string, right Node) (string, error) {
+	l, err := c.compile(left)
+	if err != nil {
+		return "", err
+	}
+	r, err := c.compile(right)
+	if err != nil {
+		return "", err
+	}
+	return "(" + l + " " + op + " " + r + ")", nil
+}
+
+type fieldSpec struct {
+	ops     string // supported operators, : is the same as =
+	compile func(c *compiler, op, value string) (string, error)
+}
+
+const (
+	equalityOps   = "= !="
+	comparisonOps = "= != < <= > >="
+)
+
+var fields map[string]fieldSpec
+
+func init() {
+	fields = map[string]fieldSpec{
+		"status":   {equalityOps, compileStatus},
+		"label":    {equalityOps, compileLabel},
+		"priority": {comparisonOps, compilePriority},
+		"due":      {comparisonOps, timeField("t.due_at", true)},
+		"created":  {comparisonOps, timeField("t.created_at", false)},
+		"updated":  {comparisonOps, timeField("t.updated_at", false)},
+		"project":  {equalityOps, compileProject},
+		"assignee": {equalityOps, compileAssignee},
+		"owner":    {equalityOps, compileOwner},
+	}
+}
+
+// status:open or status:done
+func compileStatus(c *compiler, op, value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "open", "todo", "false":
+		return "t.status = FALSE", nil
+	case "done", "completed", "closed", "true":
+		return "t.status = TRUE", nil
+	}
+	return "", fmt.Errorf("status must be open or done, not %q", value)
+}
+
+// label:work, the task has the label
+func compileLabel(c *compiler, op, value string) (string, error) {
+	labels, err := models.NormalizeLabels([]string{value})
+	if err != nil {
+		return "", err
+	}
+	return "t.labels @> ARRAY[" + c.arg(labels[0]) + "::TEXT]", nil
+}
+
+// priority>=high, priorities compare by their rank
+func compilePriority(c *compiler, op, value string) (string, error) {
+	rank := models.PriorityRank(strings.ToLower(value))
+	if rank == 0 {
+		return "", fmt.Errorf("priority must be one of %s, not %q", strings.Join(models.Priorities, ", "), value)
+	}
+	matching := []string{}
+	for _, p := range models.Priorities {
+		if compareInts(models.PriorityRank(p), op, rank) {
+			matching = append(matching, p)
+		}
+	}
+	return "t.priority = ANY(" + c.arg(pq.Array(matching)) + "::TEXT[])", nil
+}
+
+func compareInts(a int, op string, b int) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		return a == b
+	}
+}
+
+// offsets from now like 7d, -2w or 36h
+var offsetPattern = regexp.MustCompile(`^([+-]?)(\d{1,4})([hdw])$`)
+
+// conditions on a timestamp column. Values are offsets from now (due<7d, created>-2w), dates
+// (due=2024-05-01), today, tomorrow or yesterday and thisweek, nextweek or lastweek; dates, days
+// and weeks cover the whole period in the caller's time zone. withDue adds due:none and due:overdue
+func timeField(column string, withDue bool) func(c *compiler, op, value string) (string, error) {
+	return func(c *compiler, op, value string) (string, error) {
+		value = strings.ToLower(value)
+		now := c.env.Now.In(c.env.Location)
+
+		if withDue {
+			switch value {
+			case "none":
+				if op != "=" {
+					return "", fmt.Errorf("due:none only supports : and !=")
+				}
+				return column + " IS NULL", nil
+			case "overdue":
+				if op != "=" {
+					return "", fmt.Errorf("due:overdue only supports : and !=")
+				}
+				return "(" + column + " < " + c.arg(now) + " AND t.status = FALSE)", nil
+			}
+		}
+
+		if m := offsetPattern.FindStringSubmatch(value); m != nil {
+			if op == "=" {
+				return "", fmt.Errorf("offsets like %s need <, <=, > or >=", value)
+			}
+			n, _ := strconv.Atoi(m[2])
+			if m[1] == "-" {
+				n = -n
+			}
+			at := now
+			switch m[3] {
+			case "h":
+				at = now.Add(time.Duration(n) * time.Hour)
+			case "d":
+				at = now.AddDate(0, 0, n)
+			case "w":
+				at = now.AddDate(0, 0, 7*n)
+			}
+			return column + " " + op + " " + c.arg(at), nil
+		}
+
+		var start time.Time
+		days := 1
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, c.env.Location)
+		week := today.AddDate(0, 0, -((int(today.Weekday()) - int(c.env.WeekStart) + 7) % 7))
+		switch value {
+		case "today":
+			start = today
+		case "tomorrow":
+			start = today.AddDate(0, 0, 1)
+		case "yesterday":
+			start = today.AddDate(0, 0, -1)
+		case "thisweek":
+			start, days = week, 7
+		case "nextweek":
+			start, days = week.AddDate(0, 0, 7), 7
+		case "lastweek":
+			start, days = week.AddDate(0, 0, -7), 7
+		default:
+			d, err := time.ParseInLocation("2006-01-02", value, c.env.Location)
+			if err != nil {
+				return "", fmt.Errorf("invalid time %q, use an offset like 7d, a date like 2006-01-02 or today", value)
+			}
+			start = d
+		}
+		end := start.AddDate(0, 0, days)
+		switch op {
+		case "<":
+			return column + " < " + c.arg(start), nil
+		case "<=":
+			return column + " < " + c.arg(end), nil
+		case ">":
+			return column + " >= " + c.arg(end), nil
+		case ">=":
+			return column + " >= " + c.arg(start), nil
+		default:
+			return "(" + column + " >= " + c.arg(start) + " AND " + column + " < " + c.arg(end) + ")", nil
+		}
+	}
+}
+
+// project:12 or project:none
+func compileProject(c *compiler, op, value string) (string, error) {
+	if strings.EqualFold(value, "none") {
+		return "t.project_id IS NULL", nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return "", fmt.Errorf("project must be a project ID or none, not %q", value)
+	}
+	return "t.project_id = " + c.arg(id), nil
+}
+
+// assignee:me, assignee:7 or assignee:none
+func compileAssignee(c *compiler, op, value string) (string, error) {
+	if strings.EqualFold(value, "none") {
+		return "NOT EXISTS (SELECT 1 FROM task_assignees fa WHERE fa.task_id = t.task_id)", nil
+	}
+	id, err := c.userID(value)
+	if err != nil {
+		return "", fmt.Errorf("assignee must be me, a user ID or none, not %q", value)
+	}
+	return "EXISTS (SELECT 1 FROM task_assignees fa WHERE fa.task_id = t.task_id AND fa.user_id = " + c.arg(id) + ")", nil
+}
+
+// owner:me or owner:7, the creator of the task
+func compileOwner(c *compiler, op, value string) (string, error) {
+	id, err := c.userID(value)
+	if err != nil {
+		return "", fmt.Errorf("owner must be me or a user ID, not %q", value)
+	}
+	return "t.owner_id = " + c.arg(id), nil
+}
+
+func (c *compiler) userID(value string) (int, error) {
+	if strings.EqualFold(value, "me") {
+		return c.env.UserID, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,255 @@
+// Package filter implements the filter expressions of GET /tasks?filter= and saved filters, e.g.
+//
+//	status:open AND (label:work OR priority>=high) AND due<7d
+//
+// An expression is parsed into an AST of comparisons joined with AND, OR and NOT (terms next to
+// each other are joined with AND) and compiled to a parameterized SQL condition on tasks aliased t.
+// User input only ever ends up in query arguments.
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// upper bounds that keep a single expression cheap to parse and run
+const (
+	maxExpressionLength = 1000
+	maxComparisons      = 50
+	maxDepth            = 20
+)
+
+// Node is a node of a parsed expression: And, Or, Not or Comparison
+type Node interface {
+	node()
+}
+
+type And struct{ Left, Right Node }
+
+type Or struct{ Left, Right Node }
+
+type Not struct{ Expr Node }
+
+// Comparison is a single condition like priority>=high, Op is one of : = != < <= > >=
+type Comparison struct {
+	Field string
+	Op    string
+	Value string
+}
+
+func (And) node()        {}
+func (Or) node()         {}
+func (Not) node()        {}
+func (Comparison) node() {}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokOp
+	tokWord
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	quoted bool // words in double quotes are never keywords
+	pos    int
+}
+
+// split an expression into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case strings.ContainsRune(":=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(input) && input[i+1] == '=' && c != ':' && c != '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d, use != or NOT", i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		case c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(input) && input[j] != '"'; j++ {
+				if input[j] == '\\' && j+1 < len(input) {
+					j++
+				}
+				b.WriteByte(input[j])
+			}
+			if j >= len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokWord, text: b.String(), quoted: true, pos: i})
+			i = j + 1
+		default:
+			j := i
+			for j < len(input) && !unicode.IsSpace(rune(input[j])) && !strings.ContainsRune("():=!<>\"", rune(input[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokWord, text: input[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+type parser struct {
+	tokens      []token
+	pos         int
+	depth       int
+	comparisons int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// check if the next token is the keyword, keywords are case insensitive
+func (p *parser) atKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokWord && !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+// Parse reads and validates a filter expression
+func Parse(input string) (Node, error) {
+	if len(input) > maxExpressionLength {
+		return nil, fmt.Errorf("filter is longer than %d characters", maxExpressionLength)
+	}
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, fmt.Errorf("filter is empty")
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	// catch invalid values now instead of when the filter is used
+	if _, _, err = Compile(expr, Env{Now: time.Now(), Location: time.UTC}, 1); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.atKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.atKeyword("AND"):
+			p.next()
+		case t.kind == tokLParen || (t.kind == tokWord && !p.atKeyword("OR")):
+			// implicit AND
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = And{left, right}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, fmt.Errorf("filter is nested more than %d levels deep", maxDepth)
+	}
+
+	if p.atKeyword("NOT") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{expr}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at position %d", t.pos)
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Node, error) {
+	field := p.next()
+	if field.kind != tokWord || field.quoted {
+		return nil, fmt.Errorf("expected a field name at position %d", field.pos)
+	}
+	name := strings.ToLower(field.text)
+	if _, ok := fields[name]; !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", field.text, field.pos)
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected an operator after %s at position %d", field.text, op.pos)
+	}
+	value := p.next()
+	if value.kind != tokWord {
+		return nil, fmt.Errorf("expected a value after %s%s at position %d", field.text, op.text, value.pos)
+	}
+
+	p.comparisons++
+	if p.comparisons > maxComparisons {
+		return nil, fmt.Errorf("filter has more than %d conditions", maxComparisons)
+	}
+	return Comparison{Field: name, Op: op.text, Value: value.text}, nil
+}
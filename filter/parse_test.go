@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func cmp(field, op, value string) Comparison {
+	return Comparison{Field: field, Op: op, Value: value}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Node
+	}{
+		{"status:open", cmp("status", ":", "open")},
+		{"Priority >= high", cmp("priority", ">=", "high")},
+		{"due<7d", cmp("due", "<", "7d")},
+		{"label!=work", cmp("label", "!=", "work")},
+		{"status:open label:work", And{cmp("status", ":", "open"), cmp("label", ":", "work")}},
+		{"status:open and label:work", And{cmp("status", ":", "open"), cmp("label", ":", "work")}},
+		// AND binds tighter than OR
+		{"label:a OR label:b AND label:c", Or{cmp("label", ":", "a"), And{cmp("label", ":", "b"), cmp("label", ":", "c")}}},
+		{"(label:a OR label:b) label:c", And{Or{cmp("label", ":", "a"), cmp("label", ":", "b")}, cmp("label", ":", "c")}},
+		{"NOT status:done", Not{cmp("status", ":", "done")}},
+		{"not not label:x", Not{Not{cmp("label", ":", "x")}}},
+		{`label:"work"`, cmp("label", ":", "work")},
+		{`label:"w\ork"`, cmp("label", ":", "work")},
+		// quoted keywords are values, not operators
+		{`label:"OR"`, cmp("label", ":", "OR")},
+		{"status:open AND (label:work OR priority>=high) AND due<7d", And{
+			And{cmp("status", ":", "open"), Or{cmp("label", ":", "work"), cmp("priority", ">=", "high")}},
+			cmp("due", "<", "7d"),
+		}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q)\n got %#v\nwant %#v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"", "empty"},
+		{"   ", "empty"},
+		{"colour:red", "unknown field"},
+		{"status", "expected an operator"},
+		{"status:", "expected a value"},
+		{"status:open)", `unexpected ")"`},
+		{"(status:open", "expected )"},
+		{"status!open", "use != or NOT"},
+		{`label:"open`, "unterminated string"},
+		{`"status":open`, "expected a field name"},
+		{"status:maybe", "status must be open or done"},
+		{"priority>=huge", "priority must be one of"},
+		{"label>work", "label does not support >"},
+		{"due=7d", "need <, <=, > or >="},
+		{"due>none", "due:none only supports"},
+		{"due<2024-13-01", "invalid time"},
+		{"project:abc", "project must be"},
+		{"owner:none", "owner must be"},
+		{strings.Repeat("(", maxDepth+1) + "status:open" + strings.Repeat(")", maxDepth+1), "nested more than"},
+		{strings.Repeat("label:x ", maxComparisons+1), "more than 50 conditions"},
+		{strings.Repeat("x", maxExpressionLength+1), "longer than"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%.40q): got error %v, want one containing %q", tt.input, err, tt.err)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+	// a Wednesday evening in Berlin, still Wednesday in UTC
+	now := time.Date(2024, 5, 15, 20, 30, 0, 0, berlin)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, berlin) }
+	env := Env{Now: now, Location: berlin, WeekStart: time.Monday, UserID: 7}
+
+	tests := []struct {
+		input string
+		sql   string
+		args  []interface{}
+	}{
+		{"status:open", "t.status = FALSE", nil},
+		{"status!=done", "NOT COALESCE(t.status = TRUE, FALSE)", nil},
+		{"label:Work", "t.labels @> ARRAY[$3::TEXT]", []interface{}{"work"}},
+		{"priority>=high", "t.priority = ANY($3::TEXT[])", []interface{}{pq.Array([]string{"high", "urgent"})}},
+		{"priority<normal", "t.priority = ANY($3::TEXT[])", []interface{}{pq.Array([]string{"low"})}},
+		{"due<7d", "t.due_at < $3", []interface{}{now.AddDate(0, 0, 7)}},
+		{"created>-36h", "t.created_at > $3", []interface{}{now.Add(-36 * time.Hour)}},
+		{"due:none", "t.due_at IS NULL", nil},
+		{"due:overdue", "(t.due_at < $3 AND t.status = FALSE)", []interface{}{now}},
+		{"due:today", "(t.due_at >= $3 AND t.due_at < $4)", []interface{}{day(2024, 5, 15), day(2024, 5, 16)}},
+		{"due<=tomorrow", "t.due_at < $3", []interface{}{day(2024, 5, 17)}},
+		{"due:thisweek", "(t.due_at >= $3 AND t.due_at < $4)", []interface{}{day(2024, 5, 13), day(2024, 5, 20)}},
+		{"updated>2024-05-01", "t.updated_at >= $3", []interface{}{day(2024, 5, 2)}},
+		{"project:none", "t.project_id IS NULL", nil},
+		{"project:12", "t.project_id = $3", []interface{}{12}},
+		{"owner:me", "t.owner_id = $3", []interface{}{7}},
+		{"assignee:me", "EXISTS (SELECT 1 FROM task_assignees fa WHERE fa.task_id = t.task_id AND fa.user_id = $3)", []interface{}{7}},
+		{"NOT due<7d", "NOT COALESCE(t.due_at < $3, FALSE)", []interface{}{now.AddDate(0, 0, 7)}},
+		{"status:open (label:a OR label:b)", "(t.status = FALSE AND (t.labels @> ARRAY[$3::TEXT] OR t.labels @> ARRAY[$4::TEXT]))",
+			[]interface{}{"a", "b"}},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.input)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.input, err)
+		}
+		sql, args, err := Compile(expr, env, 3)
+		if err != nil {
+			t.Errorf("Compile(%q): %s", tt.input, err)
+			continue
+		}
+		if sql != tt.sql || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Compile(%q)\n got %s %v\nwant %s %v", tt.input, sql, args, tt.sql, tt.args)
+		}
+	}
+}
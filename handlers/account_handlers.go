@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+	"task-manager-api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// last step of every login method once the user has been identified: check the account
+// can log in and respond with the API's own token
+func completeLogin(w http.ResponseWriter, r *http.Request, user models.Users, requestedScopes []string) {
+	if user.Disabled {
+		http.Error(w, "account is disabled", http.StatusForbidden)
+		return
+	}
+	if user.MustResetPassword {
+		http.Error(w, "password reset required, use the reset token provided by an administrator", http.StatusForbidden)
+		return
+	}
+	scopes, err := utils.ResolveScopes(requestedScopes, user.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// every login is a session the user can see and revoke, tokens carry its ID
+	sessionID, refreshID, err := db.CreateSession(user.Email, r.UserAgent(), utils.ClientIP(r))
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	writeSessionTokens(w, user, scopes, sessionID, refreshID)
+}
+
+func writeSessionTokens(w http.ResponseWriter, user models.Users, scopes []string, sessionID, refreshID string) {
+	// generate JWT token
+	token, err := utils.GenerateToken(user, scopes, sessionID)
+	if err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	refreshToken, err := utils.GenerateRefreshToken(user, scopes, sessionID, refreshID)
+	if err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"session_id":    sessionID,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+// POST /token/refresh, body: {"refresh_token": "..."}
+// returns a new access token and a new refresh token, the old refresh token stops working
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil || data["refresh_token"] == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	claims, err := utils.ParseToken(data["refresh_token"])
+	if err != nil || claims.Purpose != utils.PurposeRefresh || claims.Sid == "" {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// the user may have been disabled or changed role since the login
+	user, err := db.GetUserByEmail(claims.Email)
+	if err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if user.Disabled || user.MustResetPassword {
+		http.Error(w, "account is not active", http.StatusForbidden)
+		return
+	}
+	// a narrowed token stays narrowed, a lower role can only take scopes away
+	scopes := utils.RestrictScopes(claims.Scopes, user.Role)
+	if len(scopes) == 0 {
+		http.Error(w, "none of the token's scopes is allowed for role "+user.Role+" any more, log in again", http.StatusForbidden)
+		return
+	}
+
+	refreshID, err := db.RotateRefreshToken(claims.Sid, claims.Email, claims.Id)
+	if err != nil {
+		if errors.Is(err, db.ErrSessionInvalid) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeSessionTokens(w, user, scopes, claims.Sid, refreshID)
+}
+
+// GET /me/sessions
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	sessions, err := db.ListSessions(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch sessions from database", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.Sid
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// DELETE /me/sessions/{id}
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	sessionID := mux.Vars(r)["id"]
+	if err := db.RevokeSession(sessionID, claims.Email); err != nil {
+		if errors.Is(err, db.ErrSessionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(claims.Email, "session.revoke", sessionID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /me/sessions
+// log out everywhere else, the session making the request stays active
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	n, err := db.RevokeUserSessions(claims.Email, claims.Sid)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(claims.Email, "session.revoke_others", claims.Email, fmt.Sprintf("revoked=%d", n))
+	writeJSON(w, http.StatusOK, map[string]int64{"revoked": n})
+}
+
+// POST /logout
+func Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if claims.Sid == "" {
+		http.Error(w, "Token is not tied to a session", http.StatusBadRequest)
+		return
+	}
+	if err := db.RevokeSession(claims.Sid, claims.Email); err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /password/reset, body: {"token": "...", "password": "..."}
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "failed parse JSON", http.StatusBadRequest)
+		return
+	}
+	token, password := data["token"], data["password"]
+	if token == "" || password == "" {
+		http.Error(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	email, err := db.ResetPassword(token, password)
+	if err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if errors.Is(err, db.ErrInvalidResetToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// whoever knew the old password must not stay logged in
+	if _, err = db.RevokeUserSessions(email, ""); err != nil {
+		log.Printf("Error revoking sessions of %s: %s", email, err)
+	}
+	db.RecordAudit(email, "password.reset", email, "")
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Password updated, please log in again"})
+}
+
+// PUT /me/password, body: {"current_password": "...", "new_password": "..."}
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if rejectAPIKey(w, claims) {
+		return
+	}
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "failed parse JSON", http.StatusBadRequest)
+		return
+	}
+	if data["current_password"] == "" || data["new_password"] == "" {
+		http.Error(w, "current_password and new_password are required", http.StatusBadRequest)
+		return
+	}
+
+	err := db.ChangePassword(claims.Email, data["current_password"], data["new_password"])
+	if err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if errors.Is(err, db.ErrWrongPassword) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = db.RevokeUserSessions(claims.Email, claims.Sid); err != nil {
+		log.Printf("Error revoking sessions of %s: %s", claims.Email, err)
+	}
+	db.RecordAudit(claims.Email, "password.change", claims.Email, "")
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Password updated"})
+}
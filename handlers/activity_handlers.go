@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+
+	"task-manager-api/db"
+)
+
+// GET /tasks/{id}/history?limit=&offset=
+func GetTaskHistory(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := getPagination(r)
+	entries, err := db.GetTaskHistory(id, claims.Email, limit, offset)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch task history")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// GET /activity?limit=&offset=, changes to everything the caller can see and the caller's own changes
+func GetActivityFeed(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	limit, offset := getPagination(r)
+	entries, err := db.GetActivityFeed(claims.Email, limit, offset)
+	if err != nil {
+		http.Error(w, "Couldn't fetch activity", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+	"task-manager-api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+const passwordResetTTL = 24 * time.Hour
+
+// record an admin action in the audit log, failures are logged but never block the request
+func auditAdmin(r *http.Request, action, target, details string) {
+	actor := "unknown"
+	if claims, ok := getClaims(r); ok {
+		actor = claims.Email
+	}
+	db.RecordAudit(actor, action, target, details)
+}
+
+// write the right status for errors returned by user management functions
+func writeUserError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrUserNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+}
+
+// GET /admin/users?q=&limit=&offset=
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	search := r.URL.Query().Get("q")
+	limit, offset := getPagination(r)
+
+	users, err := db.ListUsers(search, limit, offset)
+	if err != nil {
+		http.Error(w, "Couldn't fetch users from database", http.StatusInternalServerError)
+		return
+	}
+	auditAdmin(r, "users.list", "", fmt.Sprintf("q=%q limit=%d offset=%d", search, limit, offset))
+	writeJSON(w, http.StatusOK, users)
+}
+
+// GET /admin/users/{email}
+func AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	auditAdmin(r, "users.view", email, "")
+	writeJSON(w, http.StatusOK, user)
+}
+
+// PUT /admin/users/{email}/role
+func AdminSetRole(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	var data map[string]interface{}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	role, ok := data["role"].(string)
+	if !ok || !models.IsValidRole(role) {
+		http.Error(w, "role must be one of: user, admin", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetUserRole(email, role); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	auditAdmin(r, "users.set_role", email, "role="+role)
+	writeJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("Role of %s set to %s", email, role)})
+}
+
+// POST /admin/users/{email}/disable
+func AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, true)
+}
+
+// POST /admin/users/{email}/enable
+func AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, false)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	email := mux.Vars(r)["email"]
+	if claims, ok := getClaims(r); ok && disabled && claims.Email == email {
+		http.Error(w, "Admins cannot disable their own account", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetUserDisabled(email, disabled); err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	action := "users.enable"
+	if disabled {
+		action = "users.disable"
+		if _, err := db.RevokeUserSessions(email, ""); err != nil {
+			log.Printf("Error revoking sessions of %s: %s", email, err)
+		}
+	}
+	auditAdmin(r, action, email, "")
+	log.Printf("Account %s disabled=%v", email, disabled)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"email": email, "disabled": disabled})
+}
+
+// POST /admin/users/{email}/force-password-reset
+// the user can no longer log in until the password is reset with the returned token
+func AdminForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	token, expiresAt, err := db.ForcePasswordReset(email, passwordResetTTL)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	if _, err = db.RevokeUserSessions(email, ""); err != nil {
+		log.Printf("Error revoking sessions of %s: %s", email, err)
+	}
+	auditAdmin(r, "users.force_password_reset", email, "")
+	utils.NoStore(w)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"email":       email,
+		"reset_token": token,
+		"expires_at":  expiresAt,
+	})
+}
+
+// GET /admin/users/{email}/tasks
+func AdminGetUserTasks(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	tasks, err := db.GetAllTasks(email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch tasks from database", http.StatusInternalServerError)
+		return
+	}
+	if tasks == nil {
+		tasks = []models.Task{}
+	}
+	auditAdmin(r, "users.view_tasks", email, "")
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// GET /admin/audit?limit=&offset=
+func AdminGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, offset := getPagination(r)
+	entries, err := db.GetAuditLog(limit, offset)
+	if err != nil {
+		http.Error(w, "Couldn't fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	auditAdmin(r, "audit.view", "", "")
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// POST /admin/users/{email}/unlock
+// clears a lockout after too many failed logins
+func AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+	// without a limiter nothing is ever locked
+	if loginLimiter != nil {
+		if err := loginLimiter.Unlock(strings.ToLower(email)); err != nil {
+			http.Error(w, "Failed to unlock account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	auditAdmin(r, "users.unlock", email, "")
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Login attempts cleared for " + email})
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /me/api-keys
+// body: {"name": "ci", "scopes": ["tasks:read"], "expires_at": "2025-01-01T00:00:00Z"} or "expires_in_days": 30
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	// keys are managed from a login session, so a leaked key cannot mint or revoke keys
+	if rejectAPIKey(w, claims) {
+		return
+	}
+
+	var data struct {
+		Name          string     `json:"name"`
+		Scopes        []string   `json:"scopes"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		ExpiresInDays int        `json:"expires_in_days"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Name == "" {
+		http.Error(w, "API key name required", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := utils.ResolveScopes(data.Scopes, claims.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// a key can never hold more than the credential used to create it
+	for _, scope := range scopes {
+		if !claims.HasScope(scope) {
+			http.Error(w, "Cannot grant a scope the current token does not hold: "+scope, http.StatusForbidden)
+			return
+		}
+	}
+
+	expiresAt := data.ExpiresAt
+	if expiresAt == nil && data.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, data.ExpiresInDays)
+		expiresAt = &t
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, rawKey, err := db.CreateAPIKey(claims.Email, data.Name, scopes, expiresAt)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(claims.Email, "api_key.create", key.Prefix, fmt.Sprintf("name=%q scopes=%v", key.Name, key.Scopes))
+
+	// the full key is only ever shown in this response
+	utils.NoStore(w)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"api_key": key,
+		"key":     rawKey,
+	})
+}
+
+// GET /me/api-keys
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	keys, err := db.ListAPIKeys(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch API keys from database", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// DELETE /me/api-keys/{id}
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if rejectAPIKey(w, claims) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	if err = db.RevokeAPIKey(id, claims.Email); err != nil {
+		if errors.Is(err, db.ErrAPIKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(claims.Email, "api_key.revoke", strconv.Itoa(id), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"task-manager-api/utils"
+)
+
+// an API key, even one holding the account scope, cannot create or revoke keys
+func TestAPIKeysCannotManageKeys(t *testing.T) {
+	claims := &utils.CustomClaims{Email: "a@example.com", APIKeyID: 3, Scopes: []string{utils.ScopeAccount}}
+	tests := []struct {
+		method, path string
+		handler      http.HandlerFunc
+		vars         map[string]string
+	}{
+		{"POST", "/me/api-keys", CreateAPIKey, nil},
+		{"DELETE", "/me/api-keys/4", RevokeAPIKey, map[string]string{"id": "4"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"name": "child", "scopes": ["account"]}`))
+		r = r.WithContext(context.WithValue(r.Context(), "claims", claims))
+		if tt.vars != nil {
+			r = mux.SetURLVars(r, tt.vars)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with an API key: got %d, want 403", tt.method, tt.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"task-manager-api/db"
+
+	"github.com/gorilla/mux"
+)
+
+// resolve "me" to the caller's user ID, anything else must be a numeric user ID
+func resolveUserID(value, userEmail string) (int, error) {
+	if value == "me" {
+		user, err := db.GetUserByEmail(userEmail)
+		if err != nil {
+			return 0, err
+		}
+		return user.ID, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// write the response for assignment errors, falling back to writeTaskError
+func writeAssigneeError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, db.ErrUserNotFound), errors.Is(err, db.ErrNotAssigned):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, db.ErrAssigneeNoAccess):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		writeTaskError(w, err, msg)
+	}
+}
+
+// POST /tasks/{id}/assignees, body: {"user_id": 7} or {"email": "someone@example.com"}
+// the assignee must already have access to the task, through its workspace or a share
+func AssignTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var data struct {
+		UserID int    `json:"user_id"`
+		Email  string `json:"email"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.UserID == 0 && data.Email == "" {
+		http.Error(w, "user_id or email is required", http.StatusBadRequest)
+		return
+	}
+	if data.UserID == 0 {
+		user, err := db.GetUserByEmail(data.Email)
+		if err != nil {
+			http.Error(w, "User not found: "+data.Email, http.StatusNotFound)
+			return
+		}
+		data.UserID = user.ID
+	}
+
+	if err := db.AssignTask(id, claims.Email, data.UserID); err != nil {
+		writeAssigneeError(w, err, "Failed to assign task")
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// DELETE /tasks/{id}/assignees/{user_id}, "me" removes the caller
+func UnassignTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, err := resolveUserID(mux.Vars(r)["user_id"], claims.Email)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+	if err = db.UnassignTask(id, claims.Email, userID); err != nil {
+		writeAssigneeError(w, err, "Failed to unassign task")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /tasks/{id}/assignees/history?limit=&offset=
+func GetAssignmentHistory(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := getPagination(r)
+	events, err := db.GetAssignmentHistory(id, claims.Email, limit, offset)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch assignment history")
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+)
+
+// most operations accepted in one bulk request
+const maxBulkOperations = 500
+
+type bulkOperation struct {
+	Op          string                 `json:"op"` // create, update, delete or complete
+	ID          int                    `json:"id"`
+	Fields      map[string]interface{} `json:"fields"`   // update: same fields as PATCH /tasks/{id}
+	IfMatch     string                 `json:"if_match"` // optional ETag the task must still have
+	Name        string                 `json:"name"`     // create
+	Description string                 `json:"description"`
+	Status      bool                   `json:"status"`
+	ProjectID   *int                   `json:"project_id"`
+	Priority    interface{}            `json:"priority"`
+	DueAt       interface{}            `json:"due_at"`
+	Labels      interface{}            `json:"labels"`
+	Recurrence  interface{}            `json:"recurrence"`
+	WorkspaceID *int                   `json:"workspace_id"` // create, defaults to the request's workspace
+}
+
+type bulkItemResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	ID     int    `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// convert one operation of the request body to a db.BulkOp
+func toBulkOp(item bulkOperation, workspaceID *int) (db.BulkOp, error) {
+	op := db.BulkOp{Kind: item.Op, ID: item.ID, Precondition: matchETags(item.IfMatch)}
+	switch item.Op {
+	case db.BulkCreate:
+		if item.Name == "" {
+			return op, fmt.Errorf("Task name required")
+		}
+		if item.WorkspaceID == nil {
+			item.WorkspaceID = workspaceID
+		}
+		op.Task = models.Task{
+			Name:        item.Name,
+			Description: item.Description,
+			Status:      item.Status,
+			WorkspaceID: item.WorkspaceID,
+			ProjectID:   item.ProjectID,
+		}
+		var err error
+		if op.Task.Priority, err = priorityFromJSON(item.Priority); err != nil {
+			return op, err
+		}
+		if op.Task.DueAt, err = dueAtFromJSON(item.DueAt); err != nil {
+			return op, err
+		}
+		if op.Task.Labels, err = labelsFromJSON(item.Labels); err != nil {
+			return op, err
+		}
+		if op.Task.Recurrence, err = recurrenceFromJSON(item.Recurrence); err != nil {
+			return op, err
+		}
+	case db.BulkUpdate:
+		updates, err := taskUpdatesFromJSON(item.Fields, false)
+		if err != nil {
+			return op, err
+		}
+		op.Updates = updates
+	case db.BulkDelete, db.BulkComplete:
+	default:
+		return op, fmt.Errorf("op must be create, update, delete or complete")
+	}
+	if item.Op != db.BulkCreate && item.ID <= 0 {
+		return op, fmt.Errorf("id is required")
+	}
+	return op, nil
+}
+
+// POST /tasks/bulk
+// body: {"mode": "atomic" | "partial", "operations": [{"op": "create", "name": "..."}, {"op": "update", "id": 1,
+// "fields": {"status": true}, "if_match": "\"1-3\""}, {"op": "delete", "id": 2}, {"op": "complete", "id": 3}]}
+// atomic (the default) applies all operations or none, partial applies every operation that succeeds.
+// The whole batch is one operation for POST /undo
+func BulkTasks(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	workspaceID, err := workspaceFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Mode       string          `json:"mode"`
+		Operations []bulkOperation `json:"operations"`
+	}
+	if err = readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Mode == "" {
+		data.Mode = "atomic"
+	}
+	if data.Mode != "atomic" && data.Mode != "partial" {
+		http.Error(w, "mode must be atomic or partial", http.StatusBadRequest)
+		return
+	}
+	if len(data.Operations) == 0 || len(data.Operations) > maxBulkOperations {
+		http.Error(w, fmt.Sprintf("operations must hold between 1 and %d items", maxBulkOperations), http.StatusBadRequest)
+		return
+	}
+
+	ops := make([]db.BulkOp, len(data.Operations))
+	for i, item := range data.Operations {
+		if ops[i], err = toBulkOp(item, workspaceID); err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %s", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	operationID, results, committed, err := db.BulkTasks(claims.Email, ops, data.Mode == "atomic")
+	if err != nil {
+		http.Error(w, "Failed to run bulk operation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]bulkItemResult, len(results))
+	for i, res := range results {
+		items[i] = bulkItemResult{Index: i, Op: ops[i].Kind, ID: res.ID, Status: http.StatusOK}
+		switch {
+		case res.Err == nil && ops[i].Kind == db.BulkCreate:
+			items[i].Status = http.StatusCreated
+		case res.Err == nil && ops[i].Kind == db.BulkDelete:
+			items[i].Status = http.StatusNoContent
+		case errors.Is(res.Err, db.ErrBulkAborted):
+			items[i].Status = http.StatusFailedDependency
+			items[i].Error = res.Err.Error()
+		case res.Err != nil:
+			items[i].Status = taskErrorStatus(res.Err)
+			items[i].Error = res.Err.Error()
+		}
+	}
+
+	status := http.StatusOK
+	if !committed {
+		status = http.StatusUnprocessableEntity
+	}
+	response := map[string]interface{}{
+		"mode":      data.Mode,
+		"committed": committed,
+		"results":   items,
+	}
+	if committed {
+		response["operation_id"] = operationID
+	}
+	writeJSON(w, status, response)
+}
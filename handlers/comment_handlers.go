@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"task-manager-api/db"
+)
+
+// longest comment accepted, in characters
+const maxCommentLength = 10000
+
+// GET /tasks/{id}/comments?limit=&offset=
+func ListComments(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := getPagination(r)
+	comments, err := db.ListComments(id, claims.Email, limit, offset)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch comments")
+		return
+	}
+	writeJSON(w, http.StatusOK, comments)
+}
+
+// POST /tasks/{id}/comments, body: {"body": "Blocked on the API review"}
+func AddComment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var data struct {
+		Body string `json:"body"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(data.Body) == "" {
+		http.Error(w, "Comment body required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(data.Body) > maxCommentLength {
+		http.Error(w, "Comment is too long", http.StatusBadRequest)
+		return
+	}
+	comment, err := db.AddComment(id, claims.Email, data.Body)
+	if err != nil {
+		writeTaskError(w, err, "Failed to add comment")
+		return
+	}
+	writeJSON(w, http.StatusCreated, comment)
+}
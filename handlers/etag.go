@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+)
+
+// strong ETag of a single task as rendered for the caller. It changes with every version of the
+// task, and the suffix differs between time zones (?tz=) and permissions, which both change the body
+func taskETag(t models.Task, loc *time.Location) string {
+	sum := sha256.Sum256([]byte(loc.String() + "\x00" + t.Permission))
+	return fmt.Sprintf(`"%d-%d-%s"`, t.ID, t.Version, hex.EncodeToString(sum[:4]))
+}
+
+// the task and version a strong task ETag was made for, tags without the suffix are accepted too
+func etagVersion(tag string) (id, version int, ok bool) {
+	if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(tag[1:len(tag)-1], "-", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	version, err = strconv.Atoi(parts[1])
+	return id, version, err == nil
+}
+
+// split an If-Match or If-None-Match header into its entity tags
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// precondition built from the If-Match header, nil when the request has none. Weak tags never
+// match. A tag matches when it was made for the current version of the task, whatever time zone or
+// permission it was rendered for, since the precondition protects against lost updates
+func ifMatch(r *http.Request) db.Precondition {
+	return matchETags(r.Header.Get("If-Match"))
+}
+
+// precondition that passes when the task matches one of the tags in an If-Match style list,
+// nil for an empty list
+func matchETags(header string) db.Precondition {
+	if header == "" {
+		return nil
+	}
+	tags := parseETags(header)
+	return func(current models.Task) bool {
+		for _, tag := range tags {
+			if tag == "*" {
+				return true
+			}
+			if id, version, ok := etagVersion(tag); ok && id == current.ID && version == current.Version {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// check the If-None-Match header against etag with the weak comparison
+func noneMatch(r *http.Request, etag string) bool {
+	for _, tag := range parseETags(r.Header.Get("If-None-Match")) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// write a task with its ETag, GET requests whose If-None-Match matches get 304 without a body.
+// Timestamps are rendered in the zone requested with ?tz=
+func writeTask(w http.ResponseWriter, r *http.Request, status int, task models.Task) {
+	loc, err := displayLocation(r)
+	if err != nil {
+		http.Error(w, "Invalid tz: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	task = taskIn(task, loc)
+	etag := taskETag(task, loc)
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodGet && noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, status, task)
+}
+
+// write a JSON response with an ETag computed from the body, 304 when If-None-Match matches
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to create response", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(out)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
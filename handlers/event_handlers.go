@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/events"
+	"task-manager-api/utils"
+)
+
+// how often an idle event stream sends a comment, keeps proxies from closing the connection
+var EventHeartbeat = 15 * time.Second
+
+// GET /events, a text/event-stream of task.created, task.updated and task.deleted events for every
+// task the caller can see. Each event has an id, a reconnect with Last-Event-ID (or ?last_event_id=)
+// first replays the events after it. When they are no longer buffered a reset event is sent and
+// the client has to reload its tasks. Timestamps are rendered in the zone requested with ?tz=.
+// The stream ends when the token expires and, checked every utils.CredentialCheckInterval, when the
+// session or API key is revoked or the account is disabled; the reconnect then gets 401 or 403
+func StreamEvents(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || db.EventHub == nil {
+		http.Error(w, "Event streaming is not available", http.StatusNotImplemented)
+		return
+	}
+	loc, err := displayLocation(r)
+	if err != nil {
+		http.Error(w, "Invalid tz: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lastID int64
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+	if raw != "" {
+		if lastID, err = strconv.ParseInt(raw, 10, 64); err != nil || lastID < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	email := claims.Email
+	sub, missed, complete := db.EventHub.Subscribe(func(e events.Event) bool { return e.VisibleTo(email) }, lastID)
+	defer db.EventHub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // no response buffering in nginx
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		if err = writeEvent(w, e, loc); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	recheck := time.NewTicker(utils.CredentialCheckInterval)
+	defer recheck.Stop()
+	var expiry <-chan time.Time
+	if claims.ExpiresAt != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(claims.ExpiresAt, 0)))
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expiry:
+			return
+		case <-recheck.C:
+			if utils.CheckCredentials(claims) != nil {
+				return
+			}
+		case e, open := <-sub.C:
+			if !open {
+				// dropped for falling behind, the client reconnects with its Last-Event-ID
+				return
+			}
+			if err = writeEvent(w, e, loc); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// write one event in text/event-stream format, the task is shared with other subscribers and
+// converted on a copy
+func writeEvent(w http.ResponseWriter, e events.Event, loc *time.Location) error {
+	e.Time = e.Time.In(loc)
+	if e.Task != nil {
+		t := taskIn(*e.Task, loc)
+		e.Task = &t
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
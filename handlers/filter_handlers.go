@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"task-manager-api/db"
+	"task-manager-api/filter"
+)
+
+// longest saved filter name accepted
+const maxFilterNameLength = 100
+
+// read and validate the body of POST and PUT /filters, writes 400 and returns false when it is invalid
+func savedFilterFromRequest(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	var data struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return "", "", false
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" || len(data.Name) > maxFilterNameLength {
+		http.Error(w, "Filter name required, at most 100 characters", http.StatusBadRequest)
+		return "", "", false
+	}
+	if _, err := filter.Parse(data.Query); err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return data.Name, data.Query, true
+}
+
+// POST /filters, body: {"name": "Urgent work", "query": "label:work AND priority>=high"}
+func CreateSavedFilter(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	name, query, ok := savedFilterFromRequest(w, r)
+	if !ok {
+		return
+	}
+	f, err := db.CreateSavedFilter(claims.Email, name, query)
+	if err != nil {
+		writeTaskError(w, err, "Failed to save filter")
+		return
+	}
+	writeJSON(w, http.StatusCreated, f)
+}
+
+// GET /filters
+func ListSavedFilters(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	filters, err := db.ListSavedFilters(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch saved filters", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, filters)
+}
+
+// GET /filters/{id}
+func GetSavedFilter(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	f, err := db.GetSavedFilter(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch saved filter")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// PUT /filters/{id}, same body as POST /filters
+func UpdateSavedFilter(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	name, query, ok := savedFilterFromRequest(w, r)
+	if !ok {
+		return
+	}
+	f, err := db.UpdateSavedFilter(id, claims.Email, name, query)
+	if err != nil {
+		writeTaskError(w, err, "Failed to update saved filter")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// DELETE /filters/{id}
+func DeleteSavedFilter(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteSavedFilter(id, claims.Email); err != nil {
+		writeTaskError(w, err, "Failed to delete saved filter")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /filters/{id}/tasks?limit=&offset=, the tasks matching a saved filter right now. Scoped to a
+// workspace with the X-Workspace-ID header
+func GetSavedFilterTasks(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	workspaceID, err := workspaceFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := db.GetSavedFilter(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch saved filter")
+		return
+	}
+	expr, err := filter.Parse(f.Query)
+	if err != nil {
+		// saved before the filter language changed
+		http.Error(w, "Saved filter is no longer valid: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	limit, offset := getPagination(r)
+	tasks, err := db.FilterTasks(claims.Email, expr, workspaceID, limit, offset)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch tasks from database")
+		return
+	}
+	if !localizeTasks(w, r, tasks) {
+		return
+	}
+	writeJSONWithETag(w, r, tasks)
+}
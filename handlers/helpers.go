@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"task-manager-api/db"
+	"task-manager-api/utils"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// get the user claims that JWTAuthMiddleware stored in the request context
+func getClaims(r *http.Request) (*utils.CustomClaims, bool) {
+	claims, ok := r.Context().Value("claims").(*utils.CustomClaims)
+	return claims, ok
+}
+
+// credentials and two factor settings can only be changed from a login session, not with an API key.
+// Writes a 403 and returns true for API keys
+func rejectAPIKey(w http.ResponseWriter, claims *utils.CustomClaims) bool {
+	if claims.APIKeyID != 0 {
+		http.Error(w, "This action requires a login token, API keys are not accepted", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// marshal v and write it as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to create response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// read the request body and unmarshal it into v
+func readJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// read limit and offset query parameters, falling back to defaults for missing or invalid values
+func getPagination(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// convert a decoded JSON value to a list of scopes, accepts a list of strings or a space separated string
+func scopesFromJSON(v interface{}) ([]string, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return utils.ParseScopes(val), nil
+	case []interface{}:
+		scopes := make([]string, 0, len(val))
+		for _, item := range val {
+			scope, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("scopes must be a list of strings")
+			}
+			scopes = append(scopes, scope)
+		}
+		return scopes, nil
+	default:
+		return nil, fmt.Errorf("scopes must be a list of strings")
+	}
+}
+
+// write a 422 with the list of violations when err is a password policy error, returns false otherwise
+func writePasswordPolicyError(w http.ResponseWriter, err error) bool {
+	var policyErr *utils.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":      "password_policy",
+		"message":    "password does not meet the password policy",
+		"violations": policyErr.Violations,
+	})
+	return true
+}
+
+// write 404 or 403 for task and workspace lookup and permission errors, 412 for failed preconditions,
+// 409 for conflicting names, 500 with msg for anything else
+func writeTaskError(w http.ResponseWriter, err error, msg string) {
+	status := taskErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		http.Error(w, msg, status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// the HTTP status writeTaskError uses for err
+func taskErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrTaskNotFound), errors.Is(err, db.ErrWorkspaceNotFound),
+		errors.Is(err, db.ErrProjectNotFound), errors.Is(err, db.ErrMemberNotFound), errors.Is(err, db.ErrFilterNotFound),
+		errors.Is(err, db.ErrWebhookNotFound), errors.Is(err, db.ErrDeliveryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, db.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, db.ErrFilterNameTaken):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parse the numeric {id} path variable, writes 400 and returns false when it is invalid
+func taskIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// the workspace a request is scoped to, from the {workspace_id} path prefix or the X-Workspace-ID
+// header. nil means the caller's personal tasks
+func workspaceFromRequest(r *http.Request) (*int, error) {
+	raw, ok := mux.Vars(r)["workspace_id"]
+	if !ok {
+		raw = r.Header.Get("X-Workspace-ID")
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(raw)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid workspace ID %q", raw)
+	}
+	return &id, nil
+}
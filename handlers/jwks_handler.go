@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"task-manager-api/utils"
+)
+
+// GET /.well-known/jwks.json
+// public keys other services use to verify our tokens, empty when tokens use the legacy HS256 secret
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	kr := utils.DefaultKeyring()
+	if kr == nil {
+		http.Error(w, "token signing is not initialised", http.StatusServiceUnavailable)
+		return
+	}
+	// keys change on rotation, let verifiers cache the set for a short while
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, kr.JWKS())
+}
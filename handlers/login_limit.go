@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/utils"
+)
+
+// set in main with the configured store, login attempts are not limited while it is nil
+var loginLimiter *utils.LoginLimiter
+
+func SetLoginLimiter(l *utils.LoginLimiter) {
+	loginLimiter = l
+}
+
+// audit hook for LoginLimiter.OnLockout
+func AuditLockout(key string, until time.Time) {
+	log.Printf("Login locked for %s until %s", key, until.Format(time.RFC3339))
+	db.RecordAudit("system", "login.lockout", key, "until="+until.UTC().Format(time.RFC3339))
+}
+
+// write 429 with Retry-After and return false when the IP or account must wait
+func allowLoginAttempt(w http.ResponseWriter, ip, email string) bool {
+	if loginLimiter == nil {
+		return true
+	}
+	err := loginLimiter.Allow(ip, strings.ToLower(email))
+	if err == nil {
+		return true
+	}
+	var limitErr *utils.LimitError
+	if errors.As(err, &limitErr) {
+		seconds := int(math.Ceil(limitErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", fmt.Sprint(seconds))
+		http.Error(w, limitErr.Error(), http.StatusTooManyRequests)
+		return false
+	}
+	// a broken counter store should not lock everyone out
+	log.Printf("Error checking login attempts: %s", err)
+	return true
+}
+
+func recordLoginFailure(ip, email string) {
+	if loginLimiter == nil {
+		return
+	}
+	if err := loginLimiter.Failure(ip, strings.ToLower(email)); err != nil {
+		log.Printf("Error recording failed login: %s", err)
+	}
+}
+
+func recordLoginSuccess(email string) {
+	if loginLimiter == nil {
+		return
+	}
+	if err := loginLimiter.Success(strings.ToLower(email)); err != nil {
+		log.Printf("Error resetting login attempts: %s", err)
+	}
+}
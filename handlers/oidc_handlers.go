@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"task-manager-api/db"
+	"task-manager-api/oidc"
+)
+
+var (
+	oidcProvider *oidc.Provider
+	oidcLogins   = oidc.NewStateStore()
+)
+
+// enable OIDC login with the given provider, without it the /auth/oidc routes answer 404
+func SetOIDCProvider(p *oidc.Provider) {
+	oidcProvider = p
+}
+
+// GET /auth/oidc/login
+// redirects the browser to the identity provider with state, nonce and a PKCE challenge
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := oidcProvider.AuthCodeURL(r.Context(), state, nonce, oidc.CodeChallengeS256(verifier))
+	if err != nil {
+		log.Printf("OIDC login failed: %s", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if err = oidcLogins.Put(state, oidc.PendingLogin{Nonce: nonce, CodeVerifier: verifier}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// GET /auth/oidc/callback?code=...&state=...
+// exchanges the code, verifies the ID token and responds with the API's own token
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		http.Error(w, "login rejected by identity provider: "+errCode+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	login, ok := oidcLogins.Take(q.Get("state"))
+	if !ok {
+		http.Error(w, "invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	code := q.Get("code")
+	if code == "" {
+		http.Error(w, "missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := oidcProvider.Exchange(r.Context(), code, login.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %s", err)
+		http.Error(w, "failed to exchange authorization code", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := oidcProvider.VerifyIDToken(r.Context(), rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC token verification failed: %s", err)
+		http.Error(w, "invalid id token", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Email == "" || !idToken.EmailVerified {
+		http.Error(w, "identity provider did not return a verified email", http.StatusForbidden)
+		return
+	}
+
+	email, err := db.LinkExternalIdentity(idToken.Issuer, idToken.Subject, idToken.Email, idToken.Name)
+	if err != nil {
+		log.Printf("Linking external identity failed: %s", err)
+		http.Error(w, "failed to link identity", http.StatusInternalServerError)
+		return
+	}
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(email, "login.oidc", idToken.Issuer, "sub="+idToken.Subject)
+	// the identity provider replaces the password, not the second factor: users with TOTP get a
+	// challenge token to exchange at /login/2fa
+	if !checkSecondFactor(w, r, user, "", "", nil) {
+		return
+	}
+	completeLogin(w, r, user, nil)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/oidc"
+	"task-manager-api/oidc/oidctest"
+	"task-manager-api/utils"
+)
+
+const testClientID = "task-manager"
+
+var (
+	testDBOnce sync.Once
+	testDBErr  error
+)
+
+// connect to the database from DB_USERNAME, DB_PASSWORD and DB_NAME, the test is skipped when
+// they are not set
+func requireDatabase(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_NAME") == "" {
+		t.Skip("DB_NAME is not set, skipping test that needs Postgres")
+	}
+	testDBOnce.Do(func() {
+		os.Setenv("JWT_ALG", utils.AlgHS256)
+		os.Setenv("SECRET_KEY", "handlers-test-secret")
+		if testDBErr = utils.InitKeyring(); testDBErr != nil {
+			return
+		}
+		testDBErr = db.Init()
+	})
+	if testDBErr != nil {
+		t.Fatalf("database setup: %s", testDBErr)
+	}
+}
+
+// start an identity provider that logs everyone in as user and make it the API's provider
+func startOIDCProvider(t *testing.T, user oidctest.User) *oidctest.Server {
+	t.Helper()
+	idp := oidctest.NewServer(testClientID, user)
+	t.Cleanup(idp.Close)
+	SetOIDCProvider(oidc.NewProvider(oidc.Config{
+		IssuerURL:   idp.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://api.test/auth/oidc/callback",
+	}))
+	t.Cleanup(func() { SetOIDCProvider(nil) })
+	return idp
+}
+
+// run GET /auth/oidc/login and let the provider approve it, returns the callback request the
+// browser would make and the state it carries
+func oidcAuthorize(t *testing.T) (*http.Request, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got status %d: %s", rec.Code, rec.Body)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authURL.Query()
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization URL misses state, nonce or PKCE: %s", authURL)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d", res.StatusCode)
+	}
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Query().Get("state") != q.Get("state") || callback.Query().Get("code") == "" {
+		t.Fatalf("provider redirected to %s", callback)
+	}
+	return httptest.NewRequest(http.MethodGet, callback.String(), nil), q.Get("state")
+}
+
+func oidcCallback(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	OIDCCallback(rec, req)
+	return rec
+}
+
+func withQuery(req *http.Request, key, value string) *http.Request {
+	u := *req.URL
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return httptest.NewRequest(req.Method, u.String(), nil)
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	startOIDCProvider(t, oidctest.User{Subject: "u1", Email: "u1@example.com", EmailVerified: true})
+	req, _ := oidcAuthorize(t)
+	if rec := oidcCallback(withQuery(req, "state", "forged")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("forged state: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackStateIsSingleUse(t *testing.T) {
+	startOIDCProvider(t, oidctest.User{Subject: "u1", Email: "u1@example.com", EmailVerified: true})
+	req, _ := oidcAuthorize(t)
+	// the first callback uses up the state even though it fails
+	if rec := oidcCallback(withQuery(req, "code", "")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("missing code: got status %d, want 400", rec.Code)
+	}
+	if rec := oidcCallback(req); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reused state: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresCodeVerifier(t *testing.T) {
+	startOIDCProvider(t, oidctest.User{Subject: "u1", Email: "u1@example.com", EmailVerified: true})
+	req, state := oidcAuthorize(t)
+	login, ok := oidcLogins.Take(state)
+	if !ok {
+		t.Fatal("login state was not stored")
+	}
+	// an attacker who got hold of the code does not know the verifier
+	wrong, _ := oidc.RandomString()
+	if err := oidcLogins.Put(state, oidc.PendingLogin{Nonce: login.Nonce, CodeVerifier: wrong}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := oidcCallback(req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code verifier: got status %d, want 401", rec.Code)
+	}
+}
+
+func TestOIDCCallbackChecksNonce(t *testing.T) {
+	startOIDCProvider(t, oidctest.User{Subject: "u1", Email: "u1@example.com", EmailVerified: true})
+	req, state := oidcAuthorize(t)
+	login, _ := oidcLogins.Take(state)
+	if err := oidcLogins.Put(state, oidc.PendingLogin{Nonce: "other", CodeVerifier: login.CodeVerifier}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := oidcCallback(req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong nonce: got status %d, want 401", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresVerifiedEmail(t *testing.T) {
+	startOIDCProvider(t, oidctest.User{Subject: "u1", Email: "u1@example.com", EmailVerified: false})
+	req, _ := oidcAuthorize(t)
+	if rec := oidcCallback(req); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified email: got status %d, want 403", rec.Code)
+	}
+}
+
+func TestOIDCLoginEndToEnd(t *testing.T) {
+	requireDatabase(t)
+	suffix, _ := utils.GenerateRandomToken(4)
+	email := "oidc-" + suffix + "@example.com"
+	startOIDCProvider(t, oidctest.User{Subject: "sub-" + suffix, Email: email, EmailVerified: true, Name: "OIDC " + suffix})
+
+	req, _ := oidcAuthorize(t)
+	rec := oidcCallback(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d: %s", rec.Code, rec.Body)
+	}
+	var tokens map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := tokens["token"].(string)
+	claims, err := utils.ParseToken(token)
+	if err != nil {
+		t.Fatalf("callback returned an invalid token: %s", err)
+	}
+	if claims.Email != email || claims.Sid == "" {
+		t.Fatalf("token for %q with session %q, want %q with a session", claims.Email, claims.Sid, email)
+	}
+
+	// with TOTP enabled the provider login only earns a challenge token
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.StartTOTPEnrollment(email, secret); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, _ := utils.TOTPCode(secret, now.Add(-30*time.Second))
+	if _, err = db.ConfirmTOTP(email, code); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DisableTOTP(email)
+
+	req, _ = oidcAuthorize(t)
+	rec = oidcCallback(req)
+	var challenge map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &challenge); err != nil || challenge["two_factor_required"] != true {
+		t.Fatalf("callback with TOTP enabled: got status %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := challenge["token"]; ok {
+		t.Fatal("callback with TOTP enabled returned an access token")
+	}
+
+	code, _ = utils.TOTPCode(secret, now)
+	body := `{"challenge_token": "` + challenge["challenge_token"].(string) + `", "code": "` + code + `"}`
+	rec = httptest.NewRecorder()
+	LoginTwoFactor(rec, httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second factor: got status %d: %s", rec.Code, rec.Body)
+	}
+}
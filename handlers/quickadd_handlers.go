@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+	"task-manager-api/quickadd"
+)
+
+// POST /tasks/quick, body: {"text": "Pay rent tomorrow 9am #finance !high every month",
+// "timezone": "Europe/Berlin", "preview": false}
+// creates the task described by one line and responds with it and the parts of the text that were
+// interpreted. timezone is an IANA zone and defaults to the caller's settings, preview only parses
+// without creating
+func QuickAddTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	workspaceID, err := workspaceFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		Text     string `json:"text"`
+		Timezone string `json:"timezone"`
+		Preview  bool   `json:"preview"`
+	}
+	if err = readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	settings, err := db.GetUserSettings(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't read settings", http.StatusInternalServerError)
+		return
+	}
+	if data.Timezone != "" {
+		settings.Timezone = data.Timezone
+		if err = settings.Validate(); err != nil {
+			http.Error(w, "Unknown timezone: "+data.Timezone, http.StatusBadRequest)
+			return
+		}
+	}
+	loc := settings.Location()
+
+	parsed, err := quickadd.Parse(data.Text, time.Now(), loc, settings.FirstWeekday())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Preview {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"parsed": parsed})
+		return
+	}
+
+	id, err := db.InsertTask(models.Task{
+		Name:        parsed.Name,
+		OwnerEmail:  claims.Email,
+		WorkspaceID: workspaceID,
+		Priority:    parsed.Priority,
+		DueAt:       parsed.DueAt,
+		Labels:      parsed.Labels,
+		Recurrence:  parsed.Recurrence,
+	})
+	if err != nil {
+		writeTaskError(w, err, "Failed adding new task to database")
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"task": taskIn(task, loc), "parsed": parsed})
+}
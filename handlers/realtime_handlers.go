@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/realtime"
+	"task-manager-api/utils"
+)
+
+var realtimeServer *realtime.Server
+
+// enable the WebSocket API, without it GET /ws answers 501
+func SetRealtimeServer(s *realtime.Server) {
+	realtimeServer = s
+}
+
+// GET /ws, upgrades to a WebSocket for live task events and presence, see package realtime for
+// the messages. Authenticated like every other route, the connection is closed when the token
+// expires and, checked every utils.CredentialCheckInterval, when the session or API key is revoked
+// or the account is disabled
+func ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if realtimeServer == nil {
+		http.Error(w, "Live updates are not available", http.StatusNotImplemented)
+		return
+	}
+	user, err := db.GetUserByEmail(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't read user", http.StatusInternalServerError)
+		return
+	}
+	conn, err := realtimeServer.Upgrade(w, r)
+	if err != nil {
+		return // the handshake error was written by Upgrade
+	}
+	var expiresAt time.Time
+	if claims.ExpiresAt != 0 {
+		expiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	check := func() error { return utils.CheckCredentials(claims) }
+	realtimeServer.Serve(conn, realtime.User{ID: user.ID, Email: claims.Email, ExpiresAt: expiresAt, Check: check})
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"task-manager-api/db"
+	"task-manager-api/search"
+)
+
+// GET /search?q=&limit=&offset=, full-text search over tasks and comments the caller can see.
+// q supports "exact phrases", prefix* matches and -excluded terms, all terms must match
+func Search(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	q, err := search.Parse(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, "Invalid search query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset := getPagination(r)
+	results, err := db.SearchTasks(claims.Email, q, limit, offset)
+	if err != nil {
+		http.Error(w, "Couldn't search tasks", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
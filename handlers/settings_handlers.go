@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+)
+
+// GET /me/settings
+func GetSettings(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	settings, err := db.GetUserSettings(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't read settings", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// PUT or PATCH /me/settings, body: {"timezone": "Europe/Berlin", "week_start": "monday", "locale": "de-DE"}
+// fields that are left out keep their current value
+func UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	settings, err := db.GetUserSettings(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't read settings", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Timezone  *string `json:"timezone"`
+		WeekStart *string `json:"week_start"`
+		Locale    *string `json:"locale"`
+	}
+	if err = readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Timezone != nil {
+		settings.Timezone = *data.Timezone
+	}
+	if data.WeekStart != nil {
+		settings.WeekStart = *data.WeekStart
+	}
+	if data.Locale != nil {
+		settings.Locale = *data.Locale
+	}
+	if err = settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings, err = db.UpdateUserSettings(claims.Email, settings)
+	if err != nil {
+		http.Error(w, "Failed to update settings", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// the zone task timestamps are rendered in: ?tz=user for the caller's settings, ?tz=<IANA zone>, or
+// UTC by default
+func displayLocation(r *http.Request) (*time.Location, error) {
+	tz := r.URL.Query().Get("tz")
+	switch tz {
+	case "", "UTC":
+		return time.UTC, nil
+	case "user":
+		claims, ok := getClaims(r)
+		if !ok {
+			return time.UTC, nil
+		}
+		settings, err := db.GetUserSettings(claims.Email)
+		if err != nil {
+			return nil, err
+		}
+		return settings.Location(), nil
+	}
+	s := models.UserSettings{Timezone: tz, WeekStart: models.DefaultWeekStart, Locale: models.DefaultLocale}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s.Location(), nil
+}
+
+// convert the timestamps of a task to loc, they keep the same instant
+func taskIn(t models.Task, loc *time.Location) models.Task {
+	t.CreatedAt = t.CreatedAt.In(loc)
+	t.UpdatedAt = t.UpdatedAt.In(loc)
+	if t.DueAt != nil {
+		due := t.DueAt.In(loc)
+		t.DueAt = &due
+	}
+	if t.DeletedAt != nil {
+		deleted := t.DeletedAt.In(loc)
+		t.DeletedAt = &deleted
+	}
+	return t
+}
+
+func tasksIn(tasks []models.Task, loc *time.Location) []models.Task {
+	for i := range tasks {
+		tasks[i] = taskIn(tasks[i], loc)
+	}
+	return tasks
+}
+
+// convert tasks to the zone requested with ?tz=, writes 400 and returns false for unknown zones
+func localizeTasks(w http.ResponseWriter, r *http.Request, tasks []models.Task) bool {
+	loc, err := displayLocation(r)
+	if err != nil {
+		http.Error(w, "Invalid tz: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	tasksIn(tasks, loc)
+	return true
+}
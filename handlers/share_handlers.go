@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /tasks/{id}/shares, body: {"email": "someone@example.com", "permission": "viewer" | "editor"}
+// sharing again with the same user changes the permission
+func ShareTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	email, permission := data["email"], data["permission"]
+	if permission == "" {
+		permission = models.PermissionViewer
+	}
+	if email == "" || !models.IsSharePermission(permission) {
+		http.Error(w, "email is required and permission must be viewer or editor", http.StatusBadRequest)
+		return
+	}
+
+	share, err := db.ShareTask(id, claims.Email, email, permission)
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, db.ErrTaskNotFound) || errors.Is(err, db.ErrPermissionDenied) {
+			writeTaskError(w, err, "")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// GET /tasks/{id}/shares
+func ListTaskShares(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	shares, err := db.ListTaskShares(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch shares from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
+
+// DELETE /tasks/{id}/shares/{email}
+func RevokeTaskShare(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	err := db.RevokeTaskShare(id, claims.Email, mux.Vars(r)["email"])
+	if err != nil {
+		if errors.Is(err, db.ErrShareNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeTaskError(w, err, "Failed to revoke share")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /shared-with-me
+func GetSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	tasks, err := db.GetSharedWithUser(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch tasks from database", http.StatusInternalServerError)
+		return
+	}
+	if !localizeTasks(w, r, tasks) {
+		return
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// POST /projects/{project_id}/shares, body: {"email": "someone@example.com", "permission": "viewer" | "editor"}
+// gives access to every task of the project, sharing again with the same user changes the permission
+func ShareProject(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	projectID, ok := intFromPath(w, r, "project_id")
+	if !ok {
+		return
+	}
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	email, permission := data["email"], data["permission"]
+	if permission == "" {
+		permission = models.PermissionViewer
+	}
+	if email == "" || !models.IsSharePermission(permission) {
+		http.Error(w, "email is required and permission must be viewer or editor", http.StatusBadRequest)
+		return
+	}
+
+	share, err := db.ShareProject(projectID, claims.Email, email, permission)
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, db.ErrProjectNotFound) || errors.Is(err, db.ErrPermissionDenied) {
+			writeTaskError(w, err, "")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// GET /projects/{project_id}/shares
+func ListProjectShares(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	projectID, ok := intFromPath(w, r, "project_id")
+	if !ok {
+		return
+	}
+	shares, err := db.ListProjectShares(projectID, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch shares from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, shares)
+}
+
+// DELETE /projects/{project_id}/shares/{email}
+func RevokeProjectShare(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	projectID, ok := intFromPath(w, r, "project_id")
+	if !ok {
+		return
+	}
+	err := db.RevokeProjectShare(projectID, claims.Email, mux.Vars(r)["email"])
+	if err != nil {
+		if errors.Is(err, db.ErrShareNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeTaskError(w, err, "Failed to revoke share")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
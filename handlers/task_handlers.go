@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"task-manager-api/db"
+	"task-manager-api/filter"
 	"task-manager-api/models"
 	"task-manager-api/utils"
 )
@@ -73,24 +74,51 @@ func CreateTask(w http.ResponseWriter, r *http.Request, userEmail string) {
 		status = false
 	}
 
+	workspaceID, err := workspaceFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// create new task with the given details, set created_at, update_at to current time as default creation
 	new_task := models.Task{
 		Name:        name,
 		Description: desc,
 		Status:      status,
 		OwnerEmail:  userEmail,
+		WorkspaceID: workspaceID,
+	}
+	if projectID, ok := data["project_id"].(float64); ok {
+		id := int(projectID)
+		new_task.ProjectID = &id
+	}
+	if new_task.Priority, err = priorityFromJSON(data["priority"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if new_task.DueAt, err = dueAtFromJSON(data["due_at"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if new_task.Labels, err = labelsFromJSON(data["labels"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if new_task.Recurrence, err = recurrenceFromJSON(data["recurrence"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	log.Printf("POST request to create task: %v", new_task)
 
 	// adding new task to DB
-	err = db.InsertTask(new_task)
+	id, err := db.InsertTask(new_task)
 	if err != nil {
 		log.Printf("Failed adding new task to database, task details: %v", new_task)
-		http.Error(w, "Failed adding new task to database", http.StatusInternalServerError) // CHECK IF THIS IS THE CORRECT ERROR
+		writeTaskError(w, err, "Failed adding new task to database")
 		return
 	}
-	w.WriteHeader(http.StatusCreated) // indicate successful creation
+	writeJSON(w, http.StatusCreated, map[string]int{"id": id}) // indicate successful creation
 }
 
 // PUT
@@ -152,11 +180,11 @@ func UpdateTaskByID(w http.ResponseWriter, r *http.Request, userEmail string) {
 		updates["status"] = status
 	}
 
-	updates["updated_at"] = time.Now()
+	updates["updated_at"] = time.Now().UTC()
 
-	err = db.UpdateTask(id, userEmail, updates)
+	err = db.UpdateTask(id, userEmail, updates, ifMatch(r))
 	if err != nil {
-		http.Error(w, "Couldn't read task: "+err.Error(), http.StatusInternalServerError)
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -169,24 +197,56 @@ func GetTasks(w http.ResponseWriter, r *http.Request, userEmail string) {
 		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	tasks, err := db.GetAllTasks(userEmail)
+	workspaceID, err := workspaceFromRequest(r)
 	if err != nil {
-		http.Error(w, "Couldn't fetch tasks from database", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if tasks == nil {
-		tasks = []models.Task{} // in order to return response: [] instead of null -> ensures tasks is empty slice and not nil
+	var tasks []models.Task
+	if raw := r.URL.Query().Get("filter"); raw != "" {
+		// ?filter=<expression> searches everything the caller can see, see package filter
+		expr, parseErr := filter.Parse(raw)
+		if parseErr != nil {
+			http.Error(w, "Invalid filter: "+parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, offset := getPagination(r)
+		tasks, err = db.FilterTasks(userEmail, expr, workspaceID, limit, offset)
+	} else if assignee := r.URL.Query().Get("assignee"); assignee != "" {
+		// ?assignee=me or ?assignee=<user id>, combined with the workspace scope when one is given
+		assigneeID, idErr := resolveUserID(assignee, userEmail)
+		if idErr != nil {
+			http.Error(w, "Invalid assignee, use me or a user ID", http.StatusBadRequest)
+			return
+		}
+		tasks, err = db.GetAssignedTasks(userEmail, assigneeID, workspaceID)
+	} else if workspaceID != nil {
+		var projectID *int
+		if raw := r.URL.Query().Get("project_id"); raw != "" {
+			id, err := strconv.Atoi(raw)
+			if err != nil {
+				http.Error(w, "Invalid project ID format", http.StatusBadRequest)
+				return
+			}
+			projectID = &id
+		}
+		tasks, err = db.GetWorkspaceTasks(*workspaceID, userEmail, projectID)
+	} else {
+		tasks, err = db.GetAllTasks(userEmail)
 	}
-	out, err := json.Marshal(tasks)
 	if err != nil {
-		http.Error(w, "Couldn't parse tasks", http.StatusInternalServerError)
+		writeTaskError(w, err, "Couldn't fetch tasks from database")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(out)
+	if tasks == nil {
+		tasks = []models.Task{} // in order to return response: [] instead of null -> ensures tasks is empty slice and not nil
+	}
+	if !localizeTasks(w, r, tasks) {
+		return
+	}
+	writeJSONWithETag(w, r, tasks)
 }
 
 // DELETE
@@ -208,10 +268,10 @@ func DeleteTaskByID(w http.ResponseWriter, r *http.Request, userEmail string) {
 		return
 	}
 	// delete task from the database
-	err = db.DeleteTask(id, userEmail)
+	err = db.DeleteTask(id, userEmail, ifMatch(r))
 	if err != nil {
 		res := fmt.Sprintf("Error deleting task from database, Error: %s", err.Error())
-		http.Error(w, res, http.StatusInternalServerError)
+		writeTaskError(w, err, res)
 		return
 	}
 
@@ -263,6 +323,151 @@ func GetMultipleTasksByID(w http.ResponseWriter, r *http.Request, userEmail stri
 	w.Write(out)
 }
 
+// GET /tasks/{id}, supports If-None-Match
+func GetTaskByID(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// read the editable fields of a task from a PUT or PATCH body. PUT replaces every field, so missing
+// fields fall back to their defaults, PATCH only changes the fields that are present
+func taskUpdatesFromJSON(data map[string]interface{}, replace bool) (map[string]interface{}, error) {
+	updates := make(map[string]interface{})
+
+	if v, ok := data["name"]; ok || replace {
+		name, _ := v.(string)
+		if name == "" {
+			return nil, fmt.Errorf("Task name required")
+		}
+		updates["name"] = name
+	}
+	if v, ok := data["description"]; ok || replace {
+		desc, isString := v.(string)
+		if !isString && v != nil {
+			return nil, fmt.Errorf("description must be a string")
+		}
+		updates["description"] = desc
+	}
+	if v, ok := data["status"]; ok || replace {
+		status, isBool := v.(bool)
+		if !isBool && v != nil {
+			return nil, fmt.Errorf("status must be a boolean")
+		}
+		updates["status"] = status
+	}
+	if v, ok := data["project_id"]; ok || replace {
+		var projectID *int
+		switch val := v.(type) {
+		case nil:
+		case float64:
+			id := int(val)
+			projectID = &id
+		default:
+			return nil, fmt.Errorf("project_id must be a number or null")
+		}
+		updates["project_id"] = projectID
+	}
+	if v, ok := data["priority"]; ok || replace {
+		priority, err := priorityFromJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		updates["priority"] = priority
+	}
+	if v, ok := data["due_at"]; ok || replace {
+		dueAt, err := dueAtFromJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		updates["due_at"] = dueAt
+	}
+	if v, ok := data["labels"]; ok || replace {
+		labels, err := labelsFromJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		updates["labels"] = labels
+	}
+	if v, ok := data["recurrence"]; ok || replace {
+		recurrence, err := recurrenceFromJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		updates["recurrence"] = recurrence
+	}
+
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("Request body cannot be empty")
+	}
+	updates["updated_at"] = time.Now().UTC()
+	return updates, nil
+}
+
+// PUT and PATCH /tasks/{id}, honours If-Match and responds with the updated task and its new ETag
+func UpdateTaskByPath(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var data map[string]interface{}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Couldn't parse json", http.StatusBadRequest)
+		return
+	}
+	updates, err := taskUpdatesFromJSON(data, r.Method == http.MethodPut)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = db.UpdateTask(id, claims.Email, updates, ifMatch(r)); err != nil {
+		writeTaskError(w, err, "Couldn't update task: "+err.Error())
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// DELETE /tasks/{id}, honours If-Match
+func DeleteTaskByPath(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := db.DeleteTask(id, claims.Email, ifMatch(r)); err != nil {
+		writeTaskError(w, err, "Error deleting task from database, Error: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func CreateUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -296,6 +501,9 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	err = db.CreateUser(user)
 	if err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "invalid request format") {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		} else if strings.Contains(err.Error(), "invalid email format") || strings.Contains(err.Error(), "email already exists") {
@@ -334,7 +542,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var cred map[string]string
+	var cred map[string]interface{}
 
 	err = json.Unmarshal(body, &cred)
 	if err != nil {
@@ -342,40 +550,109 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email, emailOK := cred["email"]
-	password, passwordOK := cred["password"]
+	email, emailOK := cred["email"].(string)
+	password, passwordOK := cred["password"].(string)
 
 	if !emailOK || !passwordOK {
 		http.Error(w, "invalid request format", http.StatusBadRequest)
 		return
 	}
 
-	user, err := db.GetUserByEmail(email)
-	hashedPassword := user.Password
-	credOK := utils.CheckPassword(hashedPassword, password)
+	// optional "scopes" list to get a restricted token, e.g. ["tasks:read"] for dashboards
+	requestedScopes, err := scopesFromJSON(cred["scopes"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// brute force protection, per client IP and per account
+	ip := utils.ClientIP(r)
+	if !allowLoginAttempt(w, ip, email) {
+		return
+	}
 
-	if err != nil || !credOK {
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
 		if strings.Contains(err.Error(), "not found in database") {
+			recordLoginFailure(ip, email)
 			http.Error(w, "invalid email or password", http.StatusUnauthorized)
+			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// generate JWT token
-	token, err := utils.GenerateToken(user)
-	if err != nil {
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+	if !utils.CheckPassword(user.Password, password) {
+		recordLoginFailure(ip, email)
+		http.Error(w, "invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
-	response := map[string]string{"token": token}
-	jsonRes, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, "failed to create response", http.StatusInternalServerError)
+	// two factor: the password alone only earns a challenge token unless a code was sent as well
+	code, _ := cred["code"].(string)
+	recoveryCode, _ := cred["recovery_code"].(string)
+	if !checkSecondFactor(w, r, user, code, recoveryCode, requestedScopes) {
 		return
 	}
+	recordLoginSuccess(email)
+	completeLogin(w, r, user, requestedScopes)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonRes)
+// read a priority from a decoded JSON value, null or missing means normal
+func priorityFromJSON(v interface{}) (string, error) {
+	if v == nil {
+		return models.PriorityNormal, nil
+	}
+	priority, ok := v.(string)
+	if !ok || models.PriorityRank(priority) == 0 {
+		return "", fmt.Errorf("priority must be one of %s", strings.Join(models.Priorities, ", "))
+	}
+	return priority, nil
+}
+
+// read a due date in RFC 3339 format from a decoded JSON value, null means no due date
+func dueAtFromJSON(v interface{}) (*time.Time, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("due_at must be an RFC 3339 timestamp or null")
+	}
+	dueAt, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("due_at must be an RFC 3339 timestamp or null")
+	}
+	return &dueAt, nil
+}
+
+// read labels from a decoded JSON list of strings, null means no labels
+func labelsFromJSON(v interface{}) ([]string, error) {
+	if v == nil {
+		return []string{}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("labels must be a list of strings")
+	}
+	labels := make([]string, 0, len(list))
+	for _, item := range list {
+		label, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("labels must be a list of strings")
+		}
+		labels = append(labels, label)
+	}
+	return models.NormalizeLabels(labels)
+}
+
+// read a recurrence rule from a decoded JSON value, null or "" means the task does not repeat
+func recurrenceFromJSON(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	rule, ok := v.(string)
+	if !ok || (rule != "" && !models.IsRecurrence(rule)) {
+		return "", fmt.Errorf("recurrence must be a rule like FREQ=WEEKLY;INTERVAL=2;BYDAY=MO or null")
+	}
+	return rule, nil
 }
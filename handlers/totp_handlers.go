@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+	"task-manager-api/utils"
+)
+
+// name shown in authenticator apps
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Task Manager"
+}
+
+// GET /me/2fa
+func TOTPStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	enabled, err := db.IsTOTPEnabled(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't read two factor status", http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{"enabled": enabled}
+	if enabled {
+		remaining, err := db.RemainingRecoveryCodes(claims.Email)
+		if err != nil {
+			http.Error(w, "Couldn't read two factor status", http.StatusInternalServerError)
+			return
+		}
+		res["recovery_codes_remaining"] = remaining
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /me/2fa/enroll
+// returns the secret and otpauth:// URI, 2FA is only enforced after /me/2fa/confirm
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if rejectAPIKey(w, claims) {
+		return
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if err = db.StartTOTPEnrollment(claims.Email, secret); err != nil {
+		if errors.Is(err, db.ErrTOTPAlreadyEnabled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+	utils.NoStore(w)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(totpIssuer(), claims.Email, secret),
+	})
+}
+
+// POST /me/2fa/confirm, body: {"code": "123456"}
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if rejectAPIKey(w, claims) {
+		return
+	}
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil || data["code"] == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := db.ConfirmTOTP(claims.Email, data["code"])
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrInvalidTOTPCode):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, db.ErrTOTPNotEnrolled), errors.Is(err, db.ErrTOTPAlreadyEnabled):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "Failed to confirm two factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+	db.RecordAudit(claims.Email, "2fa.enable", claims.Email, "")
+	utils.NoStore(w)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// DELETE /me/2fa, body: {"code": "123456"} or {"recovery_code": "abcde-fghij"}
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	if rejectAPIKey(w, claims) {
+		return
+	}
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "failed parse JSON", http.StatusBadRequest)
+		return
+	}
+	if err := db.VerifySecondFactor(claims.Email, data["code"], data["recovery_code"]); err != nil {
+		http.Error(w, "invalid two factor code", http.StatusUnauthorized)
+		return
+	}
+	if err := db.DisableTOTP(claims.Email); err != nil {
+		http.Error(w, "Failed to disable two factor authentication", http.StatusInternalServerError)
+		return
+	}
+	db.RecordAudit(claims.Email, "2fa.disable", claims.Email, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// called by Login after the password check. Returns true when the login can be completed: the user
+// has no 2FA or sent a valid code along with the password. Otherwise a challenge token is written
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user models.Users, code, recoveryCode string, scopes []string) bool {
+	enabled, err := db.IsTOTPEnabled(user.Email)
+	if err != nil {
+		http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !enabled {
+		return true
+	}
+
+	if code != "" || recoveryCode != "" {
+		if err := db.VerifySecondFactor(user.Email, code, recoveryCode); err != nil {
+			recordLoginFailure(utils.ClientIP(r), user.Email)
+			http.Error(w, "invalid two factor code", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	challenge, err := utils.GenerateChallengeToken(user, scopes)
+	if err != nil {
+		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		return false
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"two_factor_required": true,
+		"challenge_token":     challenge,
+	})
+	return false
+}
+
+// POST /login/2fa, body: {"challenge_token": "...", "code": "123456"} or "recovery_code"
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data map[string]string
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "failed parse JSON", http.StatusBadRequest)
+		return
+	}
+	if data["challenge_token"] == "" || (data["code"] == "" && data["recovery_code"] == "") {
+		http.Error(w, "challenge_token and code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := utils.ParseToken(data["challenge_token"])
+	if err != nil || challenge.Purpose != utils.PurposeTwoFactor {
+		http.Error(w, "invalid or expired challenge token", http.StatusUnauthorized)
+		return
+	}
+	// codes are only 6 digits, guessing them is limited like passwords
+	ip := utils.ClientIP(r)
+	if !allowLoginAttempt(w, ip, challenge.Email) {
+		return
+	}
+	if err = db.VerifySecondFactor(challenge.Email, data["code"], data["recovery_code"]); err != nil {
+		recordLoginFailure(ip, challenge.Email)
+		http.Error(w, "invalid two factor code", http.StatusUnauthorized)
+		return
+	}
+	recordLoginSuccess(challenge.Email)
+	if data["recovery_code"] != "" {
+		db.RecordAudit(challenge.Email, "2fa.recovery_code_used", challenge.Email, "")
+	}
+
+	user, err := db.GetUserByEmail(challenge.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	completeLogin(w, r, user, challenge.Scopes)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"task-manager-api/db"
+)
+
+// GET /trash?limit=&offset=, deleted tasks the caller can restore
+func ListTrash(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	limit, offset := getPagination(r)
+	tasks, err := db.ListTrash(claims.Email, limit, offset)
+	if err != nil {
+		http.Error(w, "Couldn't fetch trash from database", http.StatusInternalServerError)
+		return
+	}
+	if !localizeTasks(w, r, tasks) {
+		return
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// POST /trash/{id}/restore
+func RestoreTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := db.RestoreTask(id, claims.Email); err != nil {
+		writeTaskError(w, err, "Failed to restore task")
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// DELETE /trash/{id}, removes the task permanently
+func PurgeTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := db.PurgeTask(id, claims.Email); err != nil {
+		writeTaskError(w, err, "Failed to delete task")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"task-manager-api/db"
+)
+
+// POST /tasks/{id}/revert?version=N
+func RevertTask(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := taskIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version <= 0 {
+		http.Error(w, "version query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	if err = db.RevertTask(id, claims.Email, version); err != nil {
+		if errors.Is(err, db.ErrVersionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeTaskError(w, err, "Failed to revert task")
+		return
+	}
+	task, err := db.GetTask(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't read task: "+err.Error())
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// POST /undo, reverses the caller's last create, update, delete or bulk operation
+func Undo(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	result, err := db.UndoLastOperation(claims.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNothingToUndo):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, db.ErrUndoConflict), errors.Is(err, db.ErrTaskPurged), errors.Is(err, db.ErrVersionNotFound):
+			http.Error(w, "Cannot undo: "+err.Error(), http.StatusConflict)
+		default:
+			writeTaskError(w, err, "Failed to undo")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
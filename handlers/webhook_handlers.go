@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"task-manager-api/db"
+	"task-manager-api/utils"
+	"task-manager-api/webhooks"
+)
+
+// most webhooks a user can register
+const maxWebhooksPerUser = 20
+
+// check the event types of a webhook and drop duplicates, writes 400 and returns false when they
+// are invalid
+func webhookEvents(w http.ResponseWriter, eventTypes []string) ([]string, bool) {
+	if len(eventTypes) == 0 {
+		http.Error(w, "At least one event type required: "+strings.Join(webhooks.EventTypes, ", "), http.StatusBadRequest)
+		return nil, false
+	}
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, t := range eventTypes {
+		if !webhooks.IsEventType(t) {
+			http.Error(w, "Unknown event type "+strconv.Quote(t), http.StatusBadRequest)
+			return nil, false
+		}
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique, true
+}
+
+// POST /webhooks, body: {"url": "https://ci.example.com/hooks/tasks", "events": ["task.completed"]}.
+// The response holds the signing secret, it is not shown again
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if err := webhooks.ValidateURL(data.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	eventTypes, ok := webhookEvents(w, data.Events)
+	if !ok {
+		return
+	}
+	existing, err := db.ListWebhooks(claims.Email)
+	if err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		http.Error(w, "Webhook limit reached, delete one first", http.StatusConflict)
+		return
+	}
+	hook, err := db.CreateWebhook(claims.Email, data.URL, eventTypes)
+	if err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	utils.NoStore(w)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// GET /webhooks
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	hooks, err := db.ListWebhooks(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch webhooks", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// GET /webhooks/{id}
+func GetWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	hook, err := db.GetWebhook(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// PUT or PATCH /webhooks/{id}, body: {"url": "...", "events": [...], "active": false}, fields
+// left out keep their value. The secret does not change
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	var data struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	hook, err := db.GetWebhook(id, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Failed to update webhook")
+		return
+	}
+	if data.URL != nil {
+		if err := webhooks.ValidateURL(*data.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hook.URL = *data.URL
+	}
+	if data.Events != nil {
+		if hook.Events, ok = webhookEvents(w, data.Events); !ok {
+			return
+		}
+	}
+	if data.Active != nil {
+		hook.Active = *data.Active
+	}
+	hook, err = db.UpdateWebhook(id, claims.Email, hook)
+	if err != nil {
+		writeTaskError(w, err, "Failed to update webhook")
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// DELETE /webhooks/{id}, pending deliveries are dropped
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteWebhook(id, claims.Email); err != nil {
+		writeTaskError(w, err, "Failed to delete webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /webhooks/{id}/deliveries?limit=&offset=, newest first
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	limit, offset := getPagination(r)
+	deliveries, err := db.ListWebhookDeliveries(id, claims.Email, limit, offset)
+	if err != nil {
+		writeTaskError(w, err, "Couldn't fetch webhook deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// POST /webhooks/{id}/deliveries/{delivery_id}/redeliver, queues the event again. The new delivery
+// is returned right away, its outcome shows up in the delivery log
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery_id format", http.StatusBadRequest)
+		return
+	}
+	d, err := db.RedeliverWebhook(id, deliveryID, claims.Email)
+	if err != nil {
+		writeTaskError(w, err, "Failed to redeliver webhook")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, d)
+}
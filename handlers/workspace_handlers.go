@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"task-manager-api/db"
+	"task-manager-api/models"
+	"task-manager-api/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// lifetime of invitation links when the request does not set one
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+// write the response for workspace membership errors, falling back to writeTaskError
+func writeWorkspaceError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, db.ErrLastWorkspaceOwner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, db.ErrInvalidInvitation):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		writeTaskError(w, err, msg)
+	}
+}
+
+// parse a numeric path variable, writes 400 and returns false when it is invalid
+func intFromPath(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[name])
+	if err != nil {
+		http.Error(w, "Invalid "+name+" format", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// POST /workspaces, body: {"name": "Platform team"}
+func CreateWorkspace(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Name == "" {
+		http.Error(w, "Workspace name required", http.StatusBadRequest)
+		return
+	}
+	ws, err := db.CreateWorkspace(data.Name, claims.Email)
+	if err != nil {
+		http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ws)
+}
+
+// GET /workspaces
+func ListWorkspaces(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	workspaces, err := db.ListWorkspaces(claims.Email)
+	if err != nil {
+		http.Error(w, "Couldn't fetch workspaces from database", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, workspaces)
+}
+
+// GET /workspaces/{workspace_id}
+func GetWorkspace(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	ws, err := db.GetWorkspace(id, claims.Email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Couldn't fetch workspace from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, ws)
+}
+
+// DELETE /workspaces/{workspace_id}, deletes all tasks and projects of the workspace
+func DeleteWorkspace(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	if err := db.DeleteWorkspace(id, claims.Email); err != nil {
+		writeWorkspaceError(w, err, "Failed to delete workspace")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /workspaces/{workspace_id}/members
+func ListWorkspaceMembers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	members, err := db.ListWorkspaceMembers(id, claims.Email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Couldn't fetch members from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+// PUT /workspaces/{workspace_id}/members/{user_id}, body: {"role": "admin"}
+func SetWorkspaceMemberRole(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	userID, ok := intFromPath(w, r, "user_id")
+	if !ok {
+		return
+	}
+	var data struct {
+		Role string `json:"role"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if !models.IsWorkspaceRole(data.Role) {
+		http.Error(w, "role must be owner, admin, member or guest", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetWorkspaceMemberRole(id, claims.Email, userID, data.Role); err != nil {
+		writeWorkspaceError(w, err, "Failed to change member role")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /workspaces/{workspace_id}/members/{user_id}, members can remove themselves to leave
+func RemoveWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	userID, ok := intFromPath(w, r, "user_id")
+	if !ok {
+		return
+	}
+	if err := db.RemoveWorkspaceMember(id, claims.Email, userID); err != nil {
+		writeWorkspaceError(w, err, "Failed to remove member")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /workspaces/{workspace_id}/invitations
+// body: {"role": "member", "max_uses": 10, "expires_in_hours": 48}, every field is optional
+func CreateWorkspaceInvitation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	var data struct {
+		Role           string `json:"role"`
+		MaxUses        int    `json:"max_uses"`
+		ExpiresInHours int    `json:"expires_in_hours"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Role == "" {
+		data.Role = models.WorkspaceRoleMember
+	}
+	if data.Role == models.WorkspaceRoleOwner || !models.IsWorkspaceRole(data.Role) {
+		http.Error(w, "role must be admin, member or guest", http.StatusBadRequest)
+		return
+	}
+	if data.MaxUses < 0 || data.ExpiresInHours < 0 {
+		http.Error(w, "max_uses and expires_in_hours cannot be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultInvitationTTL
+	if data.ExpiresInHours > 0 {
+		ttl = time.Duration(data.ExpiresInHours) * time.Hour
+	}
+
+	inv, token, err := db.CreateWorkspaceInvitation(id, claims.Email, data.Role, data.MaxUses, ttl)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to create invitation")
+		return
+	}
+	// the token is only ever shown in this response
+	utils.NoStore(w)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"invitation": inv,
+		"token":      token,
+		"accept_url": "/invitations/" + token + "/accept",
+	})
+}
+
+// GET /workspaces/{workspace_id}/invitations
+func ListWorkspaceInvitations(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	invitations, err := db.ListWorkspaceInvitations(id, claims.Email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Couldn't fetch invitations from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, invitations)
+}
+
+// DELETE /workspaces/{workspace_id}/invitations/{id}
+func RevokeWorkspaceInvitation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	invitationID, ok := intFromPath(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := db.RevokeWorkspaceInvitation(id, claims.Email, invitationID); err != nil {
+		writeWorkspaceError(w, err, "Failed to revoke invitation")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /invitations/{token}/accept
+func AcceptWorkspaceInvitation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	ws, err := db.AcceptWorkspaceInvitation(mux.Vars(r)["token"], claims.Email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to accept invitation")
+		return
+	}
+	writeJSON(w, http.StatusOK, ws)
+}
+
+// POST /workspaces/{workspace_id}/projects, body: {"name": "Q3 launch"}
+func CreateProject(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		http.Error(w, "Failed to parse json", http.StatusBadRequest)
+		return
+	}
+	if data.Name == "" {
+		http.Error(w, "Project name required", http.StatusBadRequest)
+		return
+	}
+	project, err := db.CreateProject(id, claims.Email, data.Name)
+	if err != nil {
+		writeWorkspaceError(w, err, "Failed to create project")
+		return
+	}
+	writeJSON(w, http.StatusCreated, project)
+}
+
+// GET /workspaces/{workspace_id}/projects
+func ListProjects(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getClaims(r)
+	if !ok {
+		http.Error(w, "Could not extract user claims", http.StatusInternalServerError)
+		return
+	}
+	id, ok := intFromPath(w, r, "workspace_id")
+	if !ok {
+		return
+	}
+	projects, err := db.ListProjects(id, claims.Email)
+	if err != nil {
+		writeWorkspaceError(w, err, "Couldn't fetch projects from database")
+		return
+	}
+	writeJSON(w, http.StatusOK, projects)
+}
@@ -3,9 +3,18 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"task-manager-api/db"
-	_ "task-manager-api/handlers"
+	"task-manager-api/events"
+	"task-manager-api/handlers"
+	"task-manager-api/oidc"
+	"task-manager-api/realtime"
 	"task-manager-api/routes"
+	"task-manager-api/utils"
+	"task-manager-api/webhooks"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -16,6 +25,14 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = utils.InitKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = utils.InitPasswordPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
 	err = db.Init()
 	if err != nil {
 		log.Fatal(err)
@@ -26,6 +43,132 @@ func main() {
 		}
 	}()
 
+	// ADMIN_EMAILS is a comma separated list of users to promote to admin on startup
+	if admins := os.Getenv("ADMIN_EMAILS"); admins != "" {
+		if err := db.EnsureAdmins(strings.Split(admins, ",")); err != nil {
+			log.Printf("Error promoting admin users: %s", err)
+		}
+	}
+
+	// UNDO_WINDOW limits how far back POST /undo reaches, e.g. "30m"
+	if window := os.Getenv("UNDO_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Invalid UNDO_WINDOW: %s", err)
+		}
+		db.UndoWindow = d
+	}
+
+	// IDEMPOTENCY_WINDOW is how long responses to POST requests with an Idempotency-Key are replayed, e.g. "48h"
+	if window := os.Getenv("IDEMPOTENCY_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid IDEMPOTENCY_WINDOW: %q", window)
+		}
+		utils.IdempotencyWindow = d
+	}
+
+	// EVENT_REPLAY_SIZE is how many recent events GET /events keeps for clients resuming with Last-Event-ID
+	replaySize := events.DefaultReplaySize
+	if size := os.Getenv("EVENT_REPLAY_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid EVENT_REPLAY_SIZE: %q", size)
+		}
+		replaySize = n
+	}
+	db.EventHub = events.NewHub(replaySize)
+	// WS_ALLOWED_ORIGINS is a comma separated list of browser origins besides the API's own that may
+	// open /ws, e.g. the web app at "https://app.example.com"
+	realtimeServer := realtime.NewServer(db.EventHub, db.TaskPermission, db.ProjectAccess)
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		for _, origin := range strings.Split(origins, ",") {
+			realtimeServer.AllowedOrigins = append(realtimeServer.AllowedOrigins, strings.TrimSpace(origin))
+		}
+	}
+	handlers.SetRealtimeServer(realtimeServer)
+
+	// webhook deliveries are queued in the database and sent in the background. Receivers on
+	// loopback or private networks are refused unless WEBHOOK_ALLOW_PRIVATE_NETWORKS=true
+	dispatcher := webhooks.NewDispatcher(db.WebhookStore{}, os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true")
+	db.WebhookNotify = dispatcher.Wake
+	go dispatcher.Run(5*time.Second, nil)
+	// the delivery log keeps finished deliveries for 30 days
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := db.PurgeWebhookDeliveries(30 * 24 * time.Hour); err != nil {
+				log.Printf("Error purging webhook deliveries: %s", err)
+			}
+		}
+	}()
+
+	// deleted tasks stay in the trash for TRASH_RETENTION (default 30 days), then they are purged
+	trashRetention := 30 * 24 * time.Hour
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatalf("Invalid TRASH_RETENTION: %s", err)
+		}
+		trashRetention = d
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := db.PurgeTrash(trashRetention); err != nil {
+				log.Printf("Error purging trash: %s", err)
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := db.PurgeIdempotencyKeys(); err != nil {
+				log.Printf("Error purging idempotency keys: %s", err)
+			}
+		}
+	}()
+
+	// ended sessions are kept for a week so they still show up in audits, then removed
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := db.PurgeSessions(7 * 24 * time.Hour); err != nil {
+				log.Printf("Error purging sessions: %s", err)
+			}
+		}
+	}()
+
+	// login brute force protection, counters in memory unless LOGIN_ATTEMPT_STORE=database. Counters are
+	// per client IP, behind a reverse proxy set TRUSTED_PROXIES so clients do not share the proxy's
+	if err := utils.ConfigureClientIP(); err != nil {
+		log.Fatal(err)
+	}
+	var attemptStore utils.AttemptStore
+	if os.Getenv("LOGIN_ATTEMPT_STORE") == "database" {
+		attemptStore = db.LoginAttemptStore{}
+		go func() {
+			for range time.Tick(time.Hour) {
+				if err := db.PurgeLoginAttempts(24 * time.Hour); err != nil {
+					log.Printf("Error purging login attempts: %s", err)
+				}
+			}
+		}()
+	} else {
+		memoryStore := utils.NewMemoryAttemptStore()
+		memoryStore.StartSweep(5 * time.Minute)
+		attemptStore = memoryStore
+	}
+	limiter := utils.NewLoginLimiter(attemptStore)
+	if err := limiter.ConfigureFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	limiter.OnLockout = handlers.AuditLockout
+	handlers.SetLoginLimiter(limiter)
+
+	// single sign-on with the company identity provider, local password login stays available
+	if cfg, ok := oidc.ConfigFromEnv(); ok {
+		handlers.SetOIDCProvider(oidc.NewProvider(cfg))
+		log.Printf("OIDC login enabled with issuer %s", cfg.IssuerURL)
+	}
+
 	r := routes.NewRouter()
 	log.Fatal(http.ListenAndServe(":5000", r))
 }
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// activity actions
+const (
+	ActivityCreated  = "created"
+	ActivityUpdated  = "updated"
+	ActivityDeleted  = "deleted"
+	ActivityRestored = "restored" // taken back out of the trash
+)
+
+// TaskSnapshot holds the user editable fields of a task at one point in its history
+type TaskSnapshot struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Status      bool   `json:"status"`
+	ProjectID   *int   `json:"project_id"`
+	// missing in snapshots written before tasks had them
+	Priority   string     `json:"priority,omitempty"`
+	DueAt      *time.Time `json:"due_at,omitempty"`
+	Labels     []string   `json:"labels,omitempty"`
+	Recurrence string     `json:"recurrence,omitempty"`
+}
+
+// FieldChange is the old and new value of one task field, From is nil for created tasks
+// and To is nil for deleted ones
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// ActivityEntry is one change to a task in the append-only activity log
+type ActivityEntry struct {
+	ID          int64                  `json:"id"`
+	TaskID      int                    `json:"task_id"`
+	WorkspaceID *int                   `json:"workspace_id,omitempty"`
+	ActorID     *int                   `json:"actor_id"`
+	ActorEmail  string                 `json:"actor_email"`
+	Action      string                 `json:"action"`
+	Version     int                    `json:"version"` // per task, the first entry of every task is version 1
+	Changes     map[string]FieldChange `json:"changes"`
+	Snapshot    TaskSnapshot           `json:"snapshot"`     // the task after the change, or before it was deleted
+	OperationID string                 `json:"operation_id"` // shared by all entries written by one request
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+// UndoResult describes what POST /undo reversed
+type UndoResult struct {
+	UndoneOperationID string `json:"undone_operation_id"`
+	OperationID       string `json:"operation_id"` // the new operation that reversed it
+	TaskIDs           []int  `json:"task_ids"`
+}
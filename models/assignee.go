@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// assignment history actions
+const (
+	AssignmentAssigned   = "assigned"
+	AssignmentUnassigned = "unassigned"
+)
+
+// AssignmentEvent records a user being assigned to or removed from a task
+type AssignmentEvent struct {
+	TaskID     int       `json:"task_id"`
+	UserID     int       `json:"user_id"`
+	UserEmail  string    `json:"user_email"`
+	Action     string    `json:"action"`
+	ActorID    int       `json:"actor_id"`
+	ActorEmail string    `json:"actor_email"`
+	CreatedAt  time.Time `json:"created_at"`
+}
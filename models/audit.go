@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// AuditEntry is a record of an administrative or security relevant action
+type AuditEntry struct {
+	ID         int       `json:"id"`
+	ActorEmail string    `json:"actor_email"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	Details    string    `json:"details,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
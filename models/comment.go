@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Comment is a note left on a task by anyone who can see it
+type Comment struct {
+	ID          int       `json:"id"`
+	TaskID      int       `json:"task_id"`
+	AuthorID    *int      `json:"author_id"` // nil when the author's account was deleted
+	AuthorEmail string    `json:"author_email,omitempty"`
+	Body        string    `json:"body"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// SavedFilter is a named filter expression ("smart list") of a user
+type SavedFilter struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// search result types
+const (
+	SearchResultTask    = "task"
+	SearchResultComment = "comment"
+)
+
+// SearchResult is a task that matched a search, either through its name and description or
+// through one of its comments. Snippet is HTML: the matching text escaped, matches in <mark> tags
+type SearchResult struct {
+	Type      string  `json:"type"`
+	Task      Task    `json:"task"`
+	CommentID *int    `json:"comment_id,omitempty"`
+	Rank      float64 `json:"rank"`
+	Snippet   string  `json:"snippet"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Session is one login of a user on a device
+type Session struct {
+	ID         string    `json:"id"`
+	UserEmail  string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
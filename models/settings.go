@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaults of users who never changed their settings
+const (
+	DefaultTimezone  = "UTC"
+	DefaultWeekStart = "monday"
+	DefaultLocale    = "en-US"
+)
+
+// days a week can start on
+var WeekStarts = map[string]time.Weekday{
+	"monday":   time.Monday,
+	"sunday":   time.Sunday,
+	"saturday": time.Saturday,
+}
+
+// BCP 47 language tags like en, en-US, pt-BR or zh-Hant-TW
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{4})?(-([a-zA-Z]{2}|[0-9]{3}))?$`)
+
+// UserSettings are the preferences dates are read and shown with
+type UserSettings struct {
+	Timezone  string     `json:"timezone"`   // IANA zone, e.g. Europe/Berlin
+	WeekStart string     `json:"week_start"` // monday, sunday or saturday
+	Locale    string     `json:"locale"`     // BCP 47 tag, e.g. en-US
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// DefaultUserSettings are the settings of users without a settings row
+func DefaultUserSettings() UserSettings {
+	return UserSettings{Timezone: DefaultTimezone, WeekStart: DefaultWeekStart, Locale: DefaultLocale}
+}
+
+// check the settings and bring them into their canonical form
+func (s *UserSettings) Validate() error {
+	if s.Timezone == "" || strings.EqualFold(s.Timezone, "local") {
+		// Local is the server's zone, not something a user can pick
+		return fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+	s.WeekStart = strings.ToLower(s.WeekStart)
+	if _, ok := WeekStarts[s.WeekStart]; !ok {
+		return fmt.Errorf("week_start must be monday, sunday or saturday, not %q", s.WeekStart)
+	}
+	if !localePattern.MatchString(s.Locale) {
+		return fmt.Errorf("invalid locale %q, use a language tag like en-US", s.Locale)
+	}
+	return nil
+}
+
+// the time zone of the settings, UTC when it cannot be loaded
+func (s UserSettings) Location() *time.Location {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// the first day of the week of the settings, Monday when unset
+func (s UserSettings) FirstWeekday() time.Weekday {
+	if day, ok := WeekStarts[s.WeekStart]; ok {
+		return day
+	}
+	return time.Monday
+}
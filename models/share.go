@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// permission levels on a task, from least to most access
+const (
+	PermissionViewer = "viewer"
+	PermissionEditor = "editor"
+	PermissionOwner  = "owner"
+)
+
+// TaskShare gives another user access to a task
+type TaskShare struct {
+	TaskID     int       `json:"task_id"`
+	UserEmail  string    `json:"user_email"`
+	Permission string    `json:"permission"`
+	SharedBy   string    `json:"shared_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ProjectShare gives another user access to every task of a project
+type ProjectShare struct {
+	ProjectID  int       `json:"project_id"`
+	UserEmail  string    `json:"user_email"`
+	Permission string    `json:"permission"`
+	SharedBy   string    `json:"shared_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// check if the permission can be granted through a share
+func IsSharePermission(p string) bool {
+	return p == PermissionViewer || p == PermissionEditor
+}
+
+// check if permission p includes everything granted by required
+func PermissionAllows(p, required string) bool {
+	rank := map[string]int{PermissionViewer: 1, PermissionEditor: 2, PermissionOwner: 3}
+	return rank[p] > 0 && rank[p] >= rank[required]
+}
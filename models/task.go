@@ -1,14 +1,88 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// task priorities, from lowest to highest
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+// Priorities lists the priorities in ascending order
+var Priorities = []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityUrgent}
+
+// position of the priority in Priorities counting from 1, 0 for unknown values
+func PriorityRank(p string) int {
+	for i, name := range Priorities {
+		if name == p {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// limits of task labels
+const (
+	MaxLabels      = 20
+	MaxLabelLength = 50
+)
+
+// lower case, trim and deduplicate labels, keeping their order. Labels cannot be empty or contain
+// spaces or commas
+func NormalizeLabels(labels []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(label), "#")))
+		if label == "" || strings.ContainsAny(label, " \t,") || utf8.RuneCountInString(label) > MaxLabelLength {
+			return nil, fmt.Errorf("invalid label %q", label)
+		}
+		if !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	if len(normalized) > MaxLabels {
+		return nil, fmt.Errorf("a task can have at most %d labels", MaxLabels)
+	}
+	return normalized, nil
+}
+
+var recurrencePattern = regexp.MustCompile(`^FREQ=(DAILY|WEEKLY|MONTHLY|YEARLY)(;INTERVAL=[1-9][0-9]{0,2})?` +
+	`(;BYDAY=(MO|TU|WE|TH|FR|SA|SU)(,(MO|TU|WE|TH|FR|SA|SU)){0,6})?$`)
+
+// check if s is a supported recurrence rule: FREQ with optional INTERVAL and BYDAY, e.g.
+// FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH
+func IsRecurrence(s string) bool {
+	return recurrencePattern.MatchString(s)
+}
 
 type Task struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description`
-	Status      bool      `json:"status"`
-	OwnerEmail  string    `json:"owner_email`
-	Owner       *Users    `json:"owner,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Status      bool          `json:"status"`
+	OwnerEmail  string        `json:"owner_email"` // the creator, read from the users table through OwnerID
+	OwnerID     int           `json:"owner_id"`
+	WorkspaceID *int          `json:"workspace_id,omitempty"` // set when the task belongs to a workspace
+	ProjectID   *int          `json:"project_id,omitempty"`
+	Priority    string        `json:"priority"`
+	DueAt       *time.Time    `json:"due_at,omitempty"`
+	Labels      []string      `json:"labels"`
+	Recurrence  string        `json:"recurrence,omitempty"` // RFC 5545 RRULE subset, see IsRecurrence
+	Owner       *UserSummary  `json:"owner,omitempty"`
+	Assignees   []UserSummary `json:"assignees"`
+	Permission  string        `json:"permission,omitempty"` // caller's access level, set when listing shared tasks
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	DeletedAt   *time.Time    `json:"deleted_at,omitempty"` // set while the task is in the trash
+	Version     int           `json:"version"`              // incremented on every change, used for ETags
 }
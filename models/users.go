@@ -1,7 +1,29 @@
 package models
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type Users struct {
-	Username string `json: "username"`
-	Password string `json: "-"`
-	Email    string `json: "email"`
+	ID                int    `json:"id"`
+	Username          string `json:"username"`
+	Password          string `json:"-"`
+	Email             string `json:"email"`
+	Role              string `json:"role"`
+	Disabled          bool   `json:"disabled"`
+	MustResetPassword bool   `json:"must_reset_password"`
+}
+
+// UserSummary is a user as embedded in other resources, e.g. the owner and assignees of a task,
+// without account details
+type UserSummary struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// check if the given role is one of the known roles
+func IsValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
 }
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// workspace member roles, from most to least access
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+	WorkspaceRoleGuest  = "guest"
+)
+
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Role      string    `json:"role,omitempty"` // the caller's role, set when listing
+}
+
+type WorkspaceMember struct {
+	WorkspaceID int       `json:"workspace_id"`
+	UserID      int       `json:"user_id"`
+	Username    string    `json:"username"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+// WorkspaceInvitation is a link that lets anyone holding it join the workspace with Role
+type WorkspaceInvitation struct {
+	ID          int        `json:"id"`
+	WorkspaceID int        `json:"workspace_id"`
+	Role        string     `json:"role"`
+	CreatedBy   int        `json:"created_by"`
+	MaxUses     int        `json:"max_uses"` // 0 means unlimited
+	Uses        int        `json:"uses"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Project groups tasks of a workspace
+type Project struct {
+	ID          int       `json:"id"`
+	WorkspaceID int       `json:"workspace_id"`
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func IsWorkspaceRole(role string) bool {
+	return role == WorkspaceRoleOwner || role == WorkspaceRoleAdmin || role == WorkspaceRoleMember || role == WorkspaceRoleGuest
+}
+
+// check if role includes everything granted by required
+func WorkspaceRoleAllows(role, required string) bool {
+	rank := map[string]int{WorkspaceRoleGuest: 1, WorkspaceRoleMember: 2, WorkspaceRoleAdmin: 3, WorkspaceRoleOwner: 4}
+	return rank[role] > 0 && rank[role] >= rank[required]
+}
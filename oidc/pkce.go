@@ -0,0 +1,81 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// how long a login started at /auth/oidc/login can take to come back to the callback
+const loginTTL = 10 * time.Minute
+
+// upper bound of pending logins kept in memory
+const maxPendingLogins = 10000
+
+// generate a random URL safe string, used for state, nonce and PKCE verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// the S256 PKCE code challenge for a verifier (RFC 7636)
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PendingLogin is what we need to remember between redirecting to the provider and the callback
+type PendingLogin struct {
+	Nonce        string
+	CodeVerifier string
+	expiresAt    time.Time
+}
+
+// StateStore keeps pending logins keyed by the state parameter. It lives in memory, so the
+// callback has to reach the same instance that started the login
+type StateStore struct {
+	mu      sync.Mutex
+	pending map[string]PendingLogin
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{pending: make(map[string]PendingLogin)}
+}
+
+func (s *StateStore) Put(state string, login PendingLogin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.pending {
+		if now.After(v.expiresAt) {
+			delete(s.pending, k)
+		}
+	}
+	if len(s.pending) >= maxPendingLogins {
+		return errors.New("too many pending logins")
+	}
+	login.expiresAt = now.Add(loginTTL)
+	s.pending[state] = login
+	return nil
+}
+
+// get and remove a pending login, a state can only be used once
+func (s *StateStore) Take(state string) (PendingLogin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.pending[state]
+	if !ok {
+		return login, false
+	}
+	delete(s.pending, state)
+	if time.Now().After(login.expiresAt) {
+		return login, false
+	}
+	return login, true
+}
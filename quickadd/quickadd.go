@@ -0,0 +1,448 @@
+// Package quickadd parses one line task descriptions like
+//
+//	Pay rent tomorrow 9am #finance !high every month
+//
+// into a task name, due date, labels, priority and recurrence. Words that are not recognised make
+// up the name. Dates and times are read in the caller's time zone and "next week" starts on the
+// caller's first day of the week.
+package quickadd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"task-manager-api/models"
+)
+
+// token kinds
+const (
+	KindDate       = "date"
+	KindTime       = "time"
+	KindLabel      = "label"
+	KindPriority   = "priority"
+	KindRecurrence = "recurrence"
+)
+
+// longest line accepted
+const maxInputLength = 500
+
+// Token is a part of the input that was interpreted, Value is what it was read as
+type Token struct {
+	Text  string `json:"text"`
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Result is the task read from a line
+type Result struct {
+	Name       string     `json:"name"`
+	DueAt      *time.Time `json:"due_at,omitempty"`
+	Labels     []string   `json:"labels"`
+	Priority   string     `json:"priority"`
+	Recurrence string     `json:"recurrence,omitempty"` // RFC 5545 RRULE, e.g. FREQ=MONTHLY
+	Tokens     []Token    `json:"tokens"`
+}
+
+var ErrNoName = errors.New("the text has no task name left after reading dates, labels and priority")
+
+// default time of day for due dates given without a time
+const (
+	endOfDayHour   = 23
+	endOfDayMinute = 59
+	tonightHour    = 20
+	// "tonight" said after tonightHour is due this long from now
+	tonightOffset = time.Hour
+)
+
+// parser state for one line
+type parser struct {
+	words     []string // as written
+	lower     []string // lower case without trailing punctuation
+	used      []bool
+	now       time.Time // in the caller's zone
+	weekStart time.Weekday
+	result    Result
+	date      *time.Time // midnight of the due day
+	clock     *[2]int    // hour and minute
+	instant   *time.Time // exact due time from "in 3 hours"
+	weekday   *time.Weekday
+	tonight   bool
+	gotDate   bool
+	gotClock  bool
+}
+
+// Parse reads a line, now is the current time, loc the caller's time zone and weekStart the first
+// day of their week
+func Parse(text string, now time.Time, loc *time.Location, weekStart time.Weekday) (Result, error) {
+	if len(text) > maxInputLength {
+		return Result{}, fmt.Errorf("text is longer than %d characters", maxInputLength)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	p := &parser{words: strings.Fields(text), now: now.In(loc), weekStart: weekStart}
+	p.lower = make([]string, len(p.words))
+	p.used = make([]bool, len(p.words))
+	for i, w := range p.words {
+		p.lower[i] = strings.TrimRight(strings.ToLower(w), ".,;")
+	}
+	p.result.Priority = models.PriorityNormal
+	p.result.Labels = []string{}
+	p.result.Tokens = []Token{}
+
+	for i := 0; i < len(p.words); {
+		n := p.match(i)
+		if n == 0 {
+			i++
+			continue
+		}
+		for j := i; j < i+n; j++ {
+			p.used[j] = true
+		}
+		i += n
+	}
+
+	var name []string
+	for i, w := range p.words {
+		if !p.used[i] {
+			name = append(name, w)
+		}
+	}
+	p.result.Name = strings.Join(name, " ")
+	if p.result.Name == "" {
+		return p.result, ErrNoName
+	}
+	labels, err := models.NormalizeLabels(p.result.Labels)
+	if err != nil {
+		return p.result, err
+	}
+	p.result.Labels = labels
+	p.result.DueAt = p.dueAt()
+	return p.result, nil
+}
+
+// record an interpreted token covering n words from i
+func (p *parser) token(i, n int, kind, value string) int {
+	p.result.Tokens = append(p.result.Tokens, Token{Text: strings.Join(p.words[i:i+n], " "), Kind: kind, Value: value})
+	return n
+}
+
+// try all recognisers at word i, returns the number of words consumed
+func (p *parser) match(i int) int {
+	w := p.lower[i]
+	switch {
+	case strings.HasPrefix(w, "#") && len(w) > 1:
+		label := strings.TrimPrefix(w, "#")
+		p.result.Labels = append(p.result.Labels, label)
+		return p.token(i, 1, KindLabel, label)
+	case strings.HasPrefix(w, "!") && models.PriorityRank(w[1:]) > 0:
+		p.result.Priority = w[1:]
+		return p.token(i, 1, KindPriority, w[1:])
+	}
+	if n := p.matchRecurrence(i); n > 0 {
+		return n
+	}
+	if !p.gotDate {
+		if n := p.matchDate(i); n > 0 {
+			return n
+		}
+	}
+	if !p.gotClock {
+		if n := p.matchClock(i); n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// the lower case word at i, "" past the end
+func (p *parser) at(i int) string {
+	if i < len(p.lower) {
+		return p.lower[i]
+	}
+	return ""
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday, "tues": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday, "thurs": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+var rruleDays = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+var frequencies = map[string]string{
+	"day": "DAILY", "days": "DAILY", "daily": "DAILY",
+	"week": "WEEKLY", "weeks": "WEEKLY", "weekly": "WEEKLY",
+	"month": "MONTHLY", "months": "MONTHLY", "monthly": "MONTHLY",
+	"year": "YEARLY", "years": "YEARLY", "yearly": "YEARLY", "annually": "YEARLY",
+}
+
+// daily, every week, every other month, every 3 days, every monday, every weekday
+func (p *parser) matchRecurrence(i int) int {
+	if p.result.Recurrence != "" {
+		return 0
+	}
+	set := func(n int, rule string) int {
+		p.result.Recurrence = rule
+		return p.token(i, n, KindRecurrence, rule)
+	}
+	w := p.at(i)
+	switch w {
+	case "daily", "weekly", "monthly", "yearly", "annually":
+		return set(1, "FREQ="+frequencies[w])
+	case "every":
+	default:
+		return 0
+	}
+
+	next := p.at(i + 1)
+	if next == "weekday" || next == "weekdays" {
+		return set(2, "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR")
+	}
+	if day, ok := weekdays[next]; ok {
+		d := day
+		p.weekday = &d
+		return set(2, "FREQ=WEEKLY;BYDAY="+rruleDays[day])
+	}
+	if freq, ok := frequencies[next]; ok && !strings.HasSuffix(next, "s") {
+		return set(2, "FREQ="+freq)
+	}
+	interval, err := strconv.Atoi(next)
+	if next == "other" {
+		interval, err = 2, nil
+	}
+	if freq, ok := frequencies[p.at(i+2)]; ok && err == nil && interval > 0 && interval <= 365 {
+		return set(3, fmt.Sprintf("FREQ=%s;INTERVAL=%d", freq, interval))
+	}
+	return 0
+}
+
+var months = map[string]time.Month{
+	"jan": time.January, "january": time.January, "feb": time.February, "february": time.February,
+	"mar": time.March, "march": time.March, "apr": time.April, "april": time.April, "may": time.May,
+	"jun": time.June, "june": time.June, "jul": time.July, "july": time.July, "aug": time.August,
+	"august": time.August, "sep": time.September, "sept": time.September, "september": time.September,
+	"oct": time.October, "october": time.October, "nov": time.November, "november": time.November,
+	"dec": time.December, "december": time.December,
+}
+
+var dayOfMonth = regexp.MustCompile(`^(\d{1,2})(st|nd|rd|th)?$`)
+
+// read a day of the month like 5 or 5th
+func parseDayOfMonth(w string) (int, bool) {
+	m := dayOfMonth.FindStringSubmatch(w)
+	if m == nil {
+		return 0, false
+	}
+	d, _ := strconv.Atoi(m[1])
+	return d, d >= 1 && d <= 31
+}
+
+// set the due day, midnight in the caller's zone
+func (p *parser) setDate(i, n int, day time.Time) int {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, p.now.Location())
+	p.date, p.gotDate = &day, true
+	return p.token(i, n, KindDate, day.Format("2006-01-02"))
+}
+
+// today, tonight, tomorrow, [on|next] friday, next week, next month, in 3 days, in 2 hours,
+// 2024-05-01, may 1, 1 may. A leading "on" or "by" is consumed with the date
+func (p *parser) matchDate(i int) int {
+	if w := p.at(i); w == "on" || w == "by" {
+		if n := p.matchDate(i + 1); n > 0 {
+			// the token was recorded for the date alone, widen it to include the preposition
+			last := &p.result.Tokens[len(p.result.Tokens)-1]
+			last.Text = p.words[i] + " " + last.Text
+			return n + 1
+		}
+		return 0
+	}
+
+	today := time.Date(p.now.Year(), p.now.Month(), p.now.Day(), 0, 0, 0, 0, p.now.Location())
+	w := p.at(i)
+	switch w {
+	case "today":
+		return p.setDate(i, 1, today)
+	case "tonight":
+		p.tonight = true
+		return p.setDate(i, 1, today)
+	case "tomorrow", "tmrw", "tmr":
+		return p.setDate(i, 1, today.AddDate(0, 0, 1))
+	case "next", "this":
+		next := p.at(i + 1)
+		if day, ok := weekdays[next]; ok {
+			// "this friday" can be today, "next friday" never is
+			d := daysUntil(today.Weekday(), day)
+			if w == "next" && d == 0 {
+				d = 7
+			}
+			return p.setDate(i, 2, today.AddDate(0, 0, d))
+		}
+		if w == "next" && next == "week" {
+			// the start of the coming week, a week from today when today is the first day
+			d := daysUntil(today.Weekday(), p.weekStart)
+			if d == 0 {
+				d = 7
+			}
+			return p.setDate(i, 2, today.AddDate(0, 0, d))
+		}
+		if w == "next" && next == "month" {
+			return p.setDate(i, 2, time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, today.Location()))
+		}
+		return 0
+	case "in":
+		n, err := strconv.Atoi(p.at(i + 1))
+		if err != nil || n <= 0 || n > 1000 {
+			return 0
+		}
+		switch strings.TrimSuffix(p.at(i+2), "s") {
+		case "minute", "min":
+			return p.setInstant(i, 3, p.now.Add(time.Duration(n)*time.Minute))
+		case "hour":
+			return p.setInstant(i, 3, p.now.Add(time.Duration(n)*time.Hour))
+		case "day":
+			return p.setDate(i, 3, today.AddDate(0, 0, n))
+		case "week":
+			return p.setDate(i, 3, today.AddDate(0, 0, 7*n))
+		case "month":
+			return p.setDate(i, 3, today.AddDate(0, n, 0))
+		}
+		return 0
+	}
+
+	if day, ok := weekdays[w]; ok {
+		return p.setDate(i, 1, today.AddDate(0, 0, daysUntil(today.Weekday(), day)))
+	}
+	if d, err := time.ParseInLocation("2006-01-02", w, p.now.Location()); err == nil {
+		return p.setDate(i, 1, d)
+	}
+	// may 1, 1 may
+	if month, ok := months[w]; ok {
+		if day, ok := parseDayOfMonth(p.at(i + 1)); ok {
+			return p.setDate(i, 2, p.upcoming(month, day))
+		}
+	}
+	if day, ok := parseDayOfMonth(w); ok {
+		if month, ok := months[p.at(i+1)]; ok {
+			return p.setDate(i, 2, p.upcoming(month, day))
+		}
+	}
+	return 0
+}
+
+// days from one weekday to the next occurrence of another, 0 when it is the same day
+func daysUntil(from, to time.Weekday) int {
+	return (int(to) - int(from) + 7) % 7
+}
+
+// the next date with the month and day, this year or next year when it has passed
+func (p *parser) upcoming(month time.Month, day int) time.Time {
+	d := time.Date(p.now.Year(), month, day, 0, 0, 0, 0, p.now.Location())
+	if d.Before(time.Date(p.now.Year(), p.now.Month(), p.now.Day(), 0, 0, 0, 0, p.now.Location())) {
+		d = d.AddDate(1, 0, 0)
+	}
+	return d
+}
+
+func (p *parser) setInstant(i, n int, at time.Time) int {
+	p.instant, p.gotDate, p.gotClock = &at, true, true
+	return p.token(i, n, KindDate, at.Format(time.RFC3339))
+}
+
+var clockPattern = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+
+// 9am, 9:30pm, 9 pm, 14:00, noon, midnight, optionally after "at"
+func (p *parser) matchClock(i int) int {
+	start, w := i, p.at(i)
+	if w == "at" {
+		i++
+		w = p.at(i)
+	}
+
+	hour, minute, n := -1, 0, 1
+	switch w {
+	case "noon":
+		hour = 12
+	case "midnight":
+		hour = 0
+	default:
+		m := clockPattern.FindStringSubmatch(w)
+		if m == nil {
+			return 0
+		}
+		suffix := m[3]
+		if suffix == "" && (p.at(i+1) == "am" || p.at(i+1) == "pm") {
+			suffix, n = p.at(i+1), 2
+		}
+		// a bare number like "3" is not a time, it needs am/pm or minutes
+		if suffix == "" && m[2] == "" {
+			return 0
+		}
+		hour, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			minute, _ = strconv.Atoi(m[2])
+		}
+		switch {
+		case minute > 59:
+			return 0
+		case suffix == "" && hour > 23:
+			return 0
+		case suffix != "" && (hour < 1 || hour > 12):
+			return 0
+		case suffix == "am" && hour == 12:
+			hour = 0
+		case suffix == "pm" && hour < 12:
+			hour += 12
+		}
+	}
+
+	p.clock, p.gotClock = &[2]int{hour, minute}, true
+	return p.token(start, i-start+n, KindTime, fmt.Sprintf("%02d:%02d", hour, minute))
+}
+
+// combine the date and time that were read into the due time, in UTC
+func (p *parser) dueAt() *time.Time {
+	if p.instant != nil {
+		due := p.instant.UTC()
+		return &due
+	}
+	loc := p.now.Location()
+	day := p.date
+	if day == nil && p.weekday != nil && p.clock == nil {
+		// "every monday" without a date starts on the next monday
+		d := time.Date(p.now.Year(), p.now.Month(), p.now.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, daysUntil(p.now.Weekday(), *p.weekday))
+		day = &d
+	}
+
+	var due time.Time
+	switch {
+	case day == nil && p.clock == nil:
+		return nil
+	case day == nil:
+		// a time alone is the next time the clock shows it
+		due = time.Date(p.now.Year(), p.now.Month(), p.now.Day(), p.clock[0], p.clock[1], 0, 0, loc)
+		if !due.After(p.now) {
+			due = due.AddDate(0, 0, 1)
+		}
+	case p.clock != nil:
+		due = time.Date(day.Year(), day.Month(), day.Day(), p.clock[0], p.clock[1], 0, 0, loc)
+	case p.tonight:
+		due = time.Date(day.Year(), day.Month(), day.Day(), tonightHour, 0, 0, 0, loc)
+		if !due.After(p.now) {
+			due = p.now.Add(tonightOffset).Truncate(time.Minute)
+		}
+	default:
+		due = time.Date(day.Year(), day.Month(), day.Day(), endOfDayHour, endOfDayMinute, 0, 0, loc)
+	}
+	due = due.UTC()
+	return &due
+}
@@ -0,0 +1,118 @@
+package quickadd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+	// Wednesday 15 May 2024, 10:00 in Berlin
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, berlin)
+	at := func(month time.Month, day, hour, minute int) string {
+		return time.Date(2024, month, day, hour, minute, 0, 0, berlin).UTC().Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		text       string
+		now        time.Time // the Wednesday morning above when zero
+		name       string
+		due        string // RFC 3339 in UTC, "" for none
+		labels     []string
+		priority   string
+		recurrence string
+	}{
+		{text: "Buy milk", name: "Buy milk"},
+		{text: "Buy milk today", name: "Buy milk", due: at(5, 15, 23, 59)},
+		{text: "Buy milk tonight", name: "Buy milk", due: at(5, 15, 20, 0)},
+		// after 20:00 tonight is an hour from now rather than earlier the same evening
+		{text: "Buy milk tonight", now: time.Date(2024, 5, 15, 22, 30, 0, 0, berlin), name: "Buy milk", due: at(5, 15, 23, 30)},
+		{text: "Buy milk tonight 11pm", now: time.Date(2024, 5, 15, 22, 30, 0, 0, berlin), name: "Buy milk", due: at(5, 15, 23, 0)},
+		{text: "Pay rent tomorrow 9am #finance !high every month", name: "Pay rent", due: at(5, 16, 9, 0),
+			labels: []string{"finance"}, priority: "high", recurrence: "FREQ=MONTHLY"},
+		{text: "Call Bob at 9:30pm", name: "Call Bob", due: at(5, 15, 21, 30)},
+		// a time that already passed today is tomorrow
+		{text: "Stand-up 9am", name: "Stand-up", due: at(5, 16, 9, 0)},
+		{text: "Lunch noon", name: "Lunch", due: at(5, 15, 12, 0)},
+		{text: "Deploy 14:00 friday", name: "Deploy", due: at(5, 17, 14, 0)},
+		{text: "Review on friday", name: "Review", due: at(5, 17, 23, 59)},
+		{text: "Review this wednesday", name: "Review", due: at(5, 15, 23, 59)},
+		{text: "Review next wednesday", name: "Review", due: at(5, 22, 23, 59)},
+		{text: "Plan next week", name: "Plan", due: at(5, 20, 23, 59)},
+		{text: "Invoice next month", name: "Invoice", due: at(6, 1, 23, 59)},
+		{text: "Ping in 3 days", name: "Ping", due: at(5, 18, 23, 59)},
+		{text: "Ping in 2 hours", name: "Ping", due: at(5, 15, 12, 0)},
+		{text: "Taxes 2024-06-30", name: "Taxes", due: at(6, 30, 23, 59)},
+		{text: "Party may 20", name: "Party", due: at(5, 20, 23, 59)},
+		// a date that has passed this year is next year
+		{text: "Party 1st may", name: "Party", due: time.Date(2025, 5, 1, 23, 59, 0, 0, berlin).UTC().Format(time.RFC3339)},
+		{text: "Water plants every other day", name: "Water plants", recurrence: "FREQ=DAILY;INTERVAL=2"},
+		{text: "Gym every monday", name: "Gym", due: at(5, 20, 23, 59), recurrence: "FREQ=WEEKLY;BYDAY=MO"},
+		{text: "Timesheet every weekday 5pm", name: "Timesheet", due: at(5, 15, 17, 0), recurrence: "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR"},
+		{text: "Backup daily", name: "Backup", recurrence: "FREQ=DAILY"},
+		// a bare number is not a time and a second date is part of the name
+		{text: "Buy 3 apples today tomorrow", name: "Buy 3 apples tomorrow", due: at(5, 15, 23, 59)},
+		{text: "Fix #Bug #bug !urgent", name: "Fix", labels: []string{"bug"}, priority: "urgent"},
+		{text: "Say hi !loud", name: "Say hi !loud"},
+	}
+	for _, tt := range tests {
+		n := tt.now
+		if n.IsZero() {
+			n = now
+		}
+		res, err := Parse(tt.text, n, berlin, time.Monday)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.text, err)
+			continue
+		}
+		due := ""
+		if res.DueAt != nil {
+			due = res.DueAt.Format(time.RFC3339)
+		}
+		labels, priority := tt.labels, tt.priority
+		if labels == nil {
+			labels = []string{}
+		}
+		if priority == "" {
+			priority = "normal"
+		}
+		if res.Name != tt.name || due != tt.due || !reflect.DeepEqual(res.Labels, labels) ||
+			res.Priority != priority || res.Recurrence != tt.recurrence {
+			t.Errorf("Parse(%q) at %s\n got name %q due %q labels %v priority %s recurrence %q\nwant name %q due %q labels %v priority %s recurrence %q",
+				tt.text, n.Format("Mon 15:04"), res.Name, due, res.Labels, res.Priority, res.Recurrence,
+				tt.name, tt.due, labels, priority, tt.recurrence)
+		}
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	res, err := Parse("Submit report by friday at 5 pm #work", now, time.UTC, time.Monday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Token{
+		{Text: "by friday", Kind: KindDate, Value: "2024-05-17"},
+		{Text: "at 5 pm", Kind: KindTime, Value: "17:00"},
+		{Text: "#work", Kind: KindLabel, Value: "work"},
+	}
+	if !reflect.DeepEqual(res.Tokens, want) {
+		t.Errorf("tokens\n got %+v\nwant %+v", res.Tokens, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	now := time.Now()
+	if _, err := Parse("tomorrow 9am #work", now, time.UTC, time.Monday); !errors.Is(err, ErrNoName) {
+		t.Errorf("only tokens: got %v, want ErrNoName", err)
+	}
+	if _, err := Parse(strings.Repeat("a", maxInputLength+1), now, time.UTC, time.Monday); err == nil {
+		t.Error("overlong text: got no error")
+	}
+}
@@ -0,0 +1,530 @@
+// Package realtime serves the WebSocket API of /ws: clients subscribe to tasks and projects, get
+// their change events from the events hub and see who is viewing or editing a task.
+//
+// Messages are JSON objects with a type. Clients send
+//
+//	{"type": "subscribe", "task_id": 12}         or "project_id", also "unsubscribe"
+//	{"type": "presence", "task_id": 12, "state": "viewing"}   viewing, editing or idle
+//	{"type": "ping"}
+//
+// and may add a "ref" that is copied to the reply. The server sends subscribed, unsubscribed,
+// event, presence, pong and error messages.
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"task-manager-api/events"
+	"task-manager-api/models"
+)
+
+// presence states, idle clears the presence of the connection
+const (
+	StateViewing = "viewing"
+	StateEditing = "editing"
+	StateIdle    = "idle"
+)
+
+// limits of a single connection
+const (
+	maxSubscriptions = 200
+	maxMessageSize   = 16 << 10
+)
+
+// User is the authenticated user of a connection
+type User struct {
+	ID        int
+	Email     string
+	ExpiresAt time.Time // the connection is closed when the token runs out, zero for no limit
+	// called every Server.CheckInterval, an error (e.g. the session was revoked) closes the
+	// connection. Nil skips the checks
+	Check func() error
+}
+
+// Server keeps the connections, their subscriptions and the presence on tasks
+type Server struct {
+	hub *events.Hub
+	// the caller's permission on a task, an error when the task is not visible
+	taskPermission func(taskID int, email string) (string, error)
+	// nil when the user can see the tasks of the project
+	projectAccess func(projectID int, email string) error
+
+	// SendQueue is how many messages a connection can fall behind before it is closed
+	SendQueue     int
+	WriteTimeout  time.Duration
+	PingInterval  time.Duration // the connection is closed after two intervals without a frame
+	CheckInterval time.Duration // how often User.Check runs
+	// browser origins other than the API's own host that may connect, e.g. "https://app.example.com".
+	// Requests without an Origin header do not come from a browser and are accepted
+	AllowedOrigins []string
+
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	watchers map[int]map[*session]bool   // task subscriptions, they receive the task's presence
+	presence map[int]map[*session]string // states set by connections on tasks
+}
+
+// NewServer returns a server fed by hub that checks subscriptions with the permission functions
+func NewServer(hub *events.Hub, taskPermission func(int, string) (string, error), projectAccess func(int, string) error) *Server {
+	srv := &Server{
+		hub:            hub,
+		taskPermission: taskPermission,
+		projectAccess:  projectAccess,
+		SendQueue:      64,
+		WriteTimeout:   10 * time.Second,
+		PingInterval:   30 * time.Second,
+		CheckInterval:  time.Minute,
+		watchers:       map[int]map[*session]bool{},
+		presence:       map[int]map[*session]string{},
+	}
+	srv.upgrader = websocket.Upgrader{CheckOrigin: srv.checkOrigin}
+	return srv
+}
+
+// Upgrade completes the WebSocket handshake of a request for Serve. A cross-origin request from
+// an origin that is not allowed is refused with 403. On failure the HTTP error is already written
+func (srv *Server) Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	return srv.upgrader.Upgrade(w, r, nil)
+}
+
+// same origin requests, requests without an Origin header and AllowedOrigins may connect, so
+// another site cannot open a connection with the cookies or credentials of a visitor's browser
+func (srv *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range srv.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// message is the envelope of every message in both directions
+type message struct {
+	Type      string          `json:"type"`
+	Ref       json.RawMessage `json:"ref,omitempty"`
+	TaskID    *int            `json:"task_id,omitempty"`
+	ProjectID *int            `json:"project_id,omitempty"`
+	State     string          `json:"state,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Event     *events.Event   `json:"event,omitempty"`
+}
+
+// presenceMessage lists the users on a task, sent when it changes and after subscribing
+type presenceMessage struct {
+	Type   string          `json:"type"`
+	Ref    json.RawMessage `json:"ref,omitempty"`
+	TaskID int             `json:"task_id"`
+	Users  []PresentUser   `json:"users"`
+}
+
+// PresentUser is a user with a connection viewing or editing a task
+type PresentUser struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+	State  string `json:"state"`
+}
+
+// session is one connection
+type session struct {
+	srv  *Server
+	conn *websocket.Conn
+	user User
+	send chan []byte
+
+	done        chan struct{} // closed when the connection should end
+	stopOnce    sync.Once
+	closeCode   int
+	closeReason string
+
+	mu       sync.Mutex
+	tasks    map[int]bool
+	projects map[int]bool
+}
+
+// Serve runs a connection until it is closed
+func (srv *Server) Serve(conn *websocket.Conn, user User) {
+	s := &session{
+		srv:      srv,
+		conn:     conn,
+		user:     user,
+		send:     make(chan []byte, srv.SendQueue),
+		done:     make(chan struct{}),
+		tasks:    map[int]bool{},
+		projects: map[int]bool{},
+	}
+	// any frame, pongs included, keeps the connection open for two ping intervals, so a client that
+	// answers pings stays connected while it sends no messages
+	conn.SetReadLimit(maxMessageSize)
+	extendRead := func() error { return conn.SetReadDeadline(time.Now().Add(2 * srv.PingInterval)) }
+	extendRead()
+	conn.SetPongHandler(func(string) error { return extendRead() })
+
+	sub, _, _ := srv.hub.Subscribe(s.wants, 0)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		s.writeLoop(sub)
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				s.stop(websocket.CloseGoingAway, "")
+			}
+			break
+		}
+		extendRead()
+		s.handle(data)
+	}
+	s.stop(websocket.CloseNormalClosure, "")
+	<-writerDone
+
+	srv.hub.Unsubscribe(sub)
+	srv.removeSession(s)
+}
+
+// end the connection, the first reason given wins
+func (s *session) stop(code int, reason string) {
+	s.stopOnce.Do(func() {
+		s.closeCode, s.closeReason = code, reason
+		close(s.done)
+	})
+}
+
+// queue a message, a connection that cannot keep up is closed instead of buffering without bound
+func (s *session) enqueue(m interface{}) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Error encoding websocket message: %s", err)
+		return
+	}
+	select {
+	case s.send <- data:
+	default:
+		s.stop(websocket.CloseTryAgainLater, "client is not reading fast enough")
+	}
+}
+
+// the only goroutine that writes messages to the connection
+func (s *session) writeLoop(sub *events.Subscription) {
+	ping := time.NewTicker(s.srv.PingInterval)
+	defer ping.Stop()
+	var expiry <-chan time.Time
+	if !s.user.ExpiresAt.IsZero() {
+		timer := time.NewTimer(time.Until(s.user.ExpiresAt))
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	var check <-chan time.Time
+	if s.user.Check != nil {
+		ticker := time.NewTicker(s.srv.CheckInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	write := func(data []byte) bool {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
+		if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			s.stop(websocket.CloseGoingAway, "")
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-s.done:
+			// best effort, the client may already be gone
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(s.closeCode, s.closeReason),
+				time.Now().Add(time.Second))
+			s.conn.Close()
+			return
+		case data := <-s.send:
+			if !write(data) {
+				continue
+			}
+		case e, open := <-sub.C:
+			if !open {
+				// the hub dropped the subscription because events piled up
+				s.stop(websocket.CloseTryAgainLater, "client is not reading fast enough")
+				continue
+			}
+			data, err := json.Marshal(message{Type: "event", Event: &e})
+			if err != nil {
+				log.Printf("Error encoding websocket event: %s", err)
+				continue
+			}
+			write(data)
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.srv.WriteTimeout)); err != nil {
+				s.stop(websocket.CloseGoingAway, "")
+			}
+		case <-expiry:
+			s.stop(websocket.ClosePolicyViolation, "token expired")
+		case <-check:
+			if err := s.user.Check(); err != nil {
+				s.stop(websocket.ClosePolicyViolation, "credentials are no longer valid")
+			}
+		}
+	}
+}
+
+// hub filter: events of subscribed tasks and projects the user can see. A task moved out of a
+// subscribed project is still reported to the project's subscribers
+func (s *session) wants(e events.Event) bool {
+	if !e.VisibleTo(s.user.Email) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tasks[e.TaskID] {
+		return true
+	}
+	if e.ProjectID != nil && s.projects[*e.ProjectID] {
+		return true
+	}
+	if change, ok := e.Changes["project_id"]; ok {
+		if from, ok := change.From.(int); ok && s.projects[from] {
+			return true
+		}
+	}
+	return false
+}
+
+// handle a message from the client
+func (s *session) handle(data []byte) {
+	var in message
+	if err := json.Unmarshal(data, &in); err != nil {
+		s.enqueue(message{Type: "error", Error: "invalid message, expected a JSON object"})
+		return
+	}
+	reply := func(m message) {
+		m.Ref = in.Ref
+		s.enqueue(m)
+	}
+	fail := func(msg string) {
+		reply(message{Type: "error", Error: msg, TaskID: in.TaskID, ProjectID: in.ProjectID})
+	}
+
+	switch in.Type {
+	case "ping":
+		reply(message{Type: "pong"})
+	case "subscribe":
+		if err := s.subscribe(in.TaskID, in.ProjectID); err != nil {
+			fail(err.Error())
+			return
+		}
+		reply(message{Type: "subscribed", TaskID: in.TaskID, ProjectID: in.ProjectID})
+		if in.TaskID != nil {
+			s.enqueue(presenceMessage{Type: "presence", Ref: in.Ref, TaskID: *in.TaskID, Users: s.srv.presentUsers(*in.TaskID)})
+		}
+	case "unsubscribe":
+		if in.TaskID == nil && in.ProjectID == nil {
+			fail("task_id or project_id is required")
+			return
+		}
+		s.unsubscribe(in.TaskID, in.ProjectID)
+		reply(message{Type: "unsubscribed", TaskID: in.TaskID, ProjectID: in.ProjectID})
+	case "presence":
+		if in.TaskID == nil {
+			fail("task_id is required")
+			return
+		}
+		if err := s.setPresence(*in.TaskID, in.State); err != nil {
+			fail(err.Error())
+		}
+	default:
+		fail("unknown message type " + in.Type)
+	}
+}
+
+var (
+	errTaskNotFound    = errors.New("task not found")
+	errProjectNotFound = errors.New("project not found")
+	errTooManySubs     = errors.New("too many subscriptions")
+)
+
+// subscribe to a task or a project after checking the user can see it
+func (s *session) subscribe(taskID, projectID *int) error {
+	if (taskID == nil) == (projectID == nil) {
+		return errors.New("exactly one of task_id and project_id is required")
+	}
+	if taskID != nil {
+		if _, err := s.srv.taskPermission(*taskID, s.user.Email); err != nil {
+			return errTaskNotFound
+		}
+	} else if err := s.srv.projectAccess(*projectID, s.user.Email); err != nil {
+		return errProjectNotFound
+	}
+
+	s.mu.Lock()
+	if len(s.tasks)+len(s.projects) >= maxSubscriptions {
+		s.mu.Unlock()
+		return errTooManySubs
+	}
+	if taskID != nil {
+		s.tasks[*taskID] = true
+	} else {
+		s.projects[*projectID] = true
+	}
+	s.mu.Unlock()
+
+	if taskID != nil {
+		s.srv.mu.Lock()
+		if s.srv.watchers[*taskID] == nil {
+			s.srv.watchers[*taskID] = map[*session]bool{}
+		}
+		s.srv.watchers[*taskID][s] = true
+		s.srv.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *session) unsubscribe(taskID, projectID *int) {
+	s.mu.Lock()
+	if taskID != nil {
+		delete(s.tasks, *taskID)
+	}
+	if projectID != nil {
+		delete(s.projects, *projectID)
+	}
+	s.mu.Unlock()
+
+	if taskID != nil {
+		s.srv.mu.Lock()
+		delete(s.srv.watchers[*taskID], s)
+		if len(s.srv.watchers[*taskID]) == 0 {
+			delete(s.srv.watchers, *taskID)
+		}
+		s.srv.mu.Unlock()
+		// leaving a task also ends viewing or editing it
+		s.setPresence(*taskID, StateIdle)
+	}
+}
+
+// set what the connection is doing with a task, editing requires editor access
+func (s *session) setPresence(taskID int, state string) error {
+	if state != StateIdle {
+		permission, err := s.srv.taskPermission(taskID, s.user.Email)
+		if err != nil {
+			return errTaskNotFound
+		}
+		switch state {
+		case StateViewing:
+		case StateEditing:
+			if !models.PermissionAllows(permission, models.PermissionEditor) {
+				return errors.New("editing requires editor access")
+			}
+		default:
+			return errors.New("state must be viewing, editing or idle")
+		}
+	}
+
+	s.srv.mu.Lock()
+	previous := s.srv.presence[taskID][s]
+	if state == StateIdle {
+		delete(s.srv.presence[taskID], s)
+		if len(s.srv.presence[taskID]) == 0 {
+			delete(s.srv.presence, taskID)
+		}
+	} else {
+		if s.srv.presence[taskID] == nil {
+			s.srv.presence[taskID] = map[*session]string{}
+		}
+		s.srv.presence[taskID][s] = state
+	}
+	s.srv.mu.Unlock()
+
+	if previous != state && !(previous == "" && state == StateIdle) {
+		s.srv.broadcastPresence(taskID)
+	}
+	return nil
+}
+
+// users present on a task, one entry per user with editing winning over viewing
+func (srv *Server) presentUsers(taskID int) []PresentUser {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.presentUsersLocked(taskID)
+}
+
+func (srv *Server) presentUsersLocked(taskID int) []PresentUser {
+	users := []PresentUser{}
+	index := map[int]int{}
+	for s, state := range srv.presence[taskID] {
+		if i, ok := index[s.user.ID]; ok {
+			if state == StateEditing {
+				users[i].State = StateEditing
+			}
+			continue
+		}
+		index[s.user.ID] = len(users)
+		users = append(users, PresentUser{UserID: s.user.ID, Email: s.user.Email, State: state})
+	}
+	return users
+}
+
+// send the presence of a task to the connections subscribed to it
+func (srv *Server) broadcastPresence(taskID int) {
+	srv.mu.Lock()
+	users := srv.presentUsersLocked(taskID)
+	targets := make([]*session, 0, len(srv.watchers[taskID]))
+	for s := range srv.watchers[taskID] {
+		targets = append(targets, s)
+	}
+	srv.mu.Unlock()
+
+	// enqueue may stop a slow session, which must not happen under srv.mu
+	for _, s := range targets {
+		s.enqueue(presenceMessage{Type: "presence", TaskID: taskID, Users: users})
+	}
+}
+
+// forget a closed connection and clear its presence
+func (srv *Server) removeSession(s *session) {
+	srv.mu.Lock()
+	var changed []int
+	for taskID, states := range srv.presence {
+		if _, ok := states[s]; ok {
+			delete(states, s)
+			if len(states) == 0 {
+				delete(srv.presence, taskID)
+			}
+			changed = append(changed, taskID)
+		}
+	}
+	for taskID, sessions := range srv.watchers {
+		delete(sessions, s)
+		if len(sessions) == 0 {
+			delete(srv.watchers, taskID)
+		}
+	}
+	srv.mu.Unlock()
+
+	for _, taskID := range changed {
+		srv.broadcastPresence(taskID)
+	}
+}
@@ -0,0 +1,299 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"task-manager-api/events"
+	"task-manager-api/models"
+)
+
+// task 1 is visible to everyone, alice edits it and bob only views it. Task 2 and every project
+// but 10 are not visible
+func testPermission(taskID int, email string) (string, error) {
+	if taskID != 1 {
+		return "", errors.New("not found")
+	}
+	if email == "alice@example.com" {
+		return models.PermissionEditor, nil
+	}
+	return models.PermissionViewer, nil
+}
+
+func testProjectAccess(projectID int, email string) error {
+	if projectID != 10 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// start a realtime server behind httptest, ?user= picks the connection's user. check, when set,
+// becomes User.Check
+func startServer(t *testing.T, check func() error) (*Server, *events.Hub, string) {
+	t.Helper()
+	hub := events.NewHub(0)
+	srv := NewServer(hub, testPermission, testProjectAccess)
+	srv.PingInterval = time.Minute
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := srv.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		srv.Serve(conn, User{ID: id, Email: r.URL.Query().Get("user"), Check: check})
+	}))
+	t.Cleanup(ts.Close)
+	return srv, hub, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+type client struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dial(t *testing.T, url string, id int, email string) *client {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/?id="+strconv.Itoa(id)+"&user="+email, nil)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	c := &client{t: t, conn: conn}
+	t.Cleanup(c.close)
+	return c
+}
+
+// send a close frame and close the connection
+func (c *client) close() {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+func (c *client) send(msg string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		c.t.Fatalf("send: %s", err)
+	}
+}
+
+// read the next message, fails the test after a few seconds
+func (c *client) read() map[string]interface{} {
+	c.t.Helper()
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, data, err := c.conn.ReadMessage()
+		done <- result{data, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			c.t.Fatalf("read: %s", res.err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(res.data, &m); err != nil {
+			c.t.Fatalf("read: %s in %s", err, res.data)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("read: no message within 5s")
+		return nil
+	}
+}
+
+// read until a message of the type arrives
+func (c *client) expect(msgType string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		if m := c.read(); m["type"] == msgType {
+			return m
+		}
+	}
+}
+
+// read until the server closes the connection and return the close code
+func (c *client) closeCode() int {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := c.conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return closeErr.Code
+		}
+		if err != nil {
+			c.t.Fatalf("connection ended without a close frame: %s", err)
+		}
+	}
+}
+
+func TestSubscribePermissions(t *testing.T) {
+	_, _, url := startServer(t, nil)
+	c := dial(t, url, 2, "bob@example.com")
+
+	tests := []struct {
+		msg  string
+		want string // the reply type
+		err  string
+	}{
+		{`{"type": "subscribe", "task_id": 2, "ref": 1}`, "error", "task not found"},
+		{`{"type": "subscribe", "project_id": 11, "ref": 2}`, "error", "project not found"},
+		{`{"type": "subscribe", "task_id": 1, "project_id": 10, "ref": 3}`, "error", "exactly one of task_id and project_id is required"},
+		{`{"type": "subscribe", "project_id": 10, "ref": 4}`, "subscribed", ""},
+		{`{"type": "subscribe", "task_id": 1, "ref": 5}`, "subscribed", ""},
+		{`{"type": "presence", "task_id": 1, "state": "editing", "ref": 6}`, "error", "editing requires editor access"},
+		{`{"type": "presence", "task_id": 2, "state": "viewing", "ref": 7}`, "error", "task not found"},
+	}
+	for i, tt := range tests {
+		c.send(tt.msg)
+		m := c.read()
+		if m["type"] != tt.want || m["ref"] != float64(i+1) || (tt.err != "" && m["error"] != tt.err) {
+			t.Errorf("%s: got %v, want %s %q", tt.msg, m, tt.want, tt.err)
+		}
+		if tt.want == "subscribed" && m["task_id"] != nil {
+			c.expect("presence") // the current presence follows a task subscription
+		}
+	}
+}
+
+func TestEventsOnlyForSubscriptions(t *testing.T) {
+	_, hub, url := startServer(t, nil)
+	c := dial(t, url, 2, "bob@example.com")
+	c.send(`{"type": "subscribe", "task_id": 1}`)
+	c.expect("subscribed")
+	c.expect("presence")
+
+	audience := []string{"bob@example.com"}
+	hub.Publish(events.Event{Type: events.TaskUpdated, TaskID: 3, Audience: audience})                      // not subscribed
+	hub.Publish(events.Event{Type: events.TaskUpdated, TaskID: 1, Audience: []string{"carol@example.com"}}) // not visible
+	hub.Publish(events.Event{Type: events.TaskDeleted, TaskID: 1, Audience: audience})
+
+	m := c.expect("event")
+	event, _ := m["event"].(map[string]interface{})
+	if event["type"] != events.TaskDeleted || event["task_id"] != float64(1) {
+		t.Fatalf("got event %v, want task.deleted of task 1", event)
+	}
+}
+
+func TestPresenceBroadcast(t *testing.T) {
+	_, _, url := startServer(t, nil)
+	alice := dial(t, url, 1, "alice@example.com")
+	bob := dial(t, url, 2, "bob@example.com")
+	for _, c := range []*client{alice, bob} {
+		c.send(`{"type": "subscribe", "task_id": 1}`)
+		c.expect("subscribed")
+		c.expect("presence")
+	}
+
+	users := func(m map[string]interface{}) string {
+		list, _ := m["users"].([]interface{})
+		parts := []string{}
+		for _, u := range list {
+			u := u.(map[string]interface{})
+			parts = append(parts, u["email"].(string)+"="+u["state"].(string))
+		}
+		return strings.Join(parts, ",")
+	}
+
+	alice.send(`{"type": "presence", "task_id": 1, "state": "editing"}`)
+	if got := users(bob.expect("presence")); got != "alice@example.com=editing" {
+		t.Fatalf("bob sees %q, want alice editing", got)
+	}
+	if got := users(alice.expect("presence")); got != "alice@example.com=editing" {
+		t.Fatalf("alice sees %q, want herself editing", got)
+	}
+
+	// closing the connection clears its presence for everyone else
+	alice.close()
+	if got := users(bob.expect("presence")); got != "" {
+		t.Fatalf("bob sees %q after alice left, want nobody", got)
+	}
+}
+
+func TestSlowClientIsClosed(t *testing.T) {
+	_, hub, url := startServer(t, nil)
+	c := dial(t, url, 2, "bob@example.com")
+	c.send(`{"type": "subscribe", "task_id": 1}`)
+	c.expect("subscribed")
+	c.expect("presence")
+
+	// the client stops reading: once the socket buffers are full the server's writes block and
+	// the events pile up in the subscription until the hub drops it
+	task := &models.Task{ID: 1, Description: strings.Repeat("x", 128<<10)}
+	c.conn.SetReadLimit(1 << 20)
+	for i := 0; i < 500; i++ {
+		hub.Publish(events.Event{Type: events.TaskUpdated, TaskID: 1, Task: task, Audience: []string{"bob@example.com"}})
+	}
+	if code := c.closeCode(); code != websocket.CloseTryAgainLater {
+		t.Fatalf("got close code %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestRevokedCredentialsClose(t *testing.T) {
+	var revoked atomic.Bool
+	srv, _, url := startServer(t, func() error {
+		if revoked.Load() {
+			return errors.New("session revoked")
+		}
+		return nil
+	})
+	srv.CheckInterval = 20 * time.Millisecond
+	c := dial(t, url, 2, "bob@example.com")
+
+	c.send(`{"type": "ping", "ref": "a"}`)
+	time.Sleep(3 * srv.CheckInterval)
+	if m := c.read(); m["type"] != "pong" {
+		t.Fatalf("got %v, want pong while the credentials are valid", m)
+	}
+	revoked.Store(true)
+	if code := c.closeCode(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("got close code %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestOriginCheck(t *testing.T) {
+	srv, _, url := startServer(t, nil)
+	srv.AllowedOrigins = []string{"https://app.example.com/"}
+	host := strings.TrimPrefix(url, "ws://")
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true}, // not a browser
+		{"http://" + host, true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://app.example.com.evil.example.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+"/?id=2&user=bob@example.com", header)
+		if tt.ok != (err == nil) {
+			t.Errorf("origin %q: got error %v, want accepted %v", tt.origin, err, tt.ok)
+		}
+		if err != nil && resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: got status %d, want 403", tt.origin, resp.StatusCode)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -2,20 +2,132 @@ package routes
 
 import (
 	"net/http"
+	"task-manager-api/db"
 	"task-manager-api/handlers"
+	"task-manager-api/models"
 	"task-manager-api/utils"
 
 	"github.com/gorilla/mux"
 )
 
 func NewRouter() *mux.Router {
+	utils.AccountStatusCheck = db.CheckAccountStatus
+	utils.APIKeyAuthenticator = db.AuthenticateAPIKey
+	utils.APIKeyStatusCheck = db.CheckAPIKey
+	utils.SessionCheck = db.CheckSession
+	utils.IdempotencyKeyStore = db.IdempotencyStore{}
 
 	r := mux.NewRouter()
 	// r.HandleFunc("/tasks", handlers.HandleTasks).Methods("GET", "POST", "DELETE", "PUT")
-	r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
+	r.Handle("/users", utils.IdempotencyMiddleware(http.HandlerFunc(handlers.CreateUser))).Methods("POST")
+	// login and token refresh responses carry credentials, they are never stored for Idempotency-Key replay.
+	// Other handlers that return secrets mark their response with utils.NoStore
 	r.HandleFunc("/login", handlers.Login).Methods("POST")
-	r.Handle("/tasks", utils.JWTAuthMiddleware(http.HandlerFunc(handlers.HandleTasks))).Methods("GET", "POST", "DELETE", "PUT")
+	r.HandleFunc("/login/2fa", handlers.LoginTwoFactor).Methods("POST")
+	r.HandleFunc("/token/refresh", handlers.RefreshToken).Methods("POST")
+	r.Handle("/logout", utils.JWTAuthMiddleware(http.HandlerFunc(handlers.Logout))).Methods("POST")
+	r.Handle("/password/reset", utils.IdempotencyMiddleware(http.HandlerFunc(handlers.ResetPassword))).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKS).Methods("GET")
+	r.HandleFunc("/auth/oidc/login", handlers.OIDCLogin).Methods("GET")
+	r.HandleFunc("/auth/oidc/callback", handlers.OIDCCallback).Methods("GET")
+	r.Handle("/tasks", withScopes(handlers.HandleTasks, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks", withScopes(handlers.HandleTasks, utils.ScopeTasksWrite)).Methods("POST", "DELETE", "PUT")
+	r.Handle("/tasks/bulk", withScopes(handlers.BulkTasks, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/tasks/quick", withScopes(handlers.QuickAddTask, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/tasks/{id:[0-9]+}", withScopes(handlers.GetTaskByID, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks/{id:[0-9]+}", withScopes(handlers.UpdateTaskByPath, utils.ScopeTasksWrite)).Methods("PUT", "PATCH")
+	r.Handle("/tasks/{id:[0-9]+}", withScopes(handlers.DeleteTaskByPath, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/tasks/{id:[0-9]+}/shares", withScopes(handlers.ListTaskShares, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks/{id:[0-9]+}/shares", withScopes(handlers.ShareTask, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/tasks/{id:[0-9]+}/shares/{email}", withScopes(handlers.RevokeTaskShare, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/tasks/{id:[0-9]+}/assignees", withScopes(handlers.AssignTask, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/tasks/{id:[0-9]+}/assignees/history", withScopes(handlers.GetAssignmentHistory, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks/{id:[0-9]+}/assignees/{user_id:[0-9]+|me}", withScopes(handlers.UnassignTask, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/tasks/{id:[0-9]+}/history", withScopes(handlers.GetTaskHistory, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks/{id:[0-9]+}/revert", withScopes(handlers.RevertTask, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/tasks/{id:[0-9]+}/comments", withScopes(handlers.ListComments, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/tasks/{id:[0-9]+}/comments", withScopes(handlers.AddComment, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/search", withScopes(handlers.Search, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/filters", withScopes(handlers.ListSavedFilters, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/filters", withScopes(handlers.CreateSavedFilter, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/filters/{id:[0-9]+}", withScopes(handlers.GetSavedFilter, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/filters/{id:[0-9]+}", withScopes(handlers.UpdateSavedFilter, utils.ScopeTasksWrite)).Methods("PUT")
+	r.Handle("/filters/{id:[0-9]+}", withScopes(handlers.DeleteSavedFilter, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/filters/{id:[0-9]+}/tasks", withScopes(handlers.GetSavedFilterTasks, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/webhooks", withScopes(handlers.ListWebhooks, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/webhooks", withScopes(handlers.CreateWebhook, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/webhooks/{id:[0-9]+}", withScopes(handlers.GetWebhook, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}", withScopes(handlers.UpdateWebhook, utils.ScopeTasksWrite)).Methods("PUT", "PATCH")
+	r.Handle("/webhooks/{id:[0-9]+}", withScopes(handlers.DeleteWebhook, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries", withScopes(handlers.ListWebhookDeliveries, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}/redeliver",
+		withScopes(handlers.RedeliverWebhook, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/shared-with-me", withScopes(handlers.GetSharedWithMe, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/undo", withScopes(handlers.Undo, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/trash", withScopes(handlers.ListTrash, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/trash/{id:[0-9]+}/restore", withScopes(handlers.RestoreTask, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/trash/{id:[0-9]+}", withScopes(handlers.PurgeTask, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/activity", withScopes(handlers.GetActivityFeed, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/events", withScopes(handlers.StreamEvents, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/ws", withScopes(handlers.ServeWebSocket, utils.ScopeTasksRead)).Methods("GET")
+
+	// workspaces, task routes under /workspaces/{workspace_id} work the same as /tasks with X-Workspace-ID
+	r.Handle("/workspaces", withScopes(handlers.ListWorkspaces, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces", withScopes(handlers.CreateWorkspace, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}", withScopes(handlers.GetWorkspace, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}", withScopes(handlers.DeleteWorkspace, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/tasks", withScopes(handlers.HandleTasks, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/tasks", withScopes(handlers.HandleTasks, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/projects", withScopes(handlers.ListProjects, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/projects", withScopes(handlers.CreateProject, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/members", withScopes(handlers.ListWorkspaceMembers, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/members/{user_id:[0-9]+}", withScopes(handlers.SetWorkspaceMemberRole, utils.ScopeTasksWrite)).Methods("PUT")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/members/{user_id:[0-9]+}", withScopes(handlers.RemoveWorkspaceMember, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/invitations", withScopes(handlers.ListWorkspaceInvitations, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/invitations", withScopes(handlers.CreateWorkspaceInvitation, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/workspaces/{workspace_id:[0-9]+}/invitations/{id:[0-9]+}", withScopes(handlers.RevokeWorkspaceInvitation, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/projects/{project_id:[0-9]+}/shares", withScopes(handlers.ListProjectShares, utils.ScopeTasksRead)).Methods("GET")
+	r.Handle("/projects/{project_id:[0-9]+}/shares", withScopes(handlers.ShareProject, utils.ScopeTasksWrite)).Methods("POST")
+	r.Handle("/projects/{project_id:[0-9]+}/shares/{email}", withScopes(handlers.RevokeProjectShare, utils.ScopeTasksWrite)).Methods("DELETE")
+	r.Handle("/invitations/{token}/accept", withScopes(handlers.AcceptWorkspaceInvitation, utils.ScopeAccount)).Methods("POST")
+
+	// current user account
+	me := r.PathPrefix("/me").Subrouter()
+	me.Use(utils.JWTAuthMiddleware, utils.RequireScope(utils.ScopeAccount), utils.IdempotencyMiddleware)
+	me.HandleFunc("/password", handlers.ChangePassword).Methods("PUT")
+	me.HandleFunc("/api-keys", handlers.CreateAPIKey).Methods("POST")
+	me.HandleFunc("/api-keys", handlers.ListAPIKeys).Methods("GET")
+	me.HandleFunc("/api-keys/{id:[0-9]+}", handlers.RevokeAPIKey).Methods("DELETE")
+	me.HandleFunc("/sessions", handlers.ListSessions).Methods("GET")
+	me.HandleFunc("/sessions", handlers.RevokeOtherSessions).Methods("DELETE")
+	me.HandleFunc("/sessions/{id}", handlers.RevokeSession).Methods("DELETE")
+	me.HandleFunc("/2fa", handlers.TOTPStatus).Methods("GET")
+	me.HandleFunc("/2fa", handlers.DisableTOTP).Methods("DELETE")
+	me.HandleFunc("/2fa/enroll", handlers.EnrollTOTP).Methods("POST")
+	me.HandleFunc("/2fa/confirm", handlers.ConfirmTOTP).Methods("POST")
+	me.HandleFunc("/settings", handlers.GetSettings).Methods("GET")
+	me.HandleFunc("/settings", handlers.UpdateSettings).Methods("PUT", "PATCH")
+
+	// admin API, every route requires the admin role
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(utils.JWTAuthMiddleware, utils.RequireRole(models.RoleAdmin), utils.RequireScope(utils.ScopeAdmin),
+		utils.IdempotencyMiddleware)
+	admin.HandleFunc("/users", handlers.AdminListUsers).Methods("GET")
+	admin.HandleFunc("/users/{email}", handlers.AdminGetUser).Methods("GET")
+	admin.HandleFunc("/users/{email}/role", handlers.AdminSetRole).Methods("PUT")
+	admin.HandleFunc("/users/{email}/disable", handlers.AdminDisableUser).Methods("POST")
+	admin.HandleFunc("/users/{email}/enable", handlers.AdminEnableUser).Methods("POST")
+	admin.HandleFunc("/users/{email}/force-password-reset", handlers.AdminForcePasswordReset).Methods("POST")
+	admin.HandleFunc("/users/{email}/unlock", handlers.AdminUnlockUser).Methods("POST")
+	admin.HandleFunc("/users/{email}/tasks", handlers.AdminGetUserTasks).Methods("GET")
+	admin.HandleFunc("/audit", handlers.AdminGetAuditLog).Methods("GET")
 
 	return r
 
 }
+
+// authenticate the request and require the given scopes before calling the handler, POST requests
+// with an Idempotency-Key are replayed per user
+func withScopes(h http.HandlerFunc, scopes ...string) http.Handler {
+	return utils.JWTAuthMiddleware(utils.RequireScope(scopes...)(utils.IdempotencyMiddleware(h)))
+}
@@ -0,0 +1,155 @@
+// Package search parses the query syntax of GET /search and compiles it to a Postgres tsquery.
+// Snippets are HTML with matches wrapped in <mark>, everything else is escaped.
+//
+// A query is a list of terms that must all match: words, "quoted phrases", prefixes ending in *
+// and terms starting with - that must not match.
+package search
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// upper bounds that keep a single query cheap
+const (
+	maxQueryLength = 500
+	maxTerms       = 32
+)
+
+// Term is one condition of a query
+type Term struct {
+	Words   []string // lower case, more than one word is a phrase
+	Prefix  bool     // the last word matches as a prefix
+	Negated bool
+}
+
+// Query is a parsed search query
+type Query struct {
+	Terms []Term
+}
+
+var ErrEmptyQuery = errors.New("search query has no terms")
+
+// Parse reads a query like `"release notes" deploy* -draft`
+func Parse(raw string) (Query, error) {
+	var q Query
+	if len(raw) > maxQueryLength {
+		return q, fmt.Errorf("search query is longer than %d characters", maxQueryLength)
+	}
+
+	rest := strings.TrimSpace(raw)
+	for rest != "" {
+		var term Term
+		if rest[0] == '-' {
+			term.Negated = true
+			rest = rest[1:]
+		}
+
+		var text string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return q, fmt.Errorf("unterminated phrase in search query")
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+			if strings.HasSuffix(text, "*") {
+				term.Prefix = true
+				text = strings.TrimRight(text, "*")
+			}
+		}
+		rest = strings.TrimSpace(rest)
+
+		// punctuation separates words, "e-mail" is the phrase "e mail"
+		term.Words = words(text)
+		if len(term.Words) == 0 {
+			continue
+		}
+		q.Terms = append(q.Terms, term)
+	}
+
+	if len(q.Terms) > maxTerms {
+		return q, fmt.Errorf("search query has more than %d terms", maxTerms)
+	}
+	positive := false
+	for _, t := range q.Terms {
+		positive = positive || !t.Negated
+	}
+	if !positive {
+		// a query of only exclusions would match nearly everything
+		return q, ErrEmptyQuery
+	}
+	return q, nil
+}
+
+// split text into lower case words of letters and digits
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// TSQuery compiles the query to the input of Postgres to_tsquery. Words only hold letters and
+// digits, so quoting them is enough to keep user input from changing the tsquery structure
+func (q Query) TSQuery() string {
+	parts := make([]string, len(q.Terms))
+	for i, t := range q.Terms {
+		lexemes := make([]string, len(t.Words))
+		for j, w := range t.Words {
+			lexemes[j] = "'" + w + "'"
+		}
+		if t.Prefix {
+			lexemes[len(lexemes)-1] += ":*"
+		}
+		part := strings.Join(lexemes, " <-> ")
+		if t.Negated {
+			part = "!(" + part + ")"
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, " & ")
+}
+
+// markers that ts_headline puts around matches in place of HTML tags, see MarkHeadline. Control
+// characters never show up in task text, SearchTasks strips them before calling ts_headline
+const (
+	HeadlineStart = "\x01"
+	HeadlineStop  = "\x02"
+)
+
+// MarkHeadline turns the output of ts_headline with HeadlineStart and HeadlineStop as selectors
+// into HTML: the text is escaped and the markers become <mark> tags. Unbalanced markers are dropped
+func MarkHeadline(headline string) string {
+	var b strings.Builder
+	open := false
+	rest := headline
+	for rest != "" {
+		i := strings.IndexAny(rest, HeadlineStart+HeadlineStop)
+		if i < 0 {
+			b.WriteString(html.EscapeString(rest))
+			break
+		}
+		b.WriteString(html.EscapeString(rest[:i]))
+		switch {
+		case rest[i:i+1] == HeadlineStart && !open:
+			b.WriteString("<mark>")
+			open = true
+		case rest[i:i+1] == HeadlineStop && open:
+			b.WriteString("</mark>")
+			open = false
+		}
+		rest = rest[i+1:]
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	return b.String()
+}
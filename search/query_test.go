@@ -0,0 +1,100 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw   string
+		terms []Term
+		err   bool
+	}{
+		{raw: "deploy", terms: []Term{{Words: []string{"deploy"}}}},
+		{raw: "  Deploy   Staging ", terms: []Term{{Words: []string{"deploy"}}, {Words: []string{"staging"}}}},
+		{raw: `"release notes" deploy* -draft`, terms: []Term{
+			{Words: []string{"release", "notes"}},
+			{Words: []string{"deploy"}, Prefix: true},
+			{Words: []string{"draft"}, Negated: true},
+		}},
+		{raw: "e-mail", terms: []Term{{Words: []string{"e", "mail"}}}},
+		{raw: `-"old stuff" new`, terms: []Term{
+			{Words: []string{"old", "stuff"}, Negated: true},
+			{Words: []string{"new"}},
+		}},
+		{raw: "deploy ** !!", terms: []Term{{Words: []string{"deploy"}}}},
+		{raw: `"unterminated phrase`, err: true},
+		{raw: strings.Repeat("a", maxQueryLength+1), err: true},
+		{raw: strings.Repeat("a ", maxTerms+1), err: true},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Parse(%.40q) = %+v, want an error", tt.raw, q.Terms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Terms, tt.terms) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.raw, q.Terms, tt.terms)
+		}
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	for _, raw := range []string{"", "   ", "-draft", "-a -b", `""`, "*"} {
+		if _, err := Parse(raw); !errors.Is(err, ErrEmptyQuery) {
+			t.Errorf("Parse(%q): got %v, want ErrEmptyQuery", raw, err)
+		}
+	}
+}
+
+func TestTSQuery(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"deploy", "'deploy'"},
+		{"deploy staging", "'deploy' & 'staging'"},
+		{`"release notes" deploy* -draft`, "'release' <-> 'notes' & 'deploy':* & !('draft')"},
+		// * inside a phrase is punctuation, not a prefix
+		{`"release note*"`, "'release' <-> 'note'"},
+		// quotes and operators are not letters, they can not reach the tsquery
+		{`it's | !x & (y)`, "'it' <-> 's' & 'x' & 'y'"},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.raw)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.raw, err)
+		}
+		if got := q.TSQuery(); got != tt.want {
+			t.Errorf("TSQuery(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestMarkHeadline(t *testing.T) {
+	tests := []struct {
+		headline string
+		want     string
+	}{
+		{"plain text", "plain text"},
+		{HeadlineStart + "Deploy" + HeadlineStop + " to staging", "<mark>Deploy</mark> to staging"},
+		{"<b>" + HeadlineStart + "bold" + HeadlineStop + "</b> & co", "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; &amp; co"},
+		// unbalanced markers never leave a tag open
+		{HeadlineStart + "a" + HeadlineStart + "b", "<mark>ab</mark>"},
+		{HeadlineStop + "a", "a"},
+	}
+	for _, tt := range tests {
+		if got := MarkHeadline(tt.headline); got != tt.want {
+			t.Errorf("MarkHeadline(%q) = %q, want %q", tt.headline, got, tt.want)
+		}
+	}
+}
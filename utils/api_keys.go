@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// API keys look like tmk_<8 hex prefix>_<64 hex secret>, the "tmk_<prefix>" part is stored
+// in clear so users can recognise their keys, the full key is only stored as a hash
+const APIKeyPrefix = "tmk_"
+
+// APIKeyAuthenticator resolves a raw API key to the claims of its owner, the client IP is
+// used for last-used tracking. Set by routes.NewRouter
+var APIKeyAuthenticator func(rawKey, clientIP string) (*CustomClaims, error)
+
+// APIKeyStatusCheck returns an error when the API key with the ID was revoked or has expired, see
+// CheckCredentials. Set by routes.NewRouter
+var APIKeyStatusCheck func(keyID int) error
+
+// check if a credential looks like one of our API keys rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// generate a new API key, returns the full key and its visible prefix
+func GenerateAPIKey() (string, string, error) {
+	prefix, err := GenerateRandomToken(4)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	visible := APIKeyPrefix + prefix
+	return visible + "_" + secret, visible, nil
+}
+
+// split a raw API key into its visible prefix, returns an error for malformed keys
+func APIKeyVisiblePrefix(rawKey string) (string, error) {
+	if !IsAPIKey(rawKey) {
+		return "", fmt.Errorf("malformed API key")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rawKey, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 8 || len(parts[1]) != 64 {
+		return "", fmt.Errorf("malformed API key")
+	}
+	return APIKeyPrefix + parts[0], nil
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	revoked := errors.New("revoked")
+	oldSession, oldKey, oldAccount := SessionCheck, APIKeyStatusCheck, AccountStatusCheck
+	t.Cleanup(func() { SessionCheck, APIKeyStatusCheck, AccountStatusCheck = oldSession, oldKey, oldAccount })
+
+	var sessionErr, keyErr, accountErr error
+	SessionCheck = func(string, string) error { return sessionErr }
+	APIKeyStatusCheck = func(int) error { return keyErr }
+	AccountStatusCheck = func(string) (string, error) { return "user", accountErr }
+
+	future := time.Now().Add(time.Hour).Unix()
+	session := &CustomClaims{Email: "a@example.com", Sid: "s1", StandardClaims: jwt.StandardClaims{ExpiresAt: future}}
+	apiKey := &CustomClaims{Email: "a@example.com", APIKeyID: 3}
+	expired := &CustomClaims{Email: "a@example.com", StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Second).Unix()}}
+
+	tests := []struct {
+		name                           string
+		claims                         *CustomClaims
+		sessionErr, keyErr, accountErr error
+		valid                          bool
+	}{
+		{name: "valid session", claims: session, valid: true},
+		{name: "valid API key", claims: apiKey, valid: true},
+		{name: "expired token", claims: expired},
+		{name: "revoked session", claims: session, sessionErr: revoked},
+		{name: "revoked API key", claims: apiKey, keyErr: revoked},
+		{name: "disabled account", claims: session, accountErr: revoked},
+		// a session token is not affected by the API key check and the other way round
+		{name: "session ignores key check", claims: session, keyErr: revoked, valid: true},
+		{name: "API key ignores session check", claims: apiKey, sessionErr: revoked, valid: true},
+	}
+	for _, tt := range tests {
+		sessionErr, keyErr, accountErr = tt.sessionErr, tt.keyErr, tt.accountErr
+		if err := CheckCredentials(tt.claims); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
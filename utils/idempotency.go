@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IdempotencyRecord is the stored state of one Idempotency-Key. A record that is not Completed
+// belongs to a request that is still running
+type IdempotencyRecord struct {
+	Fingerprint string
+	Completed   bool
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore persists idempotency keys, see db.IdempotencyStore
+type IdempotencyStore interface {
+	// claim key for a request with the given fingerprint until now+ttl. Returns true when the key was
+	// free (or expired) and is now reserved, otherwise the existing record
+	Reserve(key, fingerprint string, now time.Time, ttl time.Duration) (IdempotencyRecord, bool, error)
+	// store the response of a reserved key
+	Complete(key string, rec IdempotencyRecord) error
+	// forget a reserved key so the request can be retried
+	Release(key string) error
+}
+
+// IdempotencyKeyStore enables the Idempotency-Key header when set. Set by routes.NewRouter
+var IdempotencyKeyStore IdempotencyStore
+
+// IdempotencyWindow is how long responses are kept for replay
+var IdempotencyWindow = 24 * time.Hour
+
+// longest Idempotency-Key accepted, enough for a UUID or similar
+const maxIdempotencyKeyLength = 255
+
+// response headers that are stored and replayed with the body
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// body stored in place of a response marked with NoStore
+const noStoreReplay = "The response to this Idempotency-Key held credentials and is not replayed, list the resource instead\n"
+
+// NoStore marks a response that carries secrets (API keys, signing secrets, recovery codes...):
+// clients and proxies must not cache it and IdempotencyMiddleware does not keep its body. Call it
+// before writing the response
+func NoStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// IdempotencyMiddleware makes POST requests with an Idempotency-Key header safe to retry: the first
+// response for a key is stored and replayed for repeats of the same request, reusing a key for a
+// different request is rejected with 409 and so is a repeat that arrives while the first request is
+// still running. Server errors are not stored so those requests can be retried. Responses marked
+// with NoStore are not stored either, repeats get 409 so the request still runs only once.
+// Keys are scoped to the user when it runs after JWTAuthMiddleware
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" || IdempotencyKeyStore == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := "anonymous"
+		if claims, ok := r.Context().Value("claims").(*CustomClaims); ok {
+			scope = "user:" + claims.Email
+		}
+		storeKey := HashToken(scope + "\n" + key)
+		fingerprint := HashToken(r.Method + " " + r.URL.RequestURI() + "\n" + string(body))
+
+		rec, reserved, err := IdempotencyKeyStore.Reserve(storeKey, fingerprint, time.Now(), IdempotencyWindow)
+		if err != nil {
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusConflict)
+			case !rec.Completed:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				for name, values := range rec.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				w.Write(rec.Body)
+			}
+			return
+		}
+
+		// the key stays reserved if the handler panics, release it so the client can retry
+		stored := false
+		defer func() {
+			if !stored {
+				if err := IdempotencyKeyStore.Release(storeKey); err != nil {
+					log.Printf("Error releasing idempotency key: %s", err)
+				}
+			}
+		}()
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if rw.status >= 500 {
+			return
+		}
+
+		response := IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Completed:   true,
+			Status:      rw.status,
+			Header:      http.Header{},
+			Body:        rw.body.Bytes(),
+		}
+		if strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+			response.Status = http.StatusConflict
+			response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			response.Body = []byte(noStoreReplay)
+		} else {
+			for _, name := range replayedHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					response.Header[name] = values
+				}
+			}
+		}
+		err = IdempotencyKeyStore.Complete(storeKey, response)
+		if err != nil {
+			log.Printf("Error storing idempotent response: %s", err)
+			return
+		}
+		stored = true
+	})
+}
+
+// recordingWriter passes the response through and keeps a copy of status and body
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryIdempotencyStore keeps records in a map, enough to drive the middleware
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+func (s *memoryIdempotencyStore) Reserve(key, fingerprint string, now time.Time, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok {
+		return rec, false, nil
+	}
+	s.records[key] = IdempotencyRecord{Fingerprint: fingerprint}
+	return IdempotencyRecord{}, true, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(key string, rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = rec
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func useMemoryIdempotencyStore(t *testing.T) *memoryIdempotencyStore {
+	store := &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}}
+	old := IdempotencyKeyStore
+	IdempotencyKeyStore = store
+	t.Cleanup(func() { IdempotencyKeyStore = old })
+	return store
+}
+
+func postWithKey(h http.Handler, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(`{"name": "a"}`))
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyMiddlewareReplays(t *testing.T) {
+	useMemoryIdempotencyStore(t)
+	calls := 0
+	h := IdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 1}`))
+	}))
+
+	first := postWithKey(h, "k1")
+	second := postWithKey(h, "k1")
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if second.Code != http.StatusCreated || !bytes.Equal(second.Body.Bytes(), first.Body.Bytes()) {
+		t.Fatalf("replay: got %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+}
+
+func TestIdempotencyMiddlewareDoesNotStoreSecrets(t *testing.T) {
+	store := useMemoryIdempotencyStore(t)
+	calls := 0
+	h := IdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		NoStore(w)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key": "tm_secret"}`))
+	}))
+
+	first := postWithKey(h, "k1")
+	if first.Code != http.StatusCreated || !strings.Contains(first.Body.String(), "tm_secret") {
+		t.Fatalf("first request: got %d %q", first.Code, first.Body)
+	}
+	if first.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", first.Header().Get("Cache-Control"))
+	}
+	for _, rec := range store.records {
+		if bytes.Contains(rec.Body, []byte("tm_secret")) {
+			t.Fatal("the secret was stored for replay")
+		}
+	}
+
+	second := postWithKey(h, "k1")
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if second.Code != http.StatusConflict || strings.Contains(second.Body.String(), "tm_secret") {
+		t.Fatalf("repeat: got %d %q, want 409 without the secret", second.Code, second.Body)
+	}
+}
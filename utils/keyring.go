@@ -0,0 +1,465 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256" // legacy shared secret, cannot be published in the JWKS
+
+	defaultKeyRotation = 7 * 24 * time.Hour
+
+	// how often the keys directory is read again for keys other instances created. Tokens with an
+	// unknown kid trigger a read too, but not more often than keyReloadMinInterval
+	keyReloadInterval    = time.Minute
+	keyReloadMinInterval = 5 * time.Second
+)
+
+// SigningKey is one key of the keyring. Only the newest key signs, older keys keep verifying
+// until RetireAt, which is set on rotation to cover the lifetime of the tokens it signed
+type SigningKey struct {
+	ID        string
+	Alg       string
+	CreatedAt time.Time
+	RetireAt  time.Time // zero while the key is the active one
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type Keyring struct {
+	mu          sync.RWMutex
+	alg         string
+	keys        []*SigningKey // oldest first, the last one is active
+	dir         string        // where keys are persisted, empty for in-memory keys
+	maxTokenTTL time.Duration
+	lastReload  time.Time
+	stop        chan struct{}
+}
+
+// the keyring used to sign and verify all tokens of the API, set by InitKeyring
+var keyring *Keyring
+
+// InitKeyring sets up token signing from the environment, must run after the .env file is loaded.
+//
+//	JWT_ALG           RS256 (default), EdDSA or HS256 (legacy, uses SECRET_KEY)
+//	JWT_KEYS_DIR      directory of PKCS#8 PEM private keys named <kid>.pem, new keys are written there.
+//	                  Instances that share it must share the directory too, otherwise keys are in memory.
+//	                  It is read again every minute and when a token names a key that is not loaded
+//	JWT_KEY_ROTATION  how often a new signing key is generated, e.g. 168h, 0 disables rotation
+func InitKeyring() error {
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = AlgRS256
+	}
+	rotation := defaultKeyRotation
+	if v := os.Getenv("JWT_KEY_ROTATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid JWT_KEY_ROTATION: %w", err)
+		}
+		rotation = d
+	}
+
+	kr, err := NewKeyring(alg, os.Getenv("JWT_KEYS_DIR"), os.Getenv("SECRET_KEY"))
+	if err != nil {
+		return err
+	}
+	if alg != AlgHS256 && rotation > 0 {
+		kr.StartRotation(rotation)
+	}
+	if alg != AlgHS256 && kr.dir != "" {
+		kr.StartReload(keyReloadInterval)
+	}
+	keyring = kr
+	return nil
+}
+
+// the keyring in use, nil before InitKeyring
+func DefaultKeyring() *Keyring {
+	return keyring
+}
+
+// create a keyring for the algorithm. Asymmetric keys are loaded from dir or generated,
+// HS256 uses the shared secret. When a secret is given with an asymmetric algorithm, tokens signed
+// with the old HS256 secret keep verifying until they expire so switching does not log everyone out
+func NewKeyring(alg, dir, secret string) (*Keyring, error) {
+	kr := &Keyring{alg: alg, dir: dir, maxTokenTTL: RefreshTokenTTL, stop: make(chan struct{})}
+	switch alg {
+	case AlgHS256:
+		if secret == "" {
+			return nil, errors.New("SECRET_KEY is required for HS256 tokens")
+		}
+		kr.keys = []*SigningKey{{ID: "", Alg: AlgHS256, CreatedAt: time.Now(), signKey: []byte(secret), verifyKey: []byte(secret)}}
+		return kr, nil
+	case AlgRS256, AlgEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q", alg)
+	}
+
+	if dir != "" {
+		if err := kr.loadDir(); err != nil {
+			return nil, err
+		}
+		kr.lastReload = time.Now()
+		if len(kr.keys) > 0 {
+			log.Printf("Loaded %d signing keys from %s, active key %s", len(kr.keys), kr.dir, kr.active().ID)
+		}
+	}
+	if len(kr.keys) == 0 || kr.active().Alg != alg {
+		if _, err := kr.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	if secret != "" {
+		legacy := &SigningKey{ID: "", Alg: AlgHS256, CreatedAt: time.Now(), RetireAt: time.Now().Add(AccessTokenTTL), verifyKey: []byte(secret)}
+		kr.keys = append([]*SigningKey{legacy}, kr.keys...)
+	}
+	return kr, nil
+}
+
+func generateKey(alg string) (interface{}, interface{}, error) {
+	switch alg {
+	case AlgRS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &priv.PublicKey, nil
+	case AlgEdDSA:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, pub, nil
+	}
+	return nil, nil, fmt.Errorf("cannot generate keys for %s", alg)
+}
+
+// load all private keys of the configured algorithm from the keys directory, sorted by creation time
+func (kr *Keyring) loadDir() error {
+	files, err := filepath.Glob(filepath.Join(kr.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM data", file)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		key := &SigningKey{ID: strings.TrimSuffix(filepath.Base(file), ".pem"), CreatedAt: info.ModTime()}
+		switch priv := parsed.(type) {
+		case *rsa.PrivateKey:
+			key.Alg, key.signKey, key.verifyKey = AlgRS256, priv, &priv.PublicKey
+		case ed25519.PrivateKey:
+			key.Alg, key.signKey, key.verifyKey = AlgEdDSA, priv, priv.Public()
+		default:
+			return fmt.Errorf("%s: unsupported key type", file)
+		}
+		kr.keys = append(kr.keys, key)
+	}
+	sort.Slice(kr.keys, func(i, j int) bool { return kr.keys[i].CreatedAt.Before(kr.keys[j].CreatedAt) })
+
+	// only the newest key matching the configured algorithm signs, every other key just verifies
+	var active *SigningKey
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].Alg == kr.alg {
+			active = kr.keys[i]
+			break
+		}
+	}
+	if active == nil {
+		// new key of the right algorithm will be generated, the loaded ones retire
+		for _, k := range kr.keys {
+			k.RetireAt = time.Now().Add(kr.maxTokenTTL)
+		}
+		return nil
+	}
+	// an old key stopped signing when the next one was created, its tokens live for maxTokenTTL after that
+	others := []*SigningKey{}
+	for i, k := range kr.keys {
+		if k != active {
+			stoppedAt := time.Now()
+			if i+1 < len(kr.keys) {
+				stoppedAt = kr.keys[i+1].CreatedAt
+			}
+			k.RetireAt = stoppedAt.Add(kr.maxTokenTTL)
+			if time.Now().Before(k.RetireAt) {
+				others = append(others, k)
+			}
+		}
+	}
+	kr.keys = append(others, active)
+	return nil
+}
+
+// read the keys directory again to pick up keys another instance sharing it generated, at most
+// once per keyReloadMinInterval so tokens with made up key IDs cannot make every request hit the disk.
+// Returns whether the keys changed
+func (kr *Keyring) reload() bool {
+	kr.mu.RLock()
+	recent := time.Since(kr.lastReload) < keyReloadMinInterval
+	kr.mu.RUnlock()
+	if recent {
+		return false
+	}
+	return kr.reloadNow()
+}
+
+// read the keys directory again regardless of when it was last read
+func (kr *Keyring) reloadNow() bool {
+	kr.mu.Lock()
+	if kr.dir == "" || kr.alg == AlgHS256 {
+		kr.mu.Unlock()
+		return false
+	}
+	kr.lastReload = time.Now()
+	kr.mu.Unlock()
+
+	fresh := &Keyring{alg: kr.alg, dir: kr.dir, maxTokenTTL: kr.maxTokenTTL}
+	if err := fresh.loadDir(); err != nil {
+		log.Printf("Error reloading signing keys: %s", err)
+		return false
+	}
+	// without a key of the configured algorithm there is nothing to switch to
+	if len(fresh.keys) == 0 || fresh.active().Alg != kr.alg {
+		return false
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	// the legacy HS256 secret only lives in memory, it is kept
+	keys := []*SigningKey{}
+	loaded := map[string]bool{}
+	for _, k := range kr.keys {
+		if k.Alg == AlgHS256 {
+			keys = append(keys, k)
+		} else {
+			loaded[k.ID] = true
+		}
+	}
+	changed := len(loaded) != len(fresh.keys)
+	for _, k := range fresh.keys {
+		if !loaded[k.ID] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	kr.keys = append(keys, fresh.keys...)
+	log.Printf("Reloaded %d signing keys from %s, active key %s", len(kr.keys), kr.dir, kr.keys[len(kr.keys)-1].ID)
+	return true
+}
+
+func (kr *Keyring) saveKey(key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.signKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(kr.dir, key.ID+".pem"), data, 0600)
+}
+
+// Rotate generates a new active key. The previous keys keep verifying until the tokens they signed
+// have expired, after that they are dropped
+func (kr *Keyring) Rotate() (*SigningKey, error) {
+	priv, pub, err := generateKey(kr.alg)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id, err := GenerateRandomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: now.UTC().Format("20060102") + "-" + id, Alg: kr.alg, CreatedAt: now, signKey: priv, verifyKey: pub}
+	if kr.dir != "" {
+		if err = kr.saveKey(key); err != nil {
+			return nil, fmt.Errorf("saving signing key: %w", err)
+		}
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kept := []*SigningKey{}
+	for _, k := range kr.keys {
+		if k.RetireAt.IsZero() {
+			k.RetireAt = now.Add(kr.maxTokenTTL)
+		}
+		if now.Before(k.RetireAt) {
+			kept = append(kept, k)
+		} else if kr.dir != "" && k.signKey != nil {
+			os.Remove(filepath.Join(kr.dir, k.ID+".pem"))
+		}
+	}
+	kr.keys = append(kept, key)
+	log.Printf("New %s signing key %s is active", key.Alg, key.ID)
+	return key, nil
+}
+
+// read the keys directory at the given interval until Stop is called
+func (kr *Keyring) StartReload(every time.Duration) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kr.reload()
+			case <-kr.stop:
+				return
+			}
+		}
+	}()
+}
+
+// rotate the active key at the given interval until Stop is called. The interval counts from the
+// newest key, also when another instance sharing the keys directory created it
+func (kr *Keyring) StartRotation(every time.Duration) {
+	go func() {
+		// a key loaded from disk may already be due
+		wait := every - time.Since(kr.active().CreatedAt)
+		for {
+			select {
+			case <-time.After(wait):
+				next, err := kr.rotateIfDue(every)
+				if err != nil {
+					log.Printf("Error rotating signing key: %s", err)
+					next = keyReloadInterval
+				}
+				wait = next
+			case <-kr.stop:
+				return
+			}
+		}
+	}()
+}
+
+// rotate when the active key is at least every old. The keys directory is read first so a newer key
+// from another instance counts and instances sharing it do not each add a key per period.
+// Returns the time until the active key is due
+func (kr *Keyring) rotateIfDue(every time.Duration) (time.Duration, error) {
+	if time.Since(kr.active().CreatedAt) >= every {
+		kr.reloadNow()
+	}
+	if time.Since(kr.active().CreatedAt) >= every {
+		if _, err := kr.Rotate(); err != nil {
+			return 0, err
+		}
+	}
+	return every - time.Since(kr.active().CreatedAt), nil
+}
+
+func (kr *Keyring) Stop() {
+	if kr.stop != nil {
+		close(kr.stop)
+	}
+}
+
+func (kr *Keyring) active() *SigningKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[len(kr.keys)-1]
+}
+
+// sign the claims with the active key, the key ID is put in the kid header
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key := kr.active()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc for jwt.Parse: picks the key by kid and only accepts the algorithm that key was made for.
+// An unknown kid may be a key another instance just rotated to, the keys directory is read again
+func (kr *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := kr.verifyKey(kid, token.Method.Alg())
+	if err == errUnknownKey && kr.reload() {
+		key, err = kr.verifyKey(kid, token.Method.Alg())
+	}
+	if err == errUnknownKey {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, err
+}
+
+var errUnknownKey = errors.New("unknown signing key")
+
+func (kr *Keyring) verifyKey(kid, alg string) (interface{}, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	now := time.Now()
+	for _, k := range kr.keys {
+		if k.ID != kid || (!k.RetireAt.IsZero() && now.After(k.RetireAt)) {
+			continue
+		}
+		if alg != k.Alg {
+			return nil, fmt.Errorf("unexpected signing algorithm %s", alg)
+		}
+		return k.verifyKey, nil
+	}
+	return nil, errUnknownKey
+}
+
+// JWKS returns the public keys that currently verify tokens, in JSON Web Key Set format
+func (kr *Keyring) JWKS() map[string]interface{} {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := []map[string]string{}
+	now := time.Now()
+	for _, k := range kr.keys {
+		if !k.RetireAt.IsZero() && now.After(k.RetireAt) {
+			continue
+		}
+		switch pub := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "use": "sig", "alg": AlgRS256, "kid": k.ID,
+				"n": base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "OKP", "crv": "Ed25519", "use": "sig", "alg": AlgEdDSA, "kid": k.ID,
+				"x": base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
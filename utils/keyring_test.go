@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func newTestKeyring(t *testing.T, alg, dir, secret string) *Keyring {
+	t.Helper()
+	kr, err := NewKeyring(alg, dir, secret)
+	if err != nil {
+		t.Fatalf("NewKeyring(%s): %s", alg, err)
+	}
+	t.Cleanup(kr.Stop)
+	return kr
+}
+
+func sign(t *testing.T, kr *Keyring) string {
+	t.Helper()
+	token, err := kr.Sign(jwt.StandardClaims{Subject: "a@example.com", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func verify(kr *Keyring, token string) error {
+	_, err := jwt.Parse(token, kr.Keyfunc)
+	return err
+}
+
+func kidOf(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func pemFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestKeyringKidLookup(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgEdDSA} {
+		kr := newTestKeyring(t, alg, "", "")
+		old := sign(t, kr)
+		if kidOf(t, old) != kr.active().ID {
+			t.Fatalf("%s: token kid %q, want the active key %q", alg, kidOf(t, old), kr.active().ID)
+		}
+		if _, err := kr.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		current := sign(t, kr)
+		if kidOf(t, current) == kidOf(t, old) {
+			t.Fatalf("%s: rotation kept the key ID %q", alg, kidOf(t, old))
+		}
+		// tokens of the previous key keep verifying next to the new ones
+		for _, token := range []string{old, current} {
+			if err := verify(kr, token); err != nil {
+				t.Errorf("%s: %s", alg, err)
+			}
+		}
+		// a token from another keyring names a key this one does not have
+		if err := verify(kr, sign(t, newTestKeyring(t, alg, "", ""))); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+			t.Errorf("%s: foreign key: got %v, want unknown signing key", alg, err)
+		}
+	}
+}
+
+func TestKeyringAlgorithmPerKid(t *testing.T) {
+	rsa := newTestKeyring(t, AlgRS256, "", "legacy-secret")
+	ed := newTestKeyring(t, AlgEdDSA, "", "")
+
+	// an EdDSA token that claims the kid of the RS256 key
+	token := jwt.NewWithClaims(SigningMethodEdDSA, jwt.StandardClaims{Subject: "a@example.com"})
+	token.Header["kid"] = rsa.active().ID
+	forged, err := token.SignedString(ed.active().signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(rsa, forged); err == nil || !strings.Contains(err.Error(), "unexpected signing algorithm") {
+		t.Errorf("EdDSA token with an RS256 kid: got %v", err)
+	}
+
+	// HMAC signed with the RSA key's kid, keyed with anything, is never accepted
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "a@example.com"})
+	token.Header["kid"] = rsa.active().ID
+	forged, err = token.SignedString([]byte("legacy-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(rsa, forged); err == nil {
+		t.Error("HS256 token with an RS256 kid was accepted")
+	}
+
+	// the legacy secret has no kid and only verifies HS256
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "a@example.com"}).SignedString([]byte("legacy-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(rsa, legacy); err != nil {
+		t.Errorf("legacy HS256 token: %s", err)
+	}
+	token = jwt.NewWithClaims(SigningMethodEdDSA, jwt.StandardClaims{Subject: "a@example.com"})
+	noKid, err := token.SignedString(ed.active().signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(rsa, noKid); err == nil || !strings.Contains(err.Error(), "unexpected signing algorithm") {
+		t.Errorf("EdDSA token without kid: got %v", err)
+	}
+}
+
+func TestKeyringRetirement(t *testing.T) {
+	kr := newTestKeyring(t, AlgEdDSA, t.TempDir(), "")
+	kr.maxTokenTTL = 100 * time.Millisecond
+	old := sign(t, kr)
+	oldID := kr.active().ID
+	if _, err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old key verifies and is published until the tokens it signed have expired
+	if err := verify(kr, old); err != nil {
+		t.Fatalf("before retirement: %s", err)
+	}
+	if n := len(kr.JWKS()["keys"].([]map[string]string)); n != 2 {
+		t.Fatalf("JWKS has %d keys before retirement, want 2", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := verify(kr, old); err == nil {
+		t.Fatal("the retired key still verifies")
+	}
+	keys := kr.JWKS()["keys"].([]map[string]string)
+	if len(keys) != 1 || keys[0]["kid"] == oldID {
+		t.Fatalf("JWKS after retirement: %v", keys)
+	}
+
+	// the next rotation drops the retired key and deletes its file
+	if _, err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(kr.dir, oldID+".pem")); !os.IsNotExist(err) {
+		t.Errorf("retired key file: %v, want it removed", err)
+	}
+	if n := len(kr.keys); n != 2 {
+		t.Errorf("keyring holds %d keys, want 2", n)
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestKeyring(t, AlgEdDSA, dir, "")
+	second := newTestKeyring(t, AlgEdDSA, dir, "")
+	if first.active().ID != second.active().ID {
+		t.Fatalf("the second instance did not load the shared key")
+	}
+
+	// a token signed with a key the other instance just rotated to is verified after a reload
+	if _, err := first.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	token := sign(t, first)
+	second.lastReload = time.Time{}
+	if err := verify(second, token); err != nil {
+		t.Fatalf("token of the other instance's new key: %s", err)
+	}
+	if second.active().ID != first.active().ID {
+		t.Errorf("after the reload the active key is %s, want %s", second.active().ID, first.active().ID)
+	}
+
+	// unknown key IDs do not read the directory again within keyReloadMinInterval
+	if _, err := first.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(second, sign(t, first)); err == nil {
+		t.Error("reloaded again right after a reload")
+	}
+}
+
+func TestKeyringRotationCountsNewerKeys(t *testing.T) {
+	dir := t.TempDir()
+	newTestKeyring(t, AlgEdDSA, dir, "")
+	// the shared key is two hours old when both instances start
+	old := time.Now().Add(-2 * time.Hour)
+	for _, file := range pemFiles(t, dir) {
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := newTestKeyring(t, AlgEdDSA, dir, "")
+	second := newTestKeyring(t, AlgEdDSA, dir, "")
+
+	wait, err := first.rotateIfDue(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("after rotating the next rotation is due in %s, want an hour", wait)
+	}
+	// the second instance picks up the key the first one created instead of adding another
+	wait, err = second.rotateIfDue(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.active().ID != first.active().ID || wait < 59*time.Minute {
+		t.Errorf("second instance: active key %s due in %s, want %s due in an hour", second.active().ID, wait, first.active().ID)
+	}
+	if files := pemFiles(t, dir); len(files) != 2 {
+		t.Errorf("keys directory holds %d keys, want 2", len(files))
+	}
+}
@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AttemptRecord is the failed login state of one key (an IP address or an account)
+type AttemptRecord struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// AttemptStore persists failed login counters, see MemoryAttemptStore and db.LoginAttemptStore
+type AttemptStore interface {
+	Get(key string) (AttemptRecord, error)
+	// count a failure, starting over from 1 when the previous failure is older than window
+	RecordFailure(key string, now time.Time, window time.Duration) (AttemptRecord, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// LoginLimiter slows down password guessing: after a few free attempts every failure doubles the
+// wait before the next attempt, and too many failures lock the account (or IP) for a while
+type LoginLimiter struct {
+	Store AttemptStore
+
+	FreeAttempts       int           // failures before backoff starts
+	BaseDelay          time.Duration // first backoff delay, doubled for every further failure
+	MaxDelay           time.Duration
+	AccountMaxFailures int // failures that lock an account
+	IPMaxFailures      int // failures that lock an IP address, higher since IPs can be shared
+	LockoutDuration    time.Duration
+	Window             time.Duration // failures older than this are forgotten
+
+	// called when a key gets locked, e.g. to write an audit entry
+	OnLockout func(key string, until time.Time)
+	Now       func() time.Time
+}
+
+// LimitError is returned when a login attempt is not allowed yet
+type LimitError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LimitError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed login attempts, locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func NewLoginLimiter(store AttemptStore) *LoginLimiter {
+	return &LoginLimiter{
+		Store:              store,
+		FreeAttempts:       3,
+		BaseDelay:          time.Second,
+		MaxDelay:           5 * time.Minute,
+		AccountMaxFailures: 10,
+		IPMaxFailures:      100,
+		LockoutDuration:    15 * time.Minute,
+		Window:             time.Hour,
+		Now:                time.Now,
+	}
+}
+
+// override the defaults with LOGIN_MAX_FAILURES, LOGIN_IP_MAX_FAILURES and LOGIN_LOCKOUT_DURATION
+func (l *LoginLimiter) ConfigureFromEnv() error {
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid LOGIN_MAX_FAILURES: %q", v)
+		}
+		l.AccountMaxFailures = n
+	}
+	if v := os.Getenv("LOGIN_IP_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid LOGIN_IP_MAX_FAILURES: %q", v)
+		}
+		l.IPMaxFailures = n
+	}
+	if v := os.Getenv("LOGIN_LOCKOUT_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid LOGIN_LOCKOUT_DURATION: %q", v)
+		}
+		l.LockoutDuration = d
+	}
+	return nil
+}
+
+func ipKey(ip string) string           { return "ip:" + ip }
+func accountKey(account string) string { return "account:" + account }
+
+// backoff delay after n failures
+func (l *LoginLimiter) delay(failures int) time.Duration {
+	n := failures - l.FreeAttempts
+	if n <= 0 {
+		return 0
+	}
+	d := l.BaseDelay
+	for i := 1; i < n && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+func (l *LoginLimiter) checkKey(key string, now time.Time) error {
+	rec, err := l.Store.Get(key)
+	if err != nil {
+		return err
+	}
+	if now.Before(rec.LockedUntil) {
+		return &LimitError{RetryAfter: rec.LockedUntil.Sub(now), Locked: true}
+	}
+	if rec.Failures == 0 || now.Sub(rec.LastFailure) > l.Window {
+		return nil
+	}
+	if next := rec.LastFailure.Add(l.delay(rec.Failures)); now.Before(next) {
+		return &LimitError{RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
+
+// Allow returns a *LimitError when the IP or the account has to wait before trying again
+func (l *LoginLimiter) Allow(ip, account string) error {
+	now := l.Now()
+	if err := l.checkKey(ipKey(ip), now); err != nil {
+		return err
+	}
+	return l.checkKey(accountKey(account), now)
+}
+
+func (l *LoginLimiter) failKey(key string, max int, now time.Time) error {
+	rec, err := l.Store.RecordFailure(key, now, l.Window)
+	if err != nil {
+		return err
+	}
+	if rec.Failures >= max && !now.Before(rec.LockedUntil) {
+		until := now.Add(l.LockoutDuration)
+		if err = l.Store.Lock(key, until); err != nil {
+			return err
+		}
+		if l.OnLockout != nil {
+			l.OnLockout(key, until)
+		}
+	}
+	return nil
+}
+
+// Failure records a failed attempt for both the IP and the account
+func (l *LoginLimiter) Failure(ip, account string) error {
+	now := l.Now()
+	if err := l.failKey(ipKey(ip), l.IPMaxFailures, now); err != nil {
+		return err
+	}
+	return l.failKey(accountKey(account), l.AccountMaxFailures, now)
+}
+
+// Success clears the account counter. The IP counter is left alone so logging in to an own
+// account cannot be used to reset the backoff of an IP guessing other accounts
+func (l *LoginLimiter) Success(account string) error {
+	return l.Store.Reset(accountKey(account))
+}
+
+// Unlock clears the lockout and failures of an account, used by admins
+func (l *LoginLimiter) Unlock(account string) error {
+	return l.Store.Reset(accountKey(account))
+}
+
+// MemoryAttemptStore keeps counters in process memory, suitable for a single instance.
+// Call StartSweep so the map does not grow with every IP that ever failed once
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]AttemptRecord
+	window  time.Duration // longest window RecordFailure was called with
+	stop    chan struct{}
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{records: make(map[string]AttemptRecord), stop: make(chan struct{})}
+}
+
+// drop counters that no longer matter at the given interval until Stop is called
+func (s *MemoryAttemptStore) StartSweep(every time.Duration) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.sweep(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *MemoryAttemptStore) Stop() {
+	close(s.stop)
+}
+
+// drop counters whose failures are outside the window and that are not locked
+func (s *MemoryAttemptStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, r := range s.records {
+		if now.Sub(r.LastFailure) > s.window && now.After(r.LockedUntil) {
+			delete(s.records, k)
+		}
+	}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if window > s.window {
+		s.window = window
+	}
+	rec := s.records[key]
+	if now.Sub(rec.LastFailure) > window {
+		rec.Failures = 0
+	}
+	rec.Failures++
+	rec.LastFailure = now
+	s.records[key] = rec
+	return rec, nil
+}
+
+func (s *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.records[key]
+	rec.LockedUntil = until
+	s.records[key] = rec
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) (*LoginLimiter, *MemoryAttemptStore) {
+	store := NewMemoryAttemptStore()
+	l := NewLoginLimiter(store)
+	l.Now = func() time.Time { return *now }
+	return l, store
+}
+
+func limitError(t *testing.T, err error) *LimitError {
+	t.Helper()
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("got %v, want a *LimitError", err)
+	}
+	return limitErr
+}
+
+func TestLoginBackoff(t *testing.T) {
+	l := NewLoginLimiter(NewMemoryAttemptStore())
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{3, 0}, // the free attempts
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{11, 128 * time.Second},
+		{12, 256 * time.Second},
+		{13, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := l.delay(tt.failures); got != tt.delay {
+			t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.delay)
+		}
+	}
+
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	l, _ = newTestLimiter(&now)
+	for i := 0; i < 5; i++ {
+		if err := l.Allow("10.0.0.1", "a@example.com"); err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+		if err := l.Failure("10.0.0.1", "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(l.delay(i + 1))
+	}
+	// after 5 failures the next attempt waits 2s from the last one
+	now = now.Add(-l.delay(5) + 500*time.Millisecond)
+	if err := limitError(t, l.Allow("10.0.0.1", "a@example.com")); err.Locked || err.RetryAfter != 1500*time.Millisecond {
+		t.Fatalf("got %+v, want a 1.5s wait", err)
+	}
+	// the wait applies to the account from any IP and to the IP for any account
+	if err := l.Allow("10.0.0.2", "a@example.com"); err == nil {
+		t.Error("another IP was not slowed down for the account")
+	}
+	if err := l.Allow("10.0.0.1", "b@example.com"); err == nil {
+		t.Error("another account was not slowed down for the IP")
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if err := l.Allow("10.0.0.1", "a@example.com"); err != nil {
+		t.Fatalf("after the wait: %s", err)
+	}
+
+	// a successful login resets the account but not the IP
+	if err := l.Success("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow("10.0.0.2", "a@example.com"); err != nil {
+		t.Errorf("account after success: %s", err)
+	}
+	if err := l.Failure("10.0.0.1", "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow("10.0.0.3", "a@example.com"); err != nil {
+		t.Errorf("one failure after success is free: %s", err)
+	}
+	if err := l.Allow("10.0.0.1", "c@example.com"); err == nil {
+		t.Error("the IP backoff was reset by a success")
+	}
+
+	// failures older than the window are forgotten
+	now = now.Add(l.Window + time.Second)
+	if err := l.Allow("10.0.0.1", "c@example.com"); err != nil {
+		t.Errorf("after the window: %s", err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		ip       func(i int) string
+		account  func(i int) string
+		failures int
+		locked   string
+	}{
+		{"account", func(i int) string { return "10.0.0." + strconv.Itoa(i) }, func(int) string { return "a@example.com" },
+			10, accountKey("a@example.com")},
+		{"ip", func(int) string { return "10.0.0.1" }, func(i int) string { return strconv.Itoa(i) + "@example.com" },
+			100, ipKey("10.0.0.1")},
+	}
+	for _, tt := range tests {
+		l, _ := newTestLimiter(&now)
+		l.FreeAttempts = 1000 // only the lockout matters here
+		var lockouts []string
+		l.OnLockout = func(key string, until time.Time) {
+			lockouts = append(lockouts, key)
+			if until != now.Add(l.LockoutDuration) {
+				t.Errorf("%s: locked until %s, want %s", tt.name, until, now.Add(l.LockoutDuration))
+			}
+		}
+
+		for i := 0; i < tt.failures-1; i++ {
+			if err := l.Failure(tt.ip(i), tt.account(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Allow(tt.ip(tt.failures), tt.account(tt.failures)); err != nil || len(lockouts) != 0 {
+			t.Fatalf("%s: before the last failure: %v, lockouts %v", tt.name, err, lockouts)
+		}
+		if err := l.Failure(tt.ip(tt.failures), tt.account(tt.failures)); err != nil {
+			t.Fatal(err)
+		}
+		if len(lockouts) != 1 || lockouts[0] != tt.locked {
+			t.Fatalf("%s: lockouts %v, want %s once", tt.name, lockouts, tt.locked)
+		}
+		now = now.Add(time.Minute)
+		if err := limitError(t, l.Allow(tt.ip(0), tt.account(0))); !err.Locked || err.RetryAfter != l.LockoutDuration-time.Minute {
+			t.Errorf("%s: got %+v, want locked for 14m", tt.name, err)
+		}
+		// failures while locked do not extend the lockout
+		if err := l.Failure(tt.ip(0), tt.account(0)); err != nil {
+			t.Fatal(err)
+		}
+		if len(lockouts) != 1 {
+			t.Errorf("%s: locked again while locked: %v", tt.name, lockouts)
+		}
+
+		now = now.Add(l.LockoutDuration)
+		if err := l.Allow(tt.ip(0), tt.account(0)); err != nil {
+			t.Errorf("%s: after the lockout: %s", tt.name, err)
+		}
+	}
+
+	// admins can unlock an account
+	l, _ := newTestLimiter(&now)
+	for i := 0; i < l.AccountMaxFailures; i++ {
+		l.Failure("10.0.0."+strconv.Itoa(i), "a@example.com")
+	}
+	if err := l.Unlock("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow("10.0.1.1", "a@example.com"); err != nil {
+		t.Errorf("after unlock: %s", err)
+	}
+}
+
+func TestMemoryAttemptStoreSweep(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	store := NewMemoryAttemptStore()
+	window := time.Hour
+	store.RecordFailure("old", now.Add(-2*window), window)
+	store.RecordFailure("recent", now.Add(-window/2), window)
+	store.RecordFailure("locked", now.Add(-2*window), window)
+	store.Lock("locked", now.Add(time.Minute))
+	store.RecordFailure("expired lock", now.Add(-2*window), window)
+	store.Lock("expired lock", now.Add(-time.Minute))
+
+	store.sweep(now)
+	for key, kept := range map[string]bool{"old": false, "recent": true, "locked": true, "expired lock": false} {
+		if _, ok := store.records[key]; ok != kept {
+			t.Errorf("%s: kept %v, want %v", key, ok, kept)
+		}
+	}
+
+	// the sweep runs in the background once started and ends with Stop
+	store.RecordFailure("old", time.Now().Add(-2*window), window)
+	store.StartSweep(time.Millisecond)
+	defer store.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.Lock()
+		_, ok := store.records["old"]
+		store.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background sweep did not drop the old counter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
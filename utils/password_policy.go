@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PasswordViolation is one reason a password was rejected, Code is stable for clients to match on
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password broke
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return "password does not meet the policy: " + strings.Join(msgs, "; ")
+}
+
+type PasswordPolicy struct {
+	MinLength      int
+	MinEntropyBits float64
+	Breached       *BreachedPasswords // nil disables the breached password check
+}
+
+// the policy applied at registration, password change and reset, configured by InitPasswordPolicy
+var passwordPolicy = &PasswordPolicy{MinLength: 10, MinEntropyBits: 40}
+
+// InitPasswordPolicy reads the policy from the environment:
+//
+//	PASSWORD_MIN_LENGTH          minimum number of characters (default 10)
+//	PASSWORD_MIN_ENTROPY         minimum estimated entropy in bits (default 40)
+//	BREACHED_PASSWORDS_PATH      file of SHA-1 hashes or a directory of hash-prefix range files
+func InitPasswordPolicy() error {
+	policy := &PasswordPolicy{MinLength: 10, MinEntropyBits: 40}
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid PASSWORD_MIN_LENGTH: %q", v)
+		}
+		policy.MinLength = n
+	}
+	if v := os.Getenv("PASSWORD_MIN_ENTROPY"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid PASSWORD_MIN_ENTROPY: %q", v)
+		}
+		policy.MinEntropyBits = n
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_PATH"); path != "" {
+		breached, err := LoadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		policy.Breached = breached
+	}
+	passwordPolicy = policy
+	return nil
+}
+
+// ValidatePassword checks a new password against the configured policy, returns *PasswordPolicyError
+func ValidatePassword(password, username, email string) error {
+	return passwordPolicy.Validate(password, username, email)
+}
+
+func (p *PasswordPolicy) Validate(password, username, email string) error {
+	var violations []PasswordViolation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		add("too_short", "password must be at least %d characters long", p.MinLength)
+	}
+
+	lower := strings.ToLower(password)
+	if u := strings.ToLower(strings.TrimSpace(username)); len(u) >= 3 && strings.Contains(lower, u) {
+		add("contains_username", "password must not contain the username")
+	}
+	if local := strings.ToLower(strings.SplitN(email, "@", 2)[0]); len(local) >= 3 && strings.Contains(lower, local) {
+		add("contains_email", "password must not contain the email address")
+	}
+
+	if bits := EstimateEntropy(password); length >= p.MinLength && bits < p.MinEntropyBits {
+		add("too_weak", "password is too predictable (estimated %.0f bits, at least %.0f required)", bits, p.MinEntropyBits)
+	}
+
+	if p.Breached != nil {
+		found, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if found {
+			add("breached", "password appears in a list of breached passwords")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// EstimateEntropy gives a rough strength estimate in bits: the size of the character classes used
+// times the length, where repeated characters and runs like "abc" or "321" count for less
+func EstimateEntropy(password string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	for _, r := range runes {
+		switch {
+		case r > unicode.MaxASCII:
+			hasOther = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	pool := 0
+	if hasLower {
+		pool += 26
+	}
+	if hasUpper {
+		pool += 26
+	}
+	if hasDigit {
+		pool += 10
+	}
+	if hasSymbol {
+		pool += 33
+	}
+	if hasOther {
+		pool += 100
+	}
+	perChar := math.Log2(float64(pool))
+
+	// the first character is worth a full symbol, later ones less when they repeat or continue a sequence
+	bits := perChar
+	seen := map[rune]int{runes[0]: 1}
+	for i := 1; i < len(runes); i++ {
+		r, prev := runes[i], runes[i-1]
+		switch {
+		case r == prev:
+			bits += 1
+		case r-prev == 1 || prev-r == 1:
+			bits += 1.5
+		case seen[r] > 0:
+			bits += perChar / 2
+		default:
+			bits += perChar
+		}
+		seen[r]++
+	}
+	return bits
+}
+
+// BreachedPasswords checks passwords against known breached SHA-1 hashes, organised by the first
+// 5 hex characters of the hash like the k-anonymity range API, so the lists can be fetched ahead of
+// time and used offline. Two layouts are supported:
+//   - a file with one full hash per line, optionally followed by ":count", loaded into memory
+//   - a directory of range files named <PREFIX>.txt with "SUFFIX:count" lines, read on demand
+type BreachedPasswords struct {
+	dir    string
+	ranges map[string]map[string]struct{}
+}
+
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("breached passwords list: %w", err)
+	}
+	if info.IsDir() {
+		return &BreachedPasswords{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash := strings.ToUpper(strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)[0])
+		if len(hash) != 40 {
+			continue
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if b.ranges[prefix] == nil {
+			b.ranges[prefix] = make(map[string]struct{})
+		}
+		b.ranges[prefix][suffix] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	if b.dir == "" {
+		_, found := b.ranges[prefix][suffix]
+		return found, nil
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.EqualFold(strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)[0], suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
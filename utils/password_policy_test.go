@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEstimateEntropy(t *testing.T) {
+	lower := math.Log2(26)
+	tests := []struct {
+		password string
+		bits     float64
+	}{
+		{"", 0},
+		{"a", lower},
+		{"aaaa", lower + 3},           // repeats count one bit each
+		{"abcd", lower + 3*1.5},       // so do runs, up or down
+		{"dcba", lower + 3*1.5},       //
+		{"abab", lower + 3*1.5},       // every step continues a run
+		{"axax", lower*2 + lower/2*2}, // characters seen before count half
+		{"aA1!", 4 * math.Log2(26+26+10+33)},
+		{"ää", math.Log2(100) + 1},
+	}
+	for _, tt := range tests {
+		if got := EstimateEntropy(tt.password); math.Abs(got-tt.bits) > 1e-9 {
+			t.Errorf("EstimateEntropy(%q) = %.2f, want %.2f", tt.password, got, tt.bits)
+		}
+	}
+}
+
+func violationCodes(err error) []string {
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	codes := []string{}
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestValidatePassword(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 10, MinEntropyBits: 40}
+	tests := []struct {
+		password string
+		codes    []string // nil when accepted
+	}{
+		{"correct horse battery staple", nil},
+		{"Tr0ub4dor&3x", nil},
+		{"k8#Vq2!mZp", nil},
+		{"short1!", []string{"too_short"}},
+		{"aaaaaaaaaaaaaaaaaaaa", []string{"too_weak"}},
+		{"abcdefghijklmnop", []string{"too_weak"}},
+		{"1234567890", []string{"too_weak"}},
+		{"alice-Xq9#vLm2", []string{"contains_username"}},
+		{"xQ9#vLm2-ALICE.SMITH", []string{"contains_username", "contains_email"}},
+		{"ALICE!", []string{"too_short", "contains_username"}},
+	}
+	for _, tt := range tests {
+		err := policy.Validate(tt.password, "alice", "alice.smith@example.com")
+		if tt.codes == nil && err != nil {
+			t.Errorf("%q: got %v, want it accepted", tt.password, err)
+		}
+		if tt.codes != nil && !reflect.DeepEqual(violationCodes(err), tt.codes) {
+			t.Errorf("%q: got %v, want %v", tt.password, err, tt.codes)
+		}
+	}
+	// short names are not checked, they would reject too many passwords
+	if err := policy.Validate("bo-Xq9#vLm2z", "bo", "bo@example.com"); err != nil {
+		t.Errorf("two letter username: %s", err)
+	}
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	if hash := sha1Hex("password"); hash != "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8" {
+		t.Fatalf("sha1(password) = %s", hash)
+	}
+	breached := sha1Hex("password")
+	// same range as "password" but another suffix, must not match
+	sibling := breached[:39] + "0"
+
+	dir := t.TempDir()
+	list := filepath.Join(dir, "hashes.txt")
+	content := strings.Join([]string{
+		strings.ToLower(breached) + ":3861493", // hashes and counts as published, case does not matter
+		sha1Hex("letmein"),
+		"not a hash",
+	}, "\n")
+	if err := os.WriteFile(list, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ranges := filepath.Join(dir, "ranges")
+	os.Mkdir(ranges, 0700)
+	rangeFile := strings.Join([]string{sibling[5:] + ":1", strings.ToLower(breached[5:]) + ":3861493"}, "\r\n")
+	if err := os.WriteFile(filepath.Join(ranges, breached[:5]+".txt"), []byte(rangeFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	letmein := sha1Hex("letmein")
+	if err := os.WriteFile(filepath.Join(ranges, letmein[:5]+".txt"), []byte(letmein[5:]+":1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		found    bool
+	}{
+		{"password", true},
+		{"letmein", true},
+		{"Password", false},
+		{"correct horse battery staple", false}, // its range file does not exist
+	}
+	for _, path := range []string{list, ranges} {
+		b, err := LoadBreachedPasswords(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			found, err := b.Contains(tt.password)
+			if err != nil || found != tt.found {
+				t.Errorf("%s: Contains(%q) = %v %v, want %v", filepath.Base(path), tt.password, found, err, tt.found)
+			}
+		}
+		// only the suffix within the prefix's range matches
+		if b.dir == "" {
+			if _, ok := b.ranges[breached[:5]][sibling[5:]]; ok {
+				t.Errorf("%s: the sibling hash was loaded", filepath.Base(path))
+			}
+		}
+
+		policy := &PasswordPolicy{MinLength: 1, Breached: b}
+		if codes := violationCodes(policy.Validate("password", "", "")); !reflect.DeepEqual(codes, []string{"breached"}) {
+			t.Errorf("%s: got %v, want breached", filepath.Base(path), codes)
+		}
+	}
+
+	if _, err := LoadBreachedPasswords(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing list was accepted")
+	}
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"task-manager-api/models"
+)
+
+const (
+	ScopeTasksRead  = "tasks:read"
+	ScopeTasksWrite = "tasks:write"
+	ScopeAccount    = "account" // manage the caller's own account, API keys etc.
+	ScopeAdmin      = "admin"
+)
+
+// all scopes that can be granted to a token or API key
+var KnownScopes = []string{ScopeTasksRead, ScopeTasksWrite, ScopeAccount, ScopeAdmin}
+
+func IsKnownScope(scope string) bool {
+	for _, s := range KnownScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// the scopes a full login token gets for the given role
+func DefaultScopes(role string) []string {
+	scopes := []string{ScopeTasksRead, ScopeTasksWrite, ScopeAccount}
+	if role == models.RoleAdmin {
+		scopes = append(scopes, ScopeAdmin)
+	}
+	return scopes
+}
+
+// check that every requested scope is known and may be granted to the role,
+// an empty request means the default scopes of the role
+func ResolveScopes(requested []string, role string) ([]string, error) {
+	if len(requested) == 0 {
+		return DefaultScopes(role), nil
+	}
+	allowed := DefaultScopes(role)
+	for _, scope := range requested {
+		if !IsKnownScope(scope) {
+			return nil, &ScopeError{Scope: scope, Reason: "unknown scope"}
+		}
+		if !containsScope(allowed, scope) {
+			return nil, &ScopeError{Scope: scope, Reason: "scope not allowed for role " + role}
+		}
+	}
+	return requested, nil
+}
+
+// the scopes of a token or API key the role still allows, e.g. after the user lost the admin role.
+// No scopes means the defaults of the role, the result is empty when none of the scopes is allowed
+func RestrictScopes(scopes []string, role string) []string {
+	allowed := DefaultScopes(role)
+	if len(scopes) == 0 {
+		return allowed
+	}
+	effective := []string{}
+	for _, scope := range scopes {
+		if containsScope(allowed, scope) {
+			effective = append(effective, scope)
+		}
+	}
+	return effective
+}
+
+type ScopeError struct {
+	Scope  string
+	Reason string
+}
+
+func (e *ScopeError) Error() string {
+	return e.Reason + ": " + e.Scope
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the claims grant the scope. Tokens issued before scopes existed
+// carry none and keep the default scopes of the user's role
+func (c *CustomClaims) HasScope(scope string) bool {
+	if c.Scopes == nil {
+		return containsScope(DefaultScopes(c.Role), scope)
+	}
+	return containsScope(c.Scopes, scope)
+}
+
+// RequireScope rejects requests whose token or API key lacks any of the given scopes with 403,
+// naming the missing scope. Must be wrapped by JWTAuthMiddleware
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("claims").(*CustomClaims)
+			if !ok {
+				http.Error(w, "Could not extract user claims", http.StatusUnauthorized)
+				return
+			}
+			for _, scope := range scopes {
+				if !claims.HasScope(scope) {
+					writeInsufficientScope(w, scope)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeInsufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":         "insufficient_scope",
+		"missing_scope": scope,
+		"message":       "token is missing the required scope " + scope,
+	})
+}
+
+// parse a space or comma separated scope list
+func ParseScopes(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+}
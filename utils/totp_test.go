@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the shared secret of the RFC 4226 and RFC 6238 SHA-1 test vectors
+const rfcSecret = "12345678901234567890"
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := totpCode([]byte(rfcSecret), int64(counter)); got != code {
+			t.Errorf("counter %d: got %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1. The RFC lists 8 digit codes, these are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	secret := totpEncoding.EncodeToString([]byte(rfcSecret))
+	for _, tt := range tests {
+		got, err := TOTPCode(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+	// secrets are accepted in lower case too
+	if got, _ := TOTPCode(strings.ToLower(secret), time.Unix(59, 0)); got != "287082" {
+		t.Errorf("lower case secret: got %s", got)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfcSecret))
+	now := time.Unix(1111111111, 0) // step 37037037
+	step := now.Unix() / totpPeriod
+	codeAt := func(offset int64) string {
+		return totpCode([]byte(rfcSecret), step+offset)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current step", codeAt(0), true, step},
+		{"one step behind", codeAt(-1), true, step - 1},
+		{"one step ahead", codeAt(1), true, step + 1},
+		{"two steps behind", codeAt(-2), false, 0},
+		{"two steps ahead", codeAt(2), false, 0},
+		{"spaces are ignored", " " + codeAt(0)[:3] + " " + codeAt(0)[3:] + " ", true, step},
+		{"too short", codeAt(0)[:5], false, 0},
+		{"too long", codeAt(0) + "1", false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		got, ok := ValidateTOTP(secret, tt.code, now)
+		if ok != tt.ok || got != tt.step {
+			t.Errorf("%s: got step %d ok %v, want step %d ok %v", tt.name, got, ok, tt.step, tt.ok)
+		}
+	}
+	if _, ok := ValidateTOTP("not base32!", codeAt(0), now); ok {
+		t.Error("invalid secret: accepted a code")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || code != NormalizeRecoveryCode(code) || seen[code] {
+			t.Errorf("bad or repeated recovery code %q", code)
+		}
+		seen[code] = true
+	}
+
+	tests := []struct{ input, want string }{
+		{"abcde-fghij", "abcde-fghij"},
+		{"ABCDE-FGHIJ", "abcde-fghij"},
+		{"  abcde-fghij\n", "abcde-fghij"},
+		{"abcdefghij", "abcde-fghij"},
+		{"abcde fghij", "abcde-fghij"},
+		{"abc de-fg hij", "abcde-fghij"},
+		// anything else is left for the lookup to reject
+		{"abcdefghijk", "abcdefghijk"},
+		{"abcde--fghij", "abcde--fghij"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.input); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -2,7 +2,13 @@ package utils
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
@@ -15,12 +21,33 @@ import (
 )
 
 type CustomClaims struct {
-	Email    string `json:"email"`
-	Username string `json:"username"`
+	Email    string   `json:"email"`
+	Username string   `json:"username"`
+	Role     string   `json:"role"`
+	Scopes   []string `json:"scopes,omitempty"`
+	APIKeyID int      `json:"api_key_id,omitempty"` // set when the request was authenticated with an API key
+	Purpose  string   `json:"purpose,omitempty"`    // set on tokens that are not access tokens, e.g. PurposeTwoFactor
+	Sid      string   `json:"sid,omitempty"`        // login session the token belongs to
 	jwt.StandardClaims
 }
 
-var JWT_SECRET string = os.Getenv("SECRET_KEY")
+// lifetime of access tokens issued at login
+const AccessTokenTTL = 24 * time.Hour
+
+// lifetime of refresh tokens, a session that is not refreshed for this long expires
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// PurposeRefresh marks refresh tokens, they can only be used at /token/refresh
+const PurposeRefresh = "refresh"
+
+// SessionCheck is called by JWTAuthMiddleware for tokens tied to a login session, a non nil error
+// rejects the request (e.g. the session was revoked). Set by routes.NewRouter
+var SessionCheck func(sessionID, email string) error
+
+// AccountStatusCheck is called by JWTAuthMiddleware on every request with the email from the token,
+// a non nil error rejects the request (e.g. the account was disabled after the token was issued).
+// It returns the current role of the account, which replaces the role in the claims
+var AccountStatusCheck func(email string) (string, error)
 
 func HashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -52,45 +79,290 @@ func IsEmailExists(email string, DB *sql.DB) (bool, error) {
 	return exists, nil
 }
 
-func GenerateToken(user models.Users) (string, error) {
+// generate an access token for the user's login session limited to the given scopes
+func GenerateToken(user models.Users, scopes []string, sessionID string) (string, error) {
 	claims := &CustomClaims{
 		Email:    user.Email,
 		Username: user.Username,
+		Role:     user.Role,
+		Scopes:   scopes,
+		Sid:      sessionID,
 		StandardClaims: jwt.StandardClaims{
 			Subject:   user.Email,
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(AccessTokenTTL).Unix(),
 		},
 	}
+	return signClaims(claims)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(JWT_SECRET))
+// generate a refresh token for the session, tokenID is stored with the session so every refresh
+// token can be used once
+func GenerateRefreshToken(user models.Users, scopes []string, sessionID, tokenID string) (string, error) {
+	claims := &CustomClaims{
+		Email:    user.Email,
+		Username: user.Username,
+		Role:     user.Role,
+		Scopes:   scopes,
+		Sid:      sessionID,
+		Purpose:  PurposeRefresh,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			Subject:   user.Email,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(RefreshTokenTTL).Unix(),
+		},
+	}
+	return signClaims(claims)
+}
 
+func signClaims(claims jwt.Claims) (string, error) {
+	if keyring == nil {
+		return "", errors.New("token signing is not initialised")
+	}
+	return keyring.Sign(claims)
 }
 
+// PurposeTwoFactor marks the short lived token given to a user who passed the password
+// check but still has to provide a second factor
+const PurposeTwoFactor = "2fa"
+
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// generate a challenge token that can only be exchanged at /login/2fa, never used for API access
+func GenerateChallengeToken(user models.Users, scopes []string) (string, error) {
+	claims := &CustomClaims{
+		Email:    user.Email,
+		Username: user.Username,
+		Role:     user.Role,
+		Scopes:   scopes,
+		Purpose:  PurposeTwoFactor,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   user.Email,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(twoFactorChallengeTTL).Unix(),
+		},
+	}
+	return signClaims(claims)
+}
+
+// parse and validate a token signed by this API
+func ParseToken(tokenStr string) (*CustomClaims, error) {
+	if keyring == nil {
+		return nil, errors.New("token signing is not initialised")
+	}
+	claims := &CustomClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, keyring.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// how often long lived connections like event streams call CheckCredentials
+var CredentialCheckInterval = time.Minute
+
+// CheckCredentials repeats the checks JWTAuthMiddleware made for claims it accepted earlier, so a
+// connection that outlives the request notices an expired token, a revoked session or API key
+// and a disabled account
+func CheckCredentials(claims *CustomClaims) error {
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return errors.New("token expired")
+	}
+	if claims.Sid != "" && SessionCheck != nil {
+		if err := SessionCheck(claims.Sid, claims.Email); err != nil {
+			return err
+		}
+	}
+	if claims.APIKeyID != 0 && APIKeyStatusCheck != nil {
+		if err := APIKeyStatusCheck(claims.APIKeyID); err != nil {
+			return err
+		}
+	}
+	if AccountStatusCheck != nil {
+		if _, err := AccountStatusCheck(claims.Email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JWTAuthMiddleware authenticates the request with either a JWT or a personal API key.
+// API keys are accepted in the X-API-Key header or as a bearer token, JWTs as a bearer token.
 func JWTAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the token from the Authorization header
-		tokenStr := r.Header.Get("Authorization")
-		if tokenStr == "" {
-			http.Error(w, "Authorization header is required", http.StatusUnauthorized)
-			return
-		}
+		var claims *CustomClaims
 
+		tokenStr := r.Header.Get("Authorization")
 		// Remove "Bearer " from the token string if it's included
 		tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" && IsAPIKey(tokenStr) {
+			apiKey = tokenStr
+		}
 
-		claims := &CustomClaims{}
-		_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(JWT_SECRET), nil
-		})
-
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		switch {
+		case apiKey != "":
+			if APIKeyAuthenticator == nil {
+				http.Error(w, "API keys are not supported", http.StatusUnauthorized)
+				return
+			}
+			var err error
+			claims, err = APIKeyAuthenticator(apiKey, ClientIP(r))
+			if err != nil {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+		case tokenStr != "":
+			var err error
+			claims, err = ParseToken(tokenStr)
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			// challenge tokens and the like only work on their own endpoint
+			if claims.Purpose != "" {
+				http.Error(w, "Token cannot be used for API access", http.StatusUnauthorized)
+				return
+			}
+			// tokens issued before sessions existed have no sid, they simply run out
+			if claims.Sid != "" && SessionCheck != nil {
+				if err := SessionCheck(claims.Sid, claims.Email); err != nil {
+					http.Error(w, "Session is no longer valid: "+err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+		default:
+			http.Error(w, "Authorization header is required", http.StatusUnauthorized)
 			return
 		}
 
+		if AccountStatusCheck != nil {
+			role, err := AccountStatusCheck(claims.Email)
+			if err != nil {
+				http.Error(w, "Account is not active: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			// a user demoted after the token was issued loses the old role right away
+			claims.Role = role
+		}
+
 		// Set claims in context
 		ctx := context.WithValue(r.Context(), "claims", claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// reverse proxies whose client address header ClientIP believes, set by ConfigureClientIP
+var (
+	trustedProxies []*net.IPNet
+	clientIPHeader = "X-Forwarded-For"
+)
+
+// ConfigureClientIP reads TRUSTED_PROXIES, a comma separated list of IP addresses or CIDR ranges of
+// reverse proxies, and CLIENT_IP_HEADER, the header they put the client address in (default
+// X-Forwarded-For). Without trusted proxies the connection's address is used, so behind a proxy
+// all clients share the proxy's address, e.g. for login attempt limits
+func ConfigureClientIP() error {
+	if header := os.Getenv("CLIENT_IP_HEADER"); header != "" {
+		clientIPHeader = http.CanonicalHeaderKey(header)
+	}
+	trustedProxies = nil
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// get the client IP address from the request, without the port. When the connection comes from a
+// trusted proxy the address is taken from its header instead: X-Forwarded-For is read from the
+// right, the first address that is not a trusted proxy is the client
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	values := r.Header.Values(clientIPHeader)
+	if len(values) == 0 {
+		return host
+	}
+	addrs := strings.Split(strings.Join(values, ","), ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if net.ParseIP(addr) == nil {
+			// the rest was written by the client or a proxy we do not know
+			return host
+		}
+		if !isTrustedProxy(addr) || i == 0 {
+			return addr
+		}
+	}
+	return host
+}
+
+// RequireRole only lets requests through when the user claims (set by JWTAuthMiddleware) hold one of the given roles.
+// JWTAuthMiddleware puts the current role from AccountStatusCheck in the claims, not the one the token was issued with
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("claims").(*CustomClaims)
+			if !ok {
+				http.Error(w, "Could not extract user claims", http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if claims.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "Forbidden: requires role "+strings.Join(roles, " or "), http.StatusForbidden)
+		})
+	}
+}
+
+// generate a random hex encoded token from n random bytes
+func GenerateRandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hash a high entropy token for storage, tokens are random so a fast hash is enough
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
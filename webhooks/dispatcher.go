@@ -0,0 +1,208 @@
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery is one queued request to a webhook
+type Delivery struct {
+	ID        int64
+	WebhookID int
+	URL       string
+	Secret    string
+	EventType string
+	Payload   []byte
+	Attempts  int // attempts made before this one
+}
+
+// Result is the outcome of one attempt
+type Result struct {
+	StatusCode int // 0 when no response was received
+	Error      string
+	Duration   time.Duration
+}
+
+// OK reports if the receiver accepted the delivery with a 2xx status
+func (r Result) OK() bool {
+	return r.Error == "" && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// Store holds the queue of deliveries, implemented by the db package
+type Store interface {
+	// ClaimDue returns up to limit deliveries that are due and hides them from other claims for
+	// lease, so a crashed dispatcher's deliveries are retried
+	ClaimDue(limit int, lease time.Duration) ([]Delivery, error)
+	// RecordAttempt stores the result of an attempt. retryAt is when to try again, nil when the
+	// delivery succeeded or gave up
+	RecordAttempt(d Delivery, res Result, retryAt *time.Time) error
+}
+
+// Dispatcher sends due deliveries and schedules retries
+type Dispatcher struct {
+	Store       Store
+	Client      *http.Client
+	MaxAttempts int           // attempts before a delivery is marked failed
+	BaseDelay   time.Duration // wait after the first failure, doubled after every further one
+	MaxDelay    time.Duration
+	BatchSize   int // deliveries claimed at once, they are sent concurrently
+	Lease       time.Duration
+	Now         func() time.Time
+
+	wake chan struct{}
+}
+
+// defaults of NewDispatcher
+const (
+	DefaultMaxAttempts = 8
+	DefaultBaseDelay   = 30 * time.Second
+	DefaultMaxDelay    = 6 * time.Hour
+	requestTimeout     = 10 * time.Second
+	maxResponseBody    = 64 << 10
+)
+
+// NewDispatcher returns a dispatcher with the default retry policy. Unless allowPrivate is set the
+// HTTP client refuses to connect to loopback and private network addresses
+func NewDispatcher(store Store, allowPrivate bool) *Dispatcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	transport := &http.Transport{
+		Proxy:               nil, // a proxy would hide the address the dialer checks
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}
+	return &Dispatcher{
+		Store: store,
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   requestTimeout,
+			// a redirect could point anywhere, receivers have to answer themselves
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		MaxAttempts: DefaultMaxAttempts,
+		BaseDelay:   DefaultBaseDelay,
+		MaxDelay:    DefaultMaxDelay,
+		BatchSize:   20,
+		Lease:       2 * requestTimeout,
+		Now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Backoff is the wait before the next attempt after the given number of failed attempts
+func (d *Dispatcher) Backoff(failures int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= d.MaxDelay {
+			return d.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Send makes one attempt to deliver, signing the payload with the current time
+func (d *Dispatcher) Send(delivery Delivery) Result {
+	start := d.Now()
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-manager-webhooks/1")
+	req.Header.Set(HeaderWebhookID, strconv.Itoa(delivery.WebhookID))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	res := Result{Duration: d.Now().Sub(start)}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	// drain a bounded amount so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+	res.StatusCode = resp.StatusCode
+	if !res.OK() {
+		res.Error = fmt.Sprintf("receiver responded %s", resp.Status)
+	}
+	return res
+}
+
+// deliver one claimed delivery and record the outcome
+func (d *Dispatcher) deliver(delivery Delivery) {
+	res := d.Send(delivery)
+	var retryAt *time.Time
+	if !res.OK() && delivery.Attempts+1 < d.MaxAttempts {
+		at := d.Now().Add(d.Backoff(delivery.Attempts + 1))
+		retryAt = &at
+	}
+	if err := d.Store.RecordAttempt(delivery, res, retryAt); err != nil {
+		log.Printf("Error recording webhook delivery %d: %s", delivery.ID, err)
+	}
+}
+
+// RunOnce sends the deliveries that are due, returns how many were attempted
+func (d *Dispatcher) RunOnce() (int, error) {
+	due, err := d.Store.ClaimDue(d.BatchSize, d.Lease)
+	if err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for _, delivery := range due {
+		wg.Add(1)
+		go func(delivery Delivery) {
+			defer wg.Done()
+			d.deliver(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// Wake makes Run look for due deliveries now instead of at the next tick, e.g. after new ones
+// were queued
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries every interval until stop is closed
+func (d *Dispatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// keep going while full batches come back, there is more waiting
+		for {
+			n, err := d.RunOnce()
+			if err != nil {
+				log.Printf("Error sending webhooks: %s", err)
+			}
+			if err != nil || n < d.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
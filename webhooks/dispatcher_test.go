@@ -0,0 +1,293 @@
+package webhooks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a delivery queue in memory, like the deliveries table of the db package
+type memoryStore struct {
+	mu         sync.Mutex
+	now        func() time.Time
+	nextID     int64
+	deliveries map[int64]*storedDelivery
+}
+
+type storedDelivery struct {
+	Delivery
+	nextAttempt time.Time
+	done        bool // delivered or given up
+	results     []Result
+}
+
+func newMemoryStore(now func() time.Time) *memoryStore {
+	return &memoryStore{now: now, deliveries: map[int64]*storedDelivery{}}
+}
+
+// queue a delivery that is due now, returns its ID
+func (s *memoryStore) queue(d Delivery) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	d.ID, d.Attempts = s.nextID, 0
+	s.deliveries[d.ID] = &storedDelivery{Delivery: d, nextAttempt: s.now()}
+	return d.ID
+}
+
+// queue the delivery again under a new ID, like db.RedeliverWebhook
+func (s *memoryStore) redeliver(id int64) int64 {
+	s.mu.Lock()
+	d := s.deliveries[id].Delivery
+	s.mu.Unlock()
+	return s.queue(d)
+}
+
+func (s *memoryStore) get(id int64) storedDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.deliveries[id]
+}
+
+func (s *memoryStore) ClaimDue(limit int, lease time.Duration) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	due := []Delivery{}
+	for _, d := range s.deliveries {
+		if !d.done && !d.nextAttempt.After(now) && len(due) < limit {
+			d.nextAttempt = now.Add(lease)
+			due = append(due, d.Delivery)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStore) RecordAttempt(d Delivery, res Result, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.deliveries[d.ID]
+	stored.Attempts++
+	stored.results = append(stored.results, res)
+	if retryAt == nil {
+		stored.done = true
+	} else {
+		stored.nextAttempt = *retryAt
+	}
+	return nil
+}
+
+// received is one request that reached the test receiver
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver answers with the given statuses in turn, the last one repeats
+func startReceiver(t *testing.T, statuses ...int) (*httptest.Server, func() []received) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []received
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{r.Header.Clone(), body})
+		status := statuses[len(statuses)-1]
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received(nil), requests...)
+	}
+}
+
+// a clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func runOnce(t *testing.T, d *Dispatcher, want int) {
+	t.Helper()
+	n, err := d.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("RunOnce attempted %d deliveries, want %d", n, want)
+	}
+}
+
+// check that a received request is a correctly signed delivery of d
+func checkSigned(t *testing.T, r received, d Delivery, now time.Time) {
+	t.Helper()
+	h := r.header
+	if err := Verify(d.Secret, h.Get(HeaderTimestamp), h.Get(HeaderSignature), r.body, 5*time.Minute, now); err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if err := Verify("other secret", h.Get(HeaderTimestamp), h.Get(HeaderSignature), r.body, 5*time.Minute, now); err != ErrInvalidSignature {
+		t.Fatalf("Verify with the wrong secret: got %v, want ErrInvalidSignature", err)
+	}
+	if h.Get(HeaderEvent) != d.EventType || h.Get(HeaderWebhookID) != strconv.Itoa(d.WebhookID) ||
+		h.Get(HeaderDelivery) != strconv.FormatInt(d.ID, 10) || string(r.body) != string(d.Payload) {
+		t.Fatalf("got headers %v and body %s for delivery %+v", h, r.body, d)
+	}
+}
+
+func TestDispatcherRetriesAndRedelivers(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)}
+	store := newMemoryStore(clock.Now)
+	ts, requests := startReceiver(t, http.StatusInternalServerError, http.StatusOK)
+
+	d := NewDispatcher(store, true)
+	d.Now = clock.Now
+	delivery := Delivery{WebhookID: 7, URL: ts.URL + "/hooks", Secret: "s3cret", EventType: TaskCreated,
+		Payload: []byte(`{"task": {"id": 1}}`)}
+	delivery.ID = store.queue(delivery)
+
+	// the first attempt fails and is scheduled after the first backoff step
+	runOnce(t, d, 1)
+	first := store.get(delivery.ID)
+	if first.done || first.Attempts != 1 || first.results[0].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("after a 500: %+v", first)
+	}
+	if want := clock.Now().Add(d.Backoff(1)); !first.nextAttempt.Equal(want) {
+		t.Fatalf("retry at %s, want %s", first.nextAttempt, want)
+	}
+	checkSigned(t, requests()[0], delivery, clock.Now())
+
+	// nothing is due until the backoff has passed
+	clock.Advance(d.Backoff(1) - time.Second)
+	runOnce(t, d, 0)
+	clock.Advance(time.Second)
+	runOnce(t, d, 1)
+	second := store.get(delivery.ID)
+	if !second.done || second.Attempts != 2 || !second.results[1].OK() {
+		t.Fatalf("after the retry: %+v", second)
+	}
+	checkSigned(t, requests()[1], delivery, clock.Now())
+
+	// a redelivery is a new delivery of the same payload, signed again when it is sent
+	clock.Advance(time.Hour)
+	redelivery := delivery
+	redelivery.ID = store.redeliver(delivery.ID)
+	runOnce(t, d, 1)
+	if got := store.get(redelivery.ID); !got.done || got.Attempts != 1 {
+		t.Fatalf("redelivery: %+v", got)
+	}
+	all := requests()
+	if len(all) != 3 {
+		t.Fatalf("receiver got %d requests, want 3", len(all))
+	}
+	checkSigned(t, all[2], redelivery, clock.Now())
+	if all[2].header.Get(HeaderSignature) == all[1].header.Get(HeaderSignature) {
+		t.Fatal("redelivery reused the old signature")
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)}
+	store := newMemoryStore(clock.Now)
+	ts, requests := startReceiver(t, http.StatusServiceUnavailable)
+
+	d := NewDispatcher(store, true)
+	d.Now = clock.Now
+	d.MaxAttempts = 3
+	id := store.queue(Delivery{WebhookID: 1, URL: ts.URL, Secret: "s", EventType: TaskDeleted, Payload: []byte(`{}`)})
+
+	for i := 1; i <= d.MaxAttempts; i++ {
+		runOnce(t, d, 1)
+		clock.Advance(d.Backoff(i))
+	}
+	runOnce(t, d, 0)
+	if got := store.get(id); !got.done || got.Attempts != 3 || len(requests()) != 3 {
+		t.Fatalf("after %d failures: %+v, %d requests", d.MaxAttempts, got, len(requests()))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(newMemoryStore(time.Now), false)
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, w := range want {
+		if got := d.Backoff(i + 1); got != w {
+			t.Errorf("Backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+	if got := d.Backoff(20); got != DefaultMaxDelay {
+		t.Errorf("Backoff(20) = %s, want the maximum %s", got, DefaultMaxDelay)
+	}
+}
+
+func TestDispatcherRefusesPrivateNetworks(t *testing.T) {
+	store := newMemoryStore(time.Now)
+	ts, requests := startReceiver(t, http.StatusOK)
+	d := NewDispatcher(store, false)
+	res := d.Send(Delivery{ID: 1, URL: ts.URL, Secret: "s", EventType: TaskCreated, Payload: []byte(`{}`)})
+	if res.OK() || len(requests()) != 0 {
+		t.Fatalf("delivery to %s: got %+v, want it refused", ts.URL, res)
+	}
+}
+
+func TestRefusePrivate(t *testing.T) {
+	tests := []struct {
+		address string
+		denied  bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"8.8.8.8:80", false},
+		{"127.0.0.1:80", true},
+		{"10.1.2.3:80", true},
+		{"172.16.0.1:80", true},
+		{"172.32.0.1:80", false},
+		{"192.168.1.1:80", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:80", true},
+		{"100.127.255.254:80", true},
+		{"100.128.0.1:80", false},
+		{"192.0.0.8:80", true},
+		{"198.18.0.1:80", true},
+		{"0.0.0.0:80", true},
+		{"224.0.0.1:80", true},
+		{"255.255.255.255:80", true},
+		{"[::1]:80", true},
+		{"[::]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:100.64.0.1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[2002:a00:1::1]:80", true},
+		{"[ff02::1]:80", true},
+	}
+	for _, tt := range tests {
+		err := refusePrivate("tcp", tt.address, nil)
+		if (err != nil) != tt.denied {
+			t.Errorf("refusePrivate(%s) = %v, want denied %v", tt.address, err, tt.denied)
+		}
+	}
+	if err := refusePrivate("tcp", "no-port", nil); err == nil {
+		t.Error("refusePrivate accepted an address without a port")
+	}
+}
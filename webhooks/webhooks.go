@@ -0,0 +1,178 @@
+// Package webhooks delivers events to user registered URLs. Deliveries are queued by the db layer
+// in the transaction of the change that caused them and sent by a Dispatcher, which signs every
+// request and retries failures with exponential backoff.
+//
+// A delivery is a POST with a JSON body and the headers
+//
+//	X-Webhook-Id          the webhook
+//	X-Webhook-Event       the event type, e.g. task.created
+//	X-Webhook-Delivery    the delivery, redeliveries get a new one
+//	X-Webhook-Timestamp   Unix seconds when the request was signed
+//	X-Webhook-Signature   v1=<hex HMAC-SHA256 of "<timestamp>.<body>" with the webhook secret>
+//
+// Receivers check the signature with Verify and reject old timestamps to prevent replays.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// event types a webhook can subscribe to
+const (
+	TaskCreated   = "task.created"
+	TaskCompleted = "task.completed"
+	TaskDeleted   = "task.deleted"
+	CommentAdded  = "comment.added"
+)
+
+// EventTypes lists the event types in the order they are documented
+var EventTypes = []string{TaskCreated, TaskCompleted, TaskDeleted, CommentAdded}
+
+// check if t is a known event type
+func IsEventType(t string) bool {
+	for _, known := range EventTypes {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// request headers of a delivery
+const (
+	HeaderWebhookID = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const signaturePrefix = "v1="
+
+// Sign computes the X-Webhook-Signature value of a body sent at timestamp (Unix seconds)
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrStaleTimestamp   = errors.New("webhook timestamp is outside the accepted window")
+)
+
+// Verify checks the timestamp and signature headers of a received delivery, tolerance is how far
+// the timestamp may be from now
+func Verify(secret, timestamp, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	if math.Abs(float64(now.Unix()-ts)) > tolerance.Seconds() {
+		return ErrStaleTimestamp
+	}
+	if !hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ValidateURL checks a webhook URL: absolute http or https without credentials
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook URL must use http or https")
+	}
+	if u.User != nil {
+		return fmt.Errorf("webhook URL must not contain credentials")
+	}
+	if len(raw) > 2000 {
+		return fmt.Errorf("webhook URL is longer than 2000 characters")
+	}
+	return nil
+}
+
+var errPrivateAddress = errors.New("webhook URL resolves to a private or local address")
+
+// networks webhooks may not connect to: everything that is not globally routable plus ranges that
+// embed such addresses. IPv4-mapped IPv6 addresses are matched against the IPv4 ranges
+var deniedNetworks = parseCIDRs(
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local, includes cloud metadata endpoints
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard
+	"2001::/23",       // IETF protocol assignments, includes Teredo
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, embeds IPv4 addresses
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link local
+	"fec0::/10",       // site local
+	"ff00::/8",        // multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// check if webhooks may not connect to the address
+func isDenied(ip net.IP) bool {
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialer Control function that refuses the addresses in deniedNetworks, so webhooks cannot reach
+// internal services. The check runs on the resolved address, DNS names pointing inside the
+// network are refused as well
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil || isDenied(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}